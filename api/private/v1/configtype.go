@@ -1,23 +1,228 @@
 package v1
 
 type WaitConfig struct {
-	Endpoint              string    `json:"endpoint"`
-	Duration              string    `json:"duration"`
-	AuthorizedKeys        []string  `json:"authorized_keys"`
-	AuthorizedGithubUsers []string  `json:"authorized_github_users"`
-	Shell                 []string  `json:"shell"`
-	AllowedSSHUsers       []string  `json:"allowed_ssh_users"`
-	Enable                []string  `json:"enable"`
-	Webhooks              []Webhook `json:"webhooks"`
-	SlackBot              *SlackBot `json:"slack_bot"`
+	Endpoint                   string            `json:"endpoint"`
+	Duration                   string            `json:"duration"`
+	MaxDuration                string            `json:"max_duration"`   // Upper bound on the total duration, including extensions.
+	MaxExtension               string            `json:"max_extension"`  // Upper bound of each extension.
+	MaxExtensions              int               `json:"max_extensions"` // How many times the breakpoint can be extended.
+	AuthorizedKeys             []string          `json:"authorized_keys"`
+	AuthorizedGithubUsers      []string          `json:"authorized_github_users"`
+	AuthorizedGithubTeams      []string          `json:"authorized_github_teams"` // As org/team-slug.
+	AuthorizedGithubOrgMembers []string          `json:"authorized_github_org_members"`
+	AuthorizeActor             bool              `json:"authorize_actor"`         // Authorizes $GITHUB_ACTOR and $GITHUB_TRIGGERING_ACTOR.
+	AuthorizeCollaborators     string            `json:"authorize_collaborators"` // Minimum permission of authorized collaborators, e.g. "push".
+	KeySources                 []KeySource       `json:"key_sources"`
+	KeyFetch                   *KeyFetch         `json:"key_fetch"`
+	KeyRefresh                 string            `json:"key_refresh"`        // How often authorized keys are resolved again while waiting.
+	DisconnectRevoked          bool              `json:"disconnect_revoked"` // Close connections whose key is no longer authorized after a refresh.
+	GithubAPIURL               string            `json:"github_api_url"`     // Defaults to ${GITHUB_API_URL}, or https://api.github.com.
+	GithubToken                string            `json:"github_token"`       // Used to resolve teams and organizations, defaults to ${GITHUB_TOKEN}.
+	Shell                      []string          `json:"shell"`
+	WorkingDir                 string            `json:"working_dir"` // Where sessions start; environment variables are expanded.
+	RunAs                      *RunAs            `json:"run_as"`
+	Sftp                       *Sftp             `json:"sftp"`
+	SessionEnv                 *SessionEnv       `json:"session_env"`
+	SessionOverrides           []SessionOverride `json:"session_overrides"` // The first override which applies to a key is used.
+	AllowedSSHUsers            []string          `json:"allowed_ssh_users"`
+	SharedTerminal             bool              `json:"shared_terminal"`     // Interactive sessions attach to a single, shared terminal.
+	Observers                  []string          `json:"observers"`           // Owners (or key fingerprints) which may only observe the shared terminal.
+	PersistentSessions         bool              `json:"persistent_sessions"` // Interactive shells survive disconnects, and can be reattached to.
+	AccessPolicies             []AccessPolicy    `json:"access_policies"`     // The first policy which applies to a key is used.
+	Enable                     []string          `json:"enable"`
+	Webhooks                   []Webhook         `json:"webhooks"`
+	SlackBot                   *SlackBot         `json:"slack_bot"`
+	Discord                    *Discord          `json:"discord"`
+	Teams                      *Teams            `json:"teams"`
+	Mattermost                 *Mattermost       `json:"mattermost"`
+	Email                      *Email            `json:"email"`
+	GitHub                     *GitHub           `json:"github"`
+	Control                    *ControlConfig    `json:"control"`
+	AutoResume                 *AutoResume       `json:"auto_resume"`
+	ExpiredExitCode            int               `json:"expired_exit_code"`    // Exit code of `breakpoint wait` when the breakpoint expires.
+	CancelJobOnExpiry          bool              `json:"cancel_job_on_expiry"` // Cancel the CI job when the breakpoint expires.
+	MOTD                       string            `json:"motd"`                 // Go template, shown to interactive ssh sessions.
 }
 
 type Webhook struct {
 	URL     string         `json:"url"`
 	Payload map[string]any `json:"payload"`
+	// Which lifecycle events to notify: allocated (the default),
+	// connection_opened, connection_closed, extended, expiring_soon, resumed
+	// and expired.
+	Events []string `json:"events"`
+	// Additional request headers; values are expanded with environment variables.
+	Headers map[string]string `json:"headers"`
+	// If set (after expanding environment variables), deliveries are signed
+	// with HMAC-SHA256, see webhook.SignatureHeader.
+	Secret string `json:"secret"`
+	// How many times to retry failed deliveries, with exponential backoff
+	// starting at retry_backoff (defaults to 1s).
+	Retries      int    `json:"retries"`
+	RetryBackoff string `json:"retry_backoff"`
+	// How the url, headers and payload are rendered: "env" (the default)
+	// expands ${VAR} references; "go" renders them as Go templates.
+	Template string `json:"template"`
 }
 
 type SlackBot struct {
 	Token   string `json:"token"`
 	Channel string `json:"channel"`
+
+	// An app-level token (xapp-...) enables interactive controls, which are
+	// served over Socket Mode.
+	AppToken string `json:"app_token"`
+	// Slack user IDs which are allowed to use interactive controls.
+	AllowedUsers []string `json:"allowed_users"`
+	// If set, members of the channel may also use interactive controls.
+	AllowChannelMembers bool `json:"allow_channel_members"`
+	// If set, connections, extensions, etc. are posted as replies to the message.
+	ThreadActivity bool `json:"thread_activity"`
+	// Go template, rendered as an additional section of the message.
+	Text string `json:"text"`
+}
+
+// RunAs runs sessions (including SFTP) as a different Unix user, which
+// requires breakpoint to run as root.
+type RunAs struct {
+	User  string `json:"user"`  // Name or uid.
+	Group string `json:"group"` // Name or gid; defaults to the user's primary group.
+}
+
+// Sftp limits what SFTP sessions may access.
+type Sftp struct {
+	// Directory which SFTP sessions are confined to, e.g. "$GITHUB_WORKSPACE";
+	// environment variables are expanded. Defaults to the whole filesystem.
+	Root string `json:"root"`
+	// If set, SFTP sessions may not modify files.
+	ReadOnly bool `json:"read_only"`
+	// Owners (or key fingerprints) whose SFTP sessions may not modify files.
+	ReadOnlyOwners []string `json:"read_only_owners"`
+}
+
+// SessionEnv configures the environment of sessions. Variable names may use
+// `*` to match any sequence of characters, e.g. "AWS_*".
+type SessionEnv struct {
+	// Variables of the runner which are passed on to sessions; all of them if empty.
+	Allow []string `json:"allow"`
+	// Variables of the runner which are never passed on, even if allowed.
+	Deny []string `json:"deny"`
+	// Additional variables; values are expanded with environment variables.
+	Set map[string]string `json:"set"`
+	// Variables which clients may set, with SendEnv or SetEnv.
+	Accept []string `json:"accept"`
+}
+
+// SessionOverride changes how sessions of some owners are started.
+type SessionOverride struct {
+	Owners     []string          `json:"owners"` // Owners (e.g. GitHub users) or key fingerprints.
+	Shell      []string          `json:"shell"`
+	WorkingDir string            `json:"working_dir"` // Environment variables are expanded.
+	Env        map[string]string `json:"env"`         // Values are expanded with environment variables.
+}
+
+// AccessPolicy limits what the keys of some owners may do.
+type AccessPolicy struct {
+	// Owners (e.g. GitHub users) or key fingerprints; if empty, the policy
+	// applies to everyone.
+	Owners []string `json:"owners"`
+	// "full" (the default) allows shells, SFTP and port forwarding.
+	// "restricted" only allows running allowed_commands.
+	Mode string `json:"mode"`
+	// Matched against the whole command, where `*` matches anything, e.g.
+	// "cat /var/log/*". Commands are run without a shell.
+	AllowedCommands []string `json:"allowed_commands"`
+}
+
+// KeySource authorizes keys from GitHub (including GitHub Enterprise Server),
+// GitLab, Gitea, or an authorized_keys file served over HTTPS.
+type KeySource struct {
+	Type   string   `json:"type"`   // github, gitlab, gitea or url.
+	Server string   `json:"server"` // Defaults to github.com or gitlab.com; required for gitea.
+	Users  []string `json:"users"`
+	URL    string   `json:"url"`   // For url.
+	Owner  string   `json:"owner"` // For url, who the keys belong to; defaults to the URL.
+}
+
+// KeyFetch configures how keys are fetched, from all sources.
+type KeyFetch struct {
+	Timeout     string `json:"timeout"`     // Per request, defaults to 10s.
+	Parallelism int    `json:"parallelism"` // Defaults to 4.
+	// If set, unknown users and failed requests are skipped with a warning,
+	// rather than failing the breakpoint.
+	Tolerant bool `json:"tolerant"`
+	// If set, keys are cached here and used when a request fails.
+	CacheDir string `json:"cache_dir"`
+}
+
+// Discord posts to a channel through a webhook, and keeps the message up to date.
+type Discord struct {
+	WebhookURL string `json:"webhook_url"` // Environment variables are expanded.
+}
+
+// Teams posts an Adaptive Card through a Microsoft Teams incoming webhook.
+// Incoming webhooks can't edit messages, so the card is not updated.
+type Teams struct {
+	WebhookURL string `json:"webhook_url"` // Environment variables are expanded.
+}
+
+// Mattermost posts through either an incoming webhook, or the API with a bot
+// token. Only the latter keeps the message up to date. Environment variables
+// are expanded in all fields.
+type Mattermost struct {
+	WebhookURL string `json:"webhook_url"`
+
+	ServerURL string `json:"server_url"`
+	Token     string `json:"token"`
+	ChannelID string `json:"channel_id"`
+}
+
+// Email is sent through SMTP when the breakpoint is allocated, and optionally
+// when it ends. Environment variables are expanded in all string fields.
+type Email struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"` // Defaults to 587.
+	StartTLS bool     `json:"starttls"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+	// If set, a summary is sent when the breakpoint ends: how it ended, for
+	// how long it was held and who connected.
+	SendSummary bool `json:"send_summary"`
+}
+
+// GitHub configures integrations with GitHub, beyond the step summary and
+// outputs which are always written when running in GitHub Actions.
+type GitHub struct {
+	// Defaults to ${GITHUB_TOKEN}. Environment variables are expanded.
+	Token string `json:"token"`
+	// Post the connection details as a comment in the pull request.
+	PRComment bool `json:"pr_comment"`
+	// Report the breakpoint as a check run, which is completed when it ends.
+	CheckRun bool `json:"check_run"`
+	// When the breakpoint ends, the comment is updated, or deleted if set.
+	DeleteCommentOnEnd bool `json:"delete_comment_on_end"`
+}
+
+// AutoResume configures when breakpoints are resumed before they expire, if
+// nobody is using them.
+type AutoResume struct {
+	// Resume if nobody connects within this long of the breakpoint being allocated.
+	NoConnectionWithin string `json:"no_connection_within"`
+	// Resume this long after the last connection is closed.
+	AfterLastDisconnect string `json:"after_last_disconnect"`
+}
+
+// ControlConfig configures access to the local control socket, which is used
+// by `breakpoint extend`, `breakpoint resume`, etc.
+type ControlConfig struct {
+	// Where to create the control socket. Defaults to a path within the user's configuration directory.
+	SocketPath string `json:"socket_path"`
+	// Members of this group (name or gid) may use the control socket, in addition to breakpoint's own user.
+	AllowedGroup string `json:"allowed_group"`
+	// If set, callers need to present this token (via BREAKPOINT_CONTROL_TOKEN). Environment variables are expanded.
+	Token string `json:"token"`
+	// If set and no token is specified, a random token is generated and made available to SSH sessions.
+	RequireToken bool `json:"require_token"`
 }
@@ -20,18 +20,25 @@ import (
 const _ = grpc.SupportPackageIsVersion7
 
 const (
-	ControlService_Resume_FullMethodName = "/namespacelabs.breakpoint.private.ControlService/Resume"
-	ControlService_Extend_FullMethodName = "/namespacelabs.breakpoint.private.ControlService/Extend"
-	ControlService_Status_FullMethodName = "/namespacelabs.breakpoint.private.ControlService/Status"
+	ControlService_Resume_FullMethodName             = "/namespacelabs.breakpoint.private.ControlService/Resume"
+	ControlService_Extend_FullMethodName             = "/namespacelabs.breakpoint.private.ControlService/Extend"
+	ControlService_Status_FullMethodName             = "/namespacelabs.breakpoint.private.ControlService/Status"
+	ControlService_AuthorizeKeys_FullMethodName      = "/namespacelabs.breakpoint.private.ControlService/AuthorizeKeys"
+	ControlService_Invite_FullMethodName             = "/namespacelabs.breakpoint.private.ControlService/Invite"
+	ControlService_HoldWhileConnected_FullMethodName = "/namespacelabs.breakpoint.private.ControlService/HoldWhileConnected"
 )
 
 // ControlServiceClient is the client API for ControlService service.
 //
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type ControlServiceClient interface {
-	Resume(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Resume(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	Extend(ctx context.Context, in *ExtendRequest, opts ...grpc.CallOption) (*ExtendResponse, error)
 	Status(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*StatusResponse, error)
+	AuthorizeKeys(ctx context.Context, in *AuthorizeKeysRequest, opts ...grpc.CallOption) (*AuthorizeKeysResponse, error)
+	Invite(ctx context.Context, in *InviteRequest, opts ...grpc.CallOption) (*InviteResponse, error)
+	// Keeps the breakpoint from expiring while there are active connections, and returns once there are none.
+	HoldWhileConnected(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error)
 }
 
 type controlServiceClient struct {
@@ -42,7 +49,7 @@ func NewControlServiceClient(cc grpc.ClientConnInterface) ControlServiceClient {
 	return &controlServiceClient{cc}
 }
 
-func (c *controlServiceClient) Resume(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+func (c *controlServiceClient) Resume(ctx context.Context, in *ResumeRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
 	out := new(emptypb.Empty)
 	err := c.cc.Invoke(ctx, ControlService_Resume_FullMethodName, in, out, opts...)
 	if err != nil {
@@ -69,13 +76,44 @@ func (c *controlServiceClient) Status(ctx context.Context, in *emptypb.Empty, op
 	return out, nil
 }
 
+func (c *controlServiceClient) AuthorizeKeys(ctx context.Context, in *AuthorizeKeysRequest, opts ...grpc.CallOption) (*AuthorizeKeysResponse, error) {
+	out := new(AuthorizeKeysResponse)
+	err := c.cc.Invoke(ctx, ControlService_AuthorizeKeys_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlServiceClient) Invite(ctx context.Context, in *InviteRequest, opts ...grpc.CallOption) (*InviteResponse, error) {
+	out := new(InviteResponse)
+	err := c.cc.Invoke(ctx, ControlService_Invite_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *controlServiceClient) HoldWhileConnected(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, ControlService_HoldWhileConnected_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // ControlServiceServer is the server API for ControlService service.
 // All implementations must embed UnimplementedControlServiceServer
 // for forward compatibility
 type ControlServiceServer interface {
-	Resume(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
+	Resume(context.Context, *ResumeRequest) (*emptypb.Empty, error)
 	Extend(context.Context, *ExtendRequest) (*ExtendResponse, error)
 	Status(context.Context, *emptypb.Empty) (*StatusResponse, error)
+	AuthorizeKeys(context.Context, *AuthorizeKeysRequest) (*AuthorizeKeysResponse, error)
+	Invite(context.Context, *InviteRequest) (*InviteResponse, error)
+	// Keeps the breakpoint from expiring while there are active connections, and returns once there are none.
+	HoldWhileConnected(context.Context, *emptypb.Empty) (*emptypb.Empty, error)
 	mustEmbedUnimplementedControlServiceServer()
 }
 
@@ -83,7 +121,7 @@ type ControlServiceServer interface {
 type UnimplementedControlServiceServer struct {
 }
 
-func (UnimplementedControlServiceServer) Resume(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+func (UnimplementedControlServiceServer) Resume(context.Context, *ResumeRequest) (*emptypb.Empty, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Resume not implemented")
 }
 func (UnimplementedControlServiceServer) Extend(context.Context, *ExtendRequest) (*ExtendResponse, error) {
@@ -92,6 +130,15 @@ func (UnimplementedControlServiceServer) Extend(context.Context, *ExtendRequest)
 func (UnimplementedControlServiceServer) Status(context.Context, *emptypb.Empty) (*StatusResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method Status not implemented")
 }
+func (UnimplementedControlServiceServer) AuthorizeKeys(context.Context, *AuthorizeKeysRequest) (*AuthorizeKeysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AuthorizeKeys not implemented")
+}
+func (UnimplementedControlServiceServer) Invite(context.Context, *InviteRequest) (*InviteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Invite not implemented")
+}
+func (UnimplementedControlServiceServer) HoldWhileConnected(context.Context, *emptypb.Empty) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method HoldWhileConnected not implemented")
+}
 func (UnimplementedControlServiceServer) mustEmbedUnimplementedControlServiceServer() {}
 
 // UnsafeControlServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -106,7 +153,7 @@ func RegisterControlServiceServer(s grpc.ServiceRegistrar, srv ControlServiceSer
 }
 
 func _ControlService_Resume_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
-	in := new(emptypb.Empty)
+	in := new(ResumeRequest)
 	if err := dec(in); err != nil {
 		return nil, err
 	}
@@ -118,7 +165,7 @@ func _ControlService_Resume_Handler(srv interface{}, ctx context.Context, dec fu
 		FullMethod: ControlService_Resume_FullMethodName,
 	}
 	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
-		return srv.(ControlServiceServer).Resume(ctx, req.(*emptypb.Empty))
+		return srv.(ControlServiceServer).Resume(ctx, req.(*ResumeRequest))
 	}
 	return interceptor(ctx, in, info, handler)
 }
@@ -159,6 +206,60 @@ func _ControlService_Status_Handler(srv interface{}, ctx context.Context, dec fu
 	return interceptor(ctx, in, info, handler)
 }
 
+func _ControlService_AuthorizeKeys_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AuthorizeKeysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).AuthorizeKeys(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControlService_AuthorizeKeys_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).AuthorizeKeys(ctx, req.(*AuthorizeKeysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlService_Invite_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(InviteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).Invite(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControlService_Invite_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).Invite(ctx, req.(*InviteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ControlService_HoldWhileConnected_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ControlServiceServer).HoldWhileConnected(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ControlService_HoldWhileConnected_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ControlServiceServer).HoldWhileConnected(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // ControlService_ServiceDesc is the grpc.ServiceDesc for ControlService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -178,6 +279,18 @@ var ControlService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Status",
 			Handler:    _ControlService_Status_Handler,
 		},
+		{
+			MethodName: "AuthorizeKeys",
+			Handler:    _ControlService_AuthorizeKeys_Handler,
+		},
+		{
+			MethodName: "Invite",
+			Handler:    _ControlService_Invite_Handler,
+		},
+		{
+			MethodName: "HoldWhileConnected",
+			Handler:    _ControlService_HoldWhileConnected_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "api/private/v1/service.proto",
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	pb "namespacelabs.dev/breakpoint/api/private/v1"
+	"namespacelabs.dev/breakpoint/pkg/bcontrol"
+	"namespacelabs.dev/breakpoint/pkg/github"
+	"namespacelabs.dev/breakpoint/pkg/waiter"
+)
+
+func init() {
+	rootCmd.AddCommand(newAuthorizeCmd())
+}
+
+func newAuthorizeCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "authorize",
+		Short: "Change which keys may connect to the running breakpoint.",
+	}
+
+	cmd.AddCommand(newAuthorizeAddCmd())
+	cmd.AddCommand(newAuthorizeRemoveCmd())
+	cmd.AddCommand(newAuthorizeListCmd())
+
+	return cmd
+}
+
+func newAuthorizeAddCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add [key...]",
+		Short: "Authorize additional keys, in authorized_keys format.",
+	}
+
+	owner := cmd.Flags().String("owner", "", "Who the keys belong to; defaults to their fingerprint.")
+	githubUser := cmd.Flags().String("github", "", "Authorize the keys of this GitHub user.")
+	cmd.MarkFlagsMutuallyExclusive("owner", "github")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		req := &pb.AuthorizeKeysRequest{Add: args, Owner: *owner}
+
+		if *githubUser != "" {
+			keys, err := github.ResolveSSHKeys(cmd.Context(), []string{*githubUser})
+			if err != nil {
+				return err
+			}
+
+			req.Add = append(req.Add, keys[*githubUser]...)
+			req.Owner = *githubUser
+		}
+
+		if len(req.Add) == 0 {
+			return errors.New("no keys to authorize")
+		}
+
+		return authorizeKeys(cmd.Context(), req)
+	}
+
+	return cmd
+}
+
+func newAuthorizeRemoveCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "remove <key|fingerprint|owner>...",
+		Short: "Revoke keys, by key, fingerprint or owner.",
+		Args:  cobra.MinimumNArgs(1),
+	}
+
+	disconnect := cmd.Flags().Bool("disconnect", false, "Also close connections which were authenticated with a revoked key.")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return authorizeKeys(cmd.Context(), &pb.AuthorizeKeysRequest{Remove: args, Disconnect: *disconnect})
+	}
+
+	return cmd
+}
+
+func newAuthorizeListCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the keys which may connect.",
+		Args:  cobra.NoArgs,
+	}
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return authorizeKeys(cmd.Context(), &pb.AuthorizeKeysRequest{})
+	}
+
+	return cmd
+}
+
+func authorizeKeys(ctx context.Context, req *pb.AuthorizeKeysRequest) error {
+	clt, conn, err := bcontrol.Connect(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	resp, err := clt.AuthorizeKeys(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for _, owner := range resp.GetDisconnected() {
+		fmt.Fprintf(os.Stdout, "Disconnected %s.\n", owner)
+	}
+
+	fmt.Fprintf(os.Stdout, "Authorized keys:\n")
+	for _, k := range resp.GetKeys() {
+		var notes []string
+		if k.Expires != nil {
+			notes = append(notes, "until "+k.GetExpires().AsTime().Format(waiter.Stamp))
+		}
+		if k.GetReadOnly() {
+			notes = append(notes, "read-only")
+		}
+		if k.GetRestricted() {
+			notes = append(notes, "restricted")
+		}
+
+		line := fmt.Sprintf("  %s  %s", k.GetFingerprint(), k.GetOwner())
+		if len(notes) > 0 {
+			line += fmt.Sprintf(" (%s)", strings.Join(notes, ", "))
+		}
+
+		fmt.Fprintln(os.Stdout, line)
+	}
+
+	return nil
+}
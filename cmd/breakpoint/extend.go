@@ -47,6 +47,10 @@ func newExtendCmd() *cobra.Command {
 			return err
 		}
 
+		if resp.GetClamped() {
+			fmt.Printf("Extension was limited: %s.\n", resp.GetClampReason())
+		}
+
 		expiration := resp.Expiration.AsTime()
 		fmt.Printf("Breakpoint now expires at %s (%s)\n",
 			expiration.Format(waiter.Stamp),
@@ -8,7 +8,6 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
-	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/emptypb"
 	v1 "namespacelabs.dev/breakpoint/api/private/v1"
 	"namespacelabs.dev/breakpoint/pkg/bcontrol"
@@ -19,10 +18,6 @@ func init() {
 	rootCmd.AddCommand(newHoldCmd())
 }
 
-const (
-	extendBy = 30 * time.Second
-)
-
 func newHoldCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "hold",
@@ -71,7 +66,12 @@ func holdForDuration(ctx context.Context, duration time.Duration) error {
 		return fmt.Errorf("duration must be positive")
 	}
 
-	status, err := getStatus(ctx)
+	socketPath, err := bcontrol.SocketPath()
+	if err != nil {
+		return err
+	}
+
+	status, err := getStatus(ctx, socketPath, os.Getenv(bcontrol.TokenEnv))
 	if err != nil {
 		return err
 	}
@@ -109,50 +109,16 @@ func holdWhileConnected(ctx context.Context) error {
 
 	waiter.PrintConnectionInfo(status.Endpoint, status.Expiration.AsTime(), os.Stderr)
 
-	tickDuration := 5 * time.Second
-	ticker := time.NewTicker(tickDuration)
-	defer ticker.Stop()
-
 	fmt.Printf("Waiting until breakpoint has no active connections\n")
 
-	for {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-
-		case <-ticker.C:
-			status, err := clt.Status(ctx, &emptypb.Empty{})
-			if err != nil {
-				return fmt.Errorf("unable to fetch breakpoint status, assuming no longer running")
-			}
-
-			expiration := status.GetExpiration().AsTime()
-			if !expiration.IsZero() && time.Now().Add(2*tickDuration).After(expiration) {
-				tryExtendBreakpoint(ctx, expiration, clt)
-			}
-
-			if status.GetNumConnections() > 0 {
-				fmt.Printf("Active connections: %d, waiting\n", status.GetNumConnections())
-				continue
-			}
-
-			fmt.Printf("No active connections, exiting\n")
-			return nil
-		}
-	}
-}
-
-func tryExtendBreakpoint(ctx context.Context, currentExpiration time.Time, clt v1.ControlServiceClient) {
-	fmt.Printf("Breakpoint expiring %s, extending by %s\n", humanize.Time(currentExpiration), extendBy)
-
-	ret, err := clt.Extend(ctx, &v1.ExtendRequest{
-		WaitFor: durationpb.New(extendBy),
-	})
-	if err != nil {
-		fmt.Printf("Unable to extend breakpoint: %v\n", err)
+	// The breakpoint doesn't expire while the call is in progress; this
+	// doesn't count as an extension.
+	if _, err := clt.HoldWhileConnected(ctx, &emptypb.Empty{}); err != nil {
+		return fmt.Errorf("failed to hold breakpoint: %w", err)
 	}
 
-	fmt.Printf("Breakpoint now expires %s\n", humanize.Time(ret.GetExpiration().AsTime()))
+	fmt.Printf("No active connections, exiting\n")
+	return nil
 }
 
 func stopBreakpoint(ctx context.Context) error {
@@ -163,6 +129,6 @@ func stopBreakpoint(ctx context.Context) error {
 
 	defer conn.Close()
 
-	_, err = clt.Resume(ctx, &emptypb.Empty{})
+	_, err = clt.Resume(ctx, &v1.ResumeRequest{})
 	return err
 }
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	gossh "golang.org/x/crypto/ssh"
+	"google.golang.org/protobuf/types/known/durationpb"
+	pb "namespacelabs.dev/breakpoint/api/private/v1"
+	"namespacelabs.dev/breakpoint/pkg/bcontrol"
+	"namespacelabs.dev/breakpoint/pkg/github"
+	"namespacelabs.dev/breakpoint/pkg/sshd"
+	"namespacelabs.dev/breakpoint/pkg/waiter"
+)
+
+func init() {
+	rootCmd.AddCommand(newInviteCmd())
+}
+
+func newInviteCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "invite <github-user|public-key>",
+		Short: "Grant someone temporary access to the breakpoint.",
+		Args:  cobra.ExactArgs(1),
+	}
+
+	dur := cmd.Flags().Duration("for", 15*time.Minute, "How long the access is granted for.")
+	readOnly := cmd.Flags().Bool("read-only", false, "Only allow observing the shared terminal and reading files over SFTP; no shells, commands or port forwarding.")
+	owner := cmd.Flags().String("owner", "", "Who a public key belongs to; defaults to its fingerprint.")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if *dur <= 0 {
+			return errors.New("--for must be positive")
+		}
+
+		req := &pb.InviteRequest{
+			Owner:     *owner,
+			Duration:  durationpb.New(*dur),
+			ReadOnly:  *readOnly,
+			GrantedBy: grantedBy(),
+		}
+
+		if _, _, _, _, err := gossh.ParseAuthorizedKey([]byte(args[0])); err == nil {
+			req.Keys = []string{args[0]}
+		} else {
+			if *owner != "" {
+				return errors.New("--owner can only be set when inviting a public key")
+			}
+
+			keys, err := github.ResolveSSHKeys(cmd.Context(), []string{args[0]})
+			if err != nil {
+				return err
+			}
+
+			if len(keys[args[0]]) == 0 {
+				return fmt.Errorf("%s has no ssh keys on GitHub", args[0])
+			}
+
+			req.Keys = keys[args[0]]
+			req.Owner = args[0]
+		}
+
+		clt, conn, err := bcontrol.Connect(cmd.Context())
+		if err != nil {
+			return err
+		}
+
+		defer conn.Close()
+
+		resp, err := clt.Invite(cmd.Context(), req)
+		if err != nil {
+			return err
+		}
+
+		expires := resp.GetExpires().AsTime()
+		fmt.Fprintf(os.Stdout, "Granted access until %s (%s):\n", expires.Format(waiter.Stamp), humanize.Time(expires))
+		for _, k := range resp.GetKeys() {
+			fmt.Fprintf(os.Stdout, "  %s  %s\n", k.GetFingerprint(), k.GetOwner())
+		}
+
+		return nil
+	}
+
+	return cmd
+}
+
+// grantedBy identifies who runs `breakpoint invite`: the owner of the ssh
+// session it runs in, or the local user. The server only relies on it if it
+// can't identify the caller itself.
+func grantedBy() string {
+	if owner := os.Getenv(sshd.OwnerEnv); owner != "" {
+		return owner
+	}
+
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return ""
+}
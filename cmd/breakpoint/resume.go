@@ -4,7 +4,8 @@ import (
 	"fmt"
 
 	"github.com/spf13/cobra"
-	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/proto"
+	pb "namespacelabs.dev/breakpoint/api/private/v1"
 	"namespacelabs.dev/breakpoint/pkg/bcontrol"
 )
 
@@ -14,7 +15,27 @@ func newResumeCmd() *cobra.Command {
 		Short: "Resume the workflow execution.",
 	}
 
+	exitCode := cmd.Flags().Int("exit-code", 0, "The exit code that breakpoint wait (or run) should exit with.")
+	fail := cmd.Flags().Bool("fail", false, "Make breakpoint wait (or run) fail (same as --exit-code=1).")
+	rerun := cmd.Flags().Bool("rerun", false, "Re-run the command wrapped by breakpoint run.")
+	cancelJob := cmd.Flags().Bool("cancel", false, "Cancel the job (the GitHub Actions workflow run), rather than resuming it.")
+	cmd.MarkFlagsMutuallyExclusive("exit-code", "fail", "rerun", "cancel")
+
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		req := &pb.ResumeRequest{Rerun: *rerun, CancelJob: *cancelJob}
+
+		switch {
+		case *fail:
+			req.ExitCode = proto.Int32(1)
+
+		case cmd.Flags().Changed("exit-code"):
+			if *exitCode < 0 || *exitCode > 255 {
+				return fmt.Errorf("exit code must be between 0 and 255")
+			}
+
+			req.ExitCode = proto.Int32(int32(*exitCode))
+		}
+
 		clt, conn, err := bcontrol.Connect(cmd.Context())
 		if err != nil {
 			return err
@@ -22,11 +43,23 @@ func newResumeCmd() *cobra.Command {
 
 		defer conn.Close()
 
-		if _, err := clt.Resume(cmd.Context(), &emptypb.Empty{}); err != nil {
+		if _, err := clt.Resume(cmd.Context(), req); err != nil {
 			return err
 		}
 
-		fmt.Printf("Breakpoint removed, workflow resuming!\n")
+		switch {
+		case req.Rerun:
+			fmt.Printf("Breakpoint removed, re-running command!\n")
+
+		case req.CancelJob:
+			fmt.Printf("Breakpoint removed, canceling the job!\n")
+
+		case req.GetExitCode() != 0:
+			fmt.Printf("Breakpoint removed, workflow resuming (exit code %d)!\n", req.GetExitCode())
+
+		default:
+			fmt.Printf("Breakpoint removed, workflow resuming!\n")
+		}
 		return nil
 	}
 
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	internalv1 "namespacelabs.dev/breakpoint/api/private/v1"
+	"namespacelabs.dev/breakpoint/pkg/config"
+	"namespacelabs.dev/breakpoint/pkg/jsonfile"
+)
+
+func init() {
+	rootCmd.AddCommand(newRunCmd())
+}
+
+func newRunCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "run [flags] -- command [args...]",
+		Short: "Runs a command, and creates a breakpoint if it fails.",
+		Args:  cobra.MinimumNArgs(1),
+	}
+
+	// Everything after the command is passed to it, as is.
+	cmd.Flags().SetInterspersed(false)
+
+	configPath := cmd.Flags().String("config", "", "Path to the configuration file.")
+	always := cmd.Flags().Bool("always", false, "Create a breakpoint even if the command succeeds.")
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		if *configPath == "" {
+			return errors.New("--config is required")
+		}
+
+		// Fail early on malformed configurations, rather than after running the command.
+		var wc internalv1.WaitConfig
+		if err := jsonfile.Load(*configPath, &wc); err != nil {
+			return fmt.Errorf("failed to load %q: %w", *configPath, err)
+		}
+
+		ctx := cmd.Context()
+
+		dir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+
+		for {
+			code, err := runCommand(ctx, args)
+			if err != nil {
+				return err
+			}
+
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			if code == 0 && !*always {
+				return nil
+			}
+
+			// Only load the configuration now, as it obtains short-lived
+			// credentials (e.g. GitHub OIDC tokens).
+			cfg, err := config.LoadConfig(ctx, *configPath)
+			if err != nil {
+				return err
+			}
+
+			outcome, err := serveBreakpoint(ctx, cfg, breakpointOpts{
+				Dir:      dir,
+				Preamble: []string{describeExit(args, code)},
+				ExtraCommands: []string{
+					"`breakpoint resume --rerun` to run the command again.",
+					"`breakpoint resume --fail` to resume, failing the step.",
+				},
+			})
+			if err != nil {
+				return err
+			}
+
+			if outcome.Rerun {
+				zerolog.Ctx(ctx).Info().Strs("command", args).Msg("Running command again")
+				continue
+			}
+
+			if err := cancelJobIfRequested(ctx, outcome, cfg); err != nil {
+				return err
+			}
+
+			if code := exitCodeFor(outcome, cfg, code); code != 0 {
+				return exitCodeError(code)
+			}
+
+			return nil
+		}
+	}
+
+	return cmd
+}
+
+// runCommand runs the specified command with inherited stdio, and returns its exit code.
+func runCommand(ctx context.Context, args []string) (int, error) {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if code := exitErr.ExitCode(); code > 0 {
+			return code, nil
+		}
+
+		// E.g. terminated by a signal.
+		return 1, nil
+	}
+
+	if err != nil {
+		return 0, fmt.Errorf("failed to run %q: %w", args[0], err)
+	}
+
+	return 0, nil
+}
+
+func describeExit(args []string, code int) string {
+	if code == 0 {
+		return fmt.Sprintf("The command `%s` succeeded.", strings.Join(args, " "))
+	}
+
+	return fmt.Sprintf("The command `%s` failed with exit code %d.", strings.Join(args, " "), code)
+}
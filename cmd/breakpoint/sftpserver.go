@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"namespacelabs.dev/breakpoint/pkg/sshd"
+)
+
+func init() {
+	rootCmd.AddCommand(newSftpServerCmd())
+	rootCmd.AddCommand(newScpServerCmd())
+}
+
+// newSftpServerCmd is run by `breakpoint wait` to serve SFTP as the user which
+// sessions run as, see run_as.
+func newSftpServerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "sftp-server",
+		Short:  "Serve SFTP over stdin and stdout.",
+		Args:   cobra.NoArgs,
+		Hidden: true,
+	}
+
+	s := sftpSessionFlags(cmd)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		err := sshd.ServeSftp(*zerolog.Ctx(cmd.Context()), stdio{os.Stdin, os.Stdout}, *s)
+		if err == io.EOF {
+			return nil
+		}
+		return err
+	}
+
+	return cmd
+}
+
+// newScpServerCmd is like newSftpServerCmd, for scp.
+func newScpServerCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:    "scp-server -- <scp args>",
+		Short:  "Run scp in server mode, over stdin and stdout.",
+		Args:   cobra.MinimumNArgs(1),
+		Hidden: true,
+	}
+
+	s := sftpSessionFlags(cmd)
+
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return sshd.ServeScp(*zerolog.Ctx(cmd.Context()), stdio{os.Stdin, os.Stdout}, *s, args)
+	}
+
+	return cmd
+}
+
+// sftpSessionFlags parses the flags of sshd.SftpSession.Args.
+func sftpSessionFlags(cmd *cobra.Command) *sshd.SftpSession {
+	var s sshd.SftpSession
+	cmd.Flags().StringVar(&s.Owner, "owner", "", "Who the session belongs to, for logging.")
+	cmd.Flags().StringVar(&s.Root, "root", "", "Directory which the session is confined to.")
+	cmd.Flags().StringVar(&s.Dir, "dir", "", "Where relative paths start.")
+	cmd.Flags().BoolVar(&s.ReadOnly, "read-only", false, "Refuse to modify files.")
+	return &s
+}
+
+type stdio struct {
+	io.Reader
+	io.Writer
+}
+
+func (stdio) Close() error { return os.Stdin.Close() }
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 
 	"github.com/spf13/cobra"
 	"google.golang.org/protobuf/types/known/emptypb"
 	v1 "namespacelabs.dev/breakpoint/api/private/v1"
 	"namespacelabs.dev/breakpoint/pkg/bcontrol"
+	"namespacelabs.dev/breakpoint/pkg/config"
 	"namespacelabs.dev/breakpoint/pkg/execbackground"
 	"namespacelabs.dev/breakpoint/pkg/waiter"
 )
@@ -33,8 +35,18 @@ func newStartCmd() *cobra.Command {
 			return errors.New("--config is required")
 		}
 
+		socketPath, token, err := config.LoadControlSettings(*configPath)
+		if err != nil {
+			return err
+		}
+
 		procArgs := []string{"wait", "--config", *configPath}
 		proc := exec.Command(os.Args[0], procArgs...)
+		proc.Env = append(os.Environ(), fmt.Sprintf("%s=%s", bcontrol.SocketPathEnv, socketPath))
+		if token != "" {
+			// Makes sure that the background process requires the same token.
+			proc.Env = append(proc.Env, fmt.Sprintf("%s=%s", bcontrol.TokenEnv, token))
+		}
 		execbackground.SetCreateSession(proc)
 
 		if err := proc.Start(); err != nil {
@@ -45,7 +57,7 @@ func newStartCmd() *cobra.Command {
 
 		fmt.Fprintf(os.Stderr, "Breakpoint starting in background (PID: %d)\n", pid)
 
-		status, err := waitForReady(cmd.Context(), 5*time.Second)
+		status, err := waitForReady(cmd.Context(), socketPath, token, 5*time.Second)
 		if err != nil {
 			_ = proc.Process.Kill()
 			return err
@@ -57,13 +69,50 @@ func newStartCmd() *cobra.Command {
 
 		waiter.PrintConnectionInfo(status.Endpoint, status.GetExpiration().AsTime(), os.Stderr)
 
-		return nil
+		return exportControlSettings(socketPath, token)
 	}
 
 	return cmd
 }
 
-func waitForReady(ctx context.Context, timeoutDuration time.Duration) (*v1.StatusResponse, error) {
+// exportControlSettings makes the control server reachable from later steps
+// (e.g. `breakpoint hold` or `breakpoint resume`): with GitHub Actions, via
+// GITHUB_ENV; otherwise, by printing them to stdout for `eval`.
+func exportControlSettings(socketPath, token string) error {
+	vars := [][2]string{{bcontrol.SocketPathEnv, socketPath}}
+	if token != "" {
+		vars = append(vars, [2]string{bcontrol.TokenEnv, token})
+	}
+
+	path := os.Getenv("GITHUB_ENV")
+	if path == "" {
+		for _, kv := range vars {
+			fmt.Fprintf(os.Stdout, "export %s='%s'\n", kv[0], strings.ReplaceAll(kv[1], "'", `'\''`))
+		}
+		return nil
+	}
+
+	if token != "" {
+		// Keep the token out of the workflow's logs.
+		fmt.Fprintf(os.Stdout, "::add-mask::%s\n", token)
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	for _, kv := range vars {
+		if _, err := fmt.Fprintf(f, "%s=%s\n", kv[0], kv[1]); err != nil {
+			f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+func waitForReady(ctx context.Context, socketPath, token string, timeoutDuration time.Duration) (*v1.StatusResponse, error) {
 	// Check for file existence with timeout
 	timeout := time.After(timeoutDuration)
 	ticker := time.NewTicker(100 * time.Millisecond)
@@ -78,7 +127,7 @@ func waitForReady(ctx context.Context, timeoutDuration time.Duration) (*v1.Statu
 			return nil, fmt.Errorf("breakpoint didn't start in time")
 
 		case <-ticker.C:
-			status, err := getStatus(ctx)
+			status, err := getStatus(ctx, socketPath, token)
 			if err != nil {
 				continue
 			}
@@ -90,8 +139,8 @@ func waitForReady(ctx context.Context, timeoutDuration time.Duration) (*v1.Statu
 	}
 }
 
-func getStatus(ctx context.Context) (*v1.StatusResponse, error) {
-	clt, conn, err := bcontrol.Connect(ctx)
+func getStatus(ctx context.Context, socketPath, token string) (*v1.StatusResponse, error) {
+	clt, conn, err := bcontrol.Dial(ctx, socketPath, token)
 	if err != nil {
 		return nil, err
 	}
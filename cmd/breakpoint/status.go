@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"google.golang.org/protobuf/types/known/emptypb"
@@ -43,8 +44,29 @@ func newStatusCmd() *cobra.Command {
 
 		fmt.Fprintf(os.Stdout, "\nActive connections: %d\n", status.GetNumConnections())
 
+		if deliveries := status.GetWebhookDeliveries(); len(deliveries) > 0 {
+			fmt.Fprintf(os.Stdout, "\nWebhook deliveries:\n")
+			for _, d := range deliveries {
+				result := "ok"
+				if d.GetError() != "" {
+					result = "failed: " + firstLine(d.GetError())
+				}
+
+				fmt.Fprintf(os.Stdout, "  %s  %-17s  %s  (%d attempt(s), status %d) %s\n",
+					d.GetTime().AsTime().Format(waiter.Stamp), d.GetEvent(), d.GetUrl(),
+					d.GetAttempts(), d.GetStatusCode(), result)
+			}
+		}
+
 		return nil
 	}
 
 	return cmd
 }
+
+func firstLine(str string) string {
+	if i := strings.IndexByte(str, '\n'); i >= 0 {
+		return str[:i]
+	}
+	return str
+}
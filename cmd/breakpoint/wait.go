@@ -6,11 +6,16 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/muesli/reflow/wordwrap"
+	"github.com/rs/zerolog"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
+	internalv1 "namespacelabs.dev/breakpoint/api/private/v1"
+	"namespacelabs.dev/breakpoint/pkg/bcontrol"
 	"namespacelabs.dev/breakpoint/pkg/config"
 	"namespacelabs.dev/breakpoint/pkg/internalserver"
 	"namespacelabs.dev/breakpoint/pkg/passthrough"
@@ -43,76 +48,323 @@ func newWaitCmd() *cobra.Command {
 			return err
 		}
 
-		mopts := waiter.ManagerOpts{
-			InitialDur: cfg.ParsedDuration,
-			Webhooks:   cfg.Webhooks,
+		outcome, err := serveBreakpoint(ctx, cfg, breakpointOpts{})
+		if err != nil {
+			return err
 		}
 
-		if cfg.SlackBot != nil {
-			mopts.SlackBots = append(mopts.SlackBots, *cfg.SlackBot)
+		if err := cancelJobIfRequested(ctx, outcome, cfg); err != nil {
+			return err
 		}
 
-		mgr, ctx := waiter.NewManager(ctx, mopts)
+		if code := exitCodeFor(outcome, cfg, 0); code != 0 {
+			return exitCodeError(code)
+		}
 
-		sshd, err := sshd.MakeServer(ctx, sshd.SSHServerOpts{
-			Shell:          cfg.Shell,
-			AuthorizedKeys: cfg.AllKeys,
-			AllowedUsers:   cfg.AllowedSSHUsers,
-			Env:            os.Environ(),
-			InteractiveMOTD: func(w io.Writer) {
-				ww := wordwrap.NewWriter(80)
+		return nil
+	}
 
-				fmt.Fprintln(ww)
-				fmt.Fprintf(ww, "Welcome to a breakpoint-provided remote shell.\n")
-				fmt.Fprintln(ww)
-				fmt.Fprintf(ww, "This breakpoint will expire %s.\n", humanize.Time(mgr.Expiration()))
-				fmt.Fprintln(ww)
-				fmt.Fprintf(ww, "The following additional commands are available:\n\n")
-				fmt.Fprintf(ww, " - `breakpoint extend` to extend the breakpoint duration.\n")
-				fmt.Fprintf(ww, " - `breakpoint resume` to resume immediately.\n")
+	return cmd
+}
 
-				_ = ww.Close()
+type breakpointOpts struct {
+	Dir           string   // Where SSH sessions start.
+	Preamble      []string // Printed as part of the MOTD.
+	ExtraCommands []string // Additional commands listed in the MOTD.
+}
 
-				_, _ = w.Write(ww.Bytes())
-			},
-		})
+// serveBreakpoint blocks until the breakpoint is resumed or expires.
+func serveBreakpoint(ctx context.Context, cfg config.ParsedConfig, opts breakpointOpts) (waiter.Outcome, error) {
+	mopts := waiter.ManagerOpts{
+		InitialDur:    cfg.ParsedDuration,
+		MaxDuration:   cfg.ParsedMaxDuration,
+		MaxExtension:  cfg.ParsedMaxExtension,
+		MaxExtensions: cfg.MaxExtensions,
+		Webhooks:      cfg.Webhooks,
+
+		ResumeIfNoConnectionWithin: cfg.ParsedNoConnectionWithin,
+		ResumeAfterLastDisconnect:  cfg.ParsedAfterLastDisconnect,
+
+		AuthorizedUsers: cfg.AuthorizedUsers(),
+	}
+
+	if cfg.SlackBot != nil {
+		mopts.SlackBots = append(mopts.SlackBots, *cfg.SlackBot)
+	}
+
+	if cfg.Discord != nil {
+		mopts.Discord = append(mopts.Discord, *cfg.Discord)
+	}
+
+	if cfg.Teams != nil {
+		mopts.Teams = append(mopts.Teams, *cfg.Teams)
+	}
+
+	if cfg.Mattermost != nil {
+		mopts.Mattermost = append(mopts.Mattermost, *cfg.Mattermost)
+	}
+
+	if cfg.Email != nil {
+		mopts.Email = append(mopts.Email, *cfg.Email)
+	}
+
+	mopts.GitHub = cfg.GitHub
+
+	mgr, ctx := waiter.NewManager(ctx, mopts)
+
+	sopts := internalserver.ServeOpts{
+		Token: cfg.ControlToken,
+	}
+
+	if cfg.Control != nil {
+		sopts.SocketPath = cfg.Control.SocketPath
+		sopts.AllowedGroup = cfg.Control.AllowedGroup
+	}
+
+	// Make sure that `breakpoint` commands within sessions can reach the
+	// control server, even if they run as a different user (see run_as).
+	socketPath := sopts.SocketPath
+	if socketPath == "" {
+		p, err := bcontrol.SocketPath()
 		if err != nil {
-			return err
+			return waiter.Outcome{}, err
 		}
+		socketPath = p
+	}
 
-		mgr.SetConnectionCountCallback(sshd.NumConnections)
+	env := cfg.SessionEnviron(os.Environ())
+	env = append(env, fmt.Sprintf("%s=%s", bcontrol.SocketPathEnv, socketPath))
 
-		eg, ctx := errgroup.WithContext(ctx)
+	if sopts.Token != "" {
+		env = append(env, fmt.Sprintf("%s=%s", bcontrol.TokenEnv, sopts.Token))
+	}
 
-		pl := passthrough.NewListener(ctx, dummyAddr{})
+	var sftpCommand, scpCommand []string
+	if cfg.ParsedRunAs != nil {
+		// SFTP and scp are served by a separate process, so that they run as
+		// the same user as sessions.
+		exe, err := os.Executable()
+		if err != nil {
+			return waiter.Outcome{}, err
+		}
 
-		eg.Go(func() error {
-			return sshd.Server.Serve(pl)
-		})
+		sftpCommand = []string{exe, "sftp-server"}
+		scpCommand = []string{exe, "scp-server"}
+	}
 
-		eg.Go(func() error {
-			defer pl.Close()
-
-			return quicproxyclient.Serve(ctx, cfg.Endpoint, cfg.RegisterMetadata, quicproxyclient.Handlers{
-				OnAllocation: func(endpoint string) {
-					mgr.SetEndpoint(endpoint)
-				},
-				Proxy: pl.Offer,
-			})
+	sshd, err := sshd.MakeServer(ctx, sshd.SSHServerOpts{
+		Shell:          cfg.Shell,
+		AuthorizedKeys: cfg.AllKeys,
+		AllowedUsers:   cfg.AllowedSSHUsers,
+		Env:            env,
+		Dir:            sessionDir(cfg, opts),
+		AcceptEnv:      acceptEnv(cfg),
+		Overrides:      cfg.ParsedSessionOverrides,
+		Identity:       cfg.ParsedRunAs,
+		SftpCommand:    sftpCommand,
+		ScpCommand:     scpCommand,
+		Sftp:           cfg.ParsedSftp,
+
+		SharedTerminal:     cfg.SharedTerminal,
+		Observers:          cfg.Observers,
+		PersistentSessions: cfg.PersistentSessions,
+		Policies:           accessPolicies(cfg.AccessPolicies),
+
+		OnConnectionsChanged: mgr.ConnectionsChanged,
+		OnConnectionOpened: func(ci sshd.ConnectionInfo) {
+			mgr.ConnectionOpened(ci.Owner, ci.RemoteAddr)
+		},
+		OnConnectionClosed: func(ci sshd.ConnectionInfo) {
+			mgr.ConnectionClosed(ci.Owner, ci.RemoteAddr)
+		},
+		InteractiveMOTD: func(w io.Writer) {
+			ww := wordwrap.NewWriter(80)
+
+			fmt.Fprintln(ww)
+			fmt.Fprintf(ww, "Welcome to a breakpoint-provided remote shell.\n")
+			fmt.Fprintln(ww)
+			for _, line := range opts.Preamble {
+				fmt.Fprintf(ww, "%s\n", line)
+			}
+			if len(opts.Preamble) > 0 {
+				fmt.Fprintln(ww)
+			}
+			if cfg.MOTD != "" {
+				motd, err := waiter.RenderTemplate(cfg.MOTD, mgr.TemplateContext())
+				if err != nil {
+					zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to render motd")
+				}
+				fmt.Fprintf(ww, "%s\n\n", strings.TrimRight(motd, "\n"))
+			}
+			fmt.Fprintf(ww, "This breakpoint will expire %s.\n", humanize.Time(mgr.Expiration()))
+			if cfg.PersistentSessions {
+				fmt.Fprintf(ww, "If you disconnect, your shell keeps running: reconnect to resume it.\n")
+			}
+			fmt.Fprintln(ww)
+			fmt.Fprintf(ww, "The following additional commands are available:\n\n")
+			fmt.Fprintf(ww, " - `breakpoint extend` to extend the breakpoint duration.\n")
+			fmt.Fprintf(ww, " - `breakpoint resume` to resume immediately.\n")
+			fmt.Fprintf(ww, " - `breakpoint invite` to grant someone temporary access.\n")
+			for _, line := range opts.ExtraCommands {
+				fmt.Fprintf(ww, " - %s\n", line)
+			}
+
+			_ = ww.Close()
+
+			_, _ = w.Write(ww.Bytes())
+		},
+	})
+	if err != nil {
+		return waiter.Outcome{}, err
+	}
+
+	mgr.SetConnectionCountCallback(sshd.NumConnections)
+	mgr.SetHostKey(sshd.HostKey)
+	sopts.SSH = sshd
+
+	eg, ctx := errgroup.WithContext(ctx)
+
+	pl := passthrough.NewListener(ctx, dummyAddr{})
+
+	eg.Go(func() error {
+		return sshd.Server.Serve(pl)
+	})
+
+	eg.Go(func() error {
+		defer pl.Close()
+
+		return quicproxyclient.Serve(ctx, cfg.Endpoint, cfg.RegisterMetadata, quicproxyclient.Handlers{
+			OnAllocation: func(endpoint string) {
+				mgr.SetEndpoint(endpoint)
+			},
+			Proxy: pl.Offer,
 		})
+	})
+
+	eg.Go(func() error {
+		return internalserver.ListenAndServe(ctx, mgr, sopts)
+	})
 
+	eg.Go(func() error {
+		return mgr.Wait()
+	})
+
+	if cfg.ParsedKeyRefresh > 0 {
 		eg.Go(func() error {
-			return internalserver.ListenAndServe(ctx, mgr)
+			refreshKeys(ctx, cfg, sshd)
+			return nil
 		})
+	}
 
-		eg.Go(func() error {
-			return mgr.Wait()
+	if err := cancelIsOK(eg.Wait()); err != nil {
+		return waiter.Outcome{}, err
+	}
+
+	return mgr.Outcome(), nil
+}
+
+// refreshKeys periodically resolves the authorized keys again, so that changes
+// to team memberships, collaborators and key sources apply to a running
+// breakpoint. Failures keep the previous set of keys.
+func refreshKeys(ctx context.Context, cfg config.ParsedConfig, srv *sshd.SSHServer) {
+	logger := zerolog.Ctx(ctx).With().Str("service", "keyrefresh").Logger()
+
+	ticker := time.NewTicker(cfg.ParsedKeyRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		keys, err := config.ResolveAuthorizedKeys(ctx, cfg.WaitConfig)
+		if err != nil {
+			logger.Warn().Err(err).Msg("Failed to refresh authorized keys")
+			continue
+		}
+
+		if err := srv.SetAuthorizedKeys(keys); err != nil {
+			logger.Warn().Err(err).Msg("Failed to refresh authorized keys")
+			continue
+		}
+
+		logger.Debug().Int("num_keys", len(srv.AuthorizedKeys())).Msg("Refreshed authorized keys")
+
+		if cfg.DisconnectRevoked {
+			for _, conn := range srv.DisconnectUnauthorized() {
+				logger.Info().Str("owner", conn.Owner).Str("remote_addr", conn.RemoteAddr).Msg("Disconnected connection whose key was revoked")
+			}
+		}
+	}
+}
+
+// sessionDir returns where sessions start. The directory of the command
+// wrapped by `breakpoint run` takes precedence over working_dir.
+func sessionDir(cfg config.ParsedConfig, opts breakpointOpts) string {
+	if opts.Dir != "" {
+		return opts.Dir
+	}
+
+	return os.ExpandEnv(cfg.WorkingDir)
+}
+
+func acceptEnv(cfg config.ParsedConfig) []string {
+	if cfg.SessionEnv == nil {
+		return nil
+	}
+
+	return cfg.SessionEnv.Accept
+}
+
+func accessPolicies(policies []internalv1.AccessPolicy) []sshd.Policy {
+	var res []sshd.Policy
+	for _, p := range policies {
+		res = append(res, sshd.Policy{
+			Owners:          p.Owners,
+			Restricted:      p.Mode == "restricted",
+			AllowedCommands: p.AllowedCommands,
 		})
+	}
+	return res
+}
 
-		return cancelIsOK(eg.Wait())
+// exitCodeFor determines what `wait` and `run` exit with. An exit code passed
+// to `breakpoint resume` always takes precedence. When the job is canceled, a
+// non-zero exit code keeps subsequent steps from running in the meantime.
+func exitCodeFor(outcome waiter.Outcome, cfg config.ParsedConfig, def int) int {
+	switch {
+	case outcome.ExitCode != nil:
+		return *outcome.ExitCode
+
+	case outcome.Expired && cfg.ExpiredExitCode != 0:
+		return cfg.ExpiredExitCode
+
+	case shouldCancelJob(outcome, cfg):
+		return 1
 	}
 
-	return cmd
+	return def
+}
+
+func shouldCancelJob(outcome waiter.Outcome, cfg config.ParsedConfig) bool {
+	return outcome.CancelJob || (outcome.Expired && cfg.CancelJobOnExpiry)
+}
+
+// cancelJobIfRequested cancels the CI job if `breakpoint resume --cancel` was
+// used, or the breakpoint expired and `cancel_job_on_expiry` is set.
+func cancelJobIfRequested(ctx context.Context, outcome waiter.Outcome, cfg config.ParsedConfig) error {
+	if !shouldCancelJob(outcome, cfg) {
+		return nil
+	}
+
+	zerolog.Ctx(ctx).Info().Msg("Canceling the job")
+	if err := waiter.CancelJob(ctx, cfg.GitHub); err != nil {
+		return fmt.Errorf("failed to cancel the job: %w", err)
+	}
+
+	return nil
 }
 
 func cancelIsOK(err error) error {
@@ -12,7 +12,20 @@ import (
 	"namespacelabs.dev/breakpoint/pkg/bgrpc"
 )
 
+const (
+	// Overrides the location of the control socket.
+	SocketPathEnv = "BREAKPOINT_CONTROL_SOCKET"
+	// Token presented to the control server, if one is required.
+	TokenEnv = "BREAKPOINT_CONTROL_TOKEN"
+
+	TokenMetadataKey = "x-breakpoint-control-token"
+)
+
 func SocketPath() (string, error) {
+	if path := os.Getenv(SocketPathEnv); path != "" {
+		return path, nil
+	}
+
 	dir, err := os.UserConfigDir()
 	if err != nil {
 		return dir, err
@@ -21,21 +34,44 @@ func SocketPath() (string, error) {
 	return filepath.Join(dir, "breakpoint/breakpoint.sock"), nil
 }
 
+// Connect connects to the control server, as configured by SocketPathEnv and TokenEnv.
 func Connect(ctx context.Context) (pb.ControlServiceClient, *grpc.ClientConn, error) {
 	socketPath, err := SocketPath()
 	if err != nil {
 		return nil, nil, err
 	}
 
-	conn, err := bgrpc.DialContext(ctx, socketPath,
+	return Dial(ctx, socketPath, os.Getenv(TokenEnv))
+}
+
+// Dial connects to the control server listening on `socketPath`, presenting
+// `token` if set.
+func Dial(ctx context.Context, socketPath, token string) (pb.ControlServiceClient, *grpc.ClientConn, error) {
+	opts := []grpc.DialOption{
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
 		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
 			var d net.Dialer
 			return d.DialContext(ctx, "unix", socketPath)
-		}))
+		}),
+	}
+
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials(token)))
+	}
+
+	conn, err := bgrpc.DialContext(ctx, socketPath, opts...)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	return pb.NewControlServiceClient(conn), conn, nil
 }
+
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{TokenMetadataKey: string(t)}, nil
+}
+
+// The control socket is local, and access to it is already restricted.
+func (tokenCredentials) RequireTransportSecurity() bool { return false }
@@ -2,19 +2,32 @@ package config
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"os"
+	"path"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
+	shlex "github.com/anmitsu/go-shlex"
 	"github.com/rs/zerolog"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
 	"google.golang.org/grpc/metadata"
 	internalv1 "namespacelabs.dev/breakpoint/api/private/v1"
 	v1 "namespacelabs.dev/breakpoint/api/public/v1"
+	"namespacelabs.dev/breakpoint/pkg/bcontrol"
 	"namespacelabs.dev/breakpoint/pkg/github"
 	"namespacelabs.dev/breakpoint/pkg/githuboidc"
 	"namespacelabs.dev/breakpoint/pkg/jsonfile"
+	"namespacelabs.dev/breakpoint/pkg/keysource"
+	"namespacelabs.dev/breakpoint/pkg/sshd"
+	"namespacelabs.dev/breakpoint/pkg/waiter"
 )
 
 func LoadConfig(ctx context.Context, file string) (ParsedConfig, error) {
@@ -31,6 +44,182 @@ func LoadConfig(ctx context.Context, file string) (ParsedConfig, error) {
 		if wh.URL == "" {
 			return cfg, errors.New("webhook is missing url")
 		}
+
+		for _, ev := range wh.Events {
+			if !slices.Contains(waiter.AllEvents, waiter.EventType(ev)) {
+				return cfg, fmt.Errorf("webhook: unknown event %q", ev)
+			}
+		}
+
+		if wh.Retries < 0 {
+			return cfg, errors.New("webhook: retries must not be negative")
+		}
+
+		if err := waiter.ValidateTemplate(wh.Template, []any{wh.URL, wh.Payload, wh.Headers}); err != nil {
+			return cfg, fmt.Errorf("webhook: %w", err)
+		}
+
+		if wh.RetryBackoff != "" {
+			if _, err := time.ParseDuration(wh.RetryBackoff); err != nil {
+				return cfg, fmt.Errorf("webhook: invalid retry_backoff: %w", err)
+			}
+		}
+	}
+
+	for _, src := range cfg.KeySources {
+		switch src.Type {
+		case "github", "gitlab":
+		case "gitea":
+			if src.Server == "" {
+				return cfg, errors.New("key_sources: gitea requires server")
+			}
+		case "url":
+			if src.URL == "" {
+				return cfg, errors.New("key_sources: url requires url")
+			}
+		default:
+			return cfg, fmt.Errorf("key_sources: unknown type %q, expected github, gitlab, gitea or url", src.Type)
+		}
+	}
+
+	if cfg.RunAs != nil {
+		if cfg.RunAs.User == "" {
+			return cfg, errors.New("run_as: user is required")
+		}
+
+		id, err := sshd.LookupIdentity(cfg.RunAs.User, cfg.RunAs.Group)
+		if err != nil {
+			return cfg, fmt.Errorf("run_as: %w", err)
+		}
+
+		cfg.ParsedRunAs = id
+
+		// The default socket is within the home directory of the user running
+		// `breakpoint wait`, which sessions can't reach.
+		if cfg.Control == nil || cfg.Control.SocketPath == "" {
+			return cfg, errors.New("run_as: control.socket_path is required, in a directory that the user may access")
+		}
+
+		if !filepath.IsAbs(cfg.Control.SocketPath) {
+			return cfg, errors.New("control: socket_path must be absolute")
+		}
+
+		if cfg.Control.AllowedGroup == "" {
+			cfg.Control.AllowedGroup = fmt.Sprint(id.Gid)
+		}
+	}
+
+	if s := cfg.Sftp; s != nil {
+		cfg.ParsedSftp = sshd.SftpOpts{ReadOnly: s.ReadOnly, ReadOnlyOwners: s.ReadOnlyOwners}
+
+		if root := os.ExpandEnv(s.Root); root != "" {
+			abs, err := filepath.Abs(root)
+			if err != nil {
+				return cfg, fmt.Errorf("sftp: invalid root: %w", err)
+			}
+
+			if st, err := os.Stat(abs); err != nil || !st.IsDir() {
+				return cfg, fmt.Errorf("sftp: root %q is not a directory", abs)
+			}
+
+			cfg.ParsedSftp.Root = abs
+		}
+	}
+
+	if se := cfg.SessionEnv; se != nil {
+		for _, pattern := range append(append(append([]string{}, se.Allow...), se.Deny...), se.Accept...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return cfg, fmt.Errorf("session_env: invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+
+	for _, o := range cfg.SessionOverrides {
+		if len(o.Owners) == 0 {
+			return cfg, errors.New("session_overrides: owners is required")
+		}
+
+		cfg.ParsedSessionOverrides = append(cfg.ParsedSessionOverrides, sshd.SessionOverride{
+			Owners: o.Owners,
+			Shell:  o.Shell,
+			Dir:    os.ExpandEnv(o.WorkingDir),
+			Env:    expandEnv(o.Env),
+		})
+	}
+
+	for _, p := range cfg.AccessPolicies {
+		switch p.Mode {
+		case "", "full":
+			if len(p.AllowedCommands) > 0 {
+				return cfg, errors.New("access_policies: allowed_commands requires mode restricted")
+			}
+		case "restricted":
+			if len(p.AllowedCommands) == 0 {
+				return cfg, errors.New("access_policies: restricted requires allowed_commands")
+			}
+			for _, pattern := range p.AllowedCommands {
+				if args, err := shlex.Split(pattern, true); err != nil || len(args) == 0 {
+					return cfg, fmt.Errorf("access_policies: invalid allowed command %q", pattern)
+				}
+			}
+		default:
+			return cfg, fmt.Errorf("access_policies: unknown mode %q, expected full or restricted", p.Mode)
+		}
+	}
+
+	if cfg.KeyRefresh != "" {
+		d, err := time.ParseDuration(cfg.KeyRefresh)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid key_refresh: %w", err)
+		}
+
+		if d < time.Minute {
+			return cfg, errors.New("key_refresh must be at least 1m")
+		}
+
+		cfg.ParsedKeyRefresh = d
+	}
+
+	if kf := cfg.KeyFetch; kf != nil && kf.Timeout != "" {
+		if _, err := time.ParseDuration(kf.Timeout); err != nil {
+			return cfg, fmt.Errorf("invalid key_fetch.timeout: %w", err)
+		}
+	}
+
+	switch cfg.AuthorizeCollaborators {
+	case "", "pull", "triage", "push", "maintain", "admin":
+	default:
+		return cfg, fmt.Errorf("invalid authorize_collaborators %q, expected pull, triage, push, maintain or admin", cfg.AuthorizeCollaborators)
+	}
+
+	if _, err := waiter.ParseTemplate(cfg.MOTD); err != nil {
+		return cfg, fmt.Errorf("invalid motd: %w", err)
+	}
+
+	if cfg.SlackBot != nil {
+		if _, err := waiter.ParseTemplate(cfg.SlackBot.Text); err != nil {
+			return cfg, fmt.Errorf("invalid slack_bot.text: %w", err)
+		}
+	}
+
+	if cfg.Discord != nil && cfg.Discord.WebhookURL == "" {
+		return cfg, errors.New("discord is missing webhook_url")
+	}
+
+	if cfg.Teams != nil && cfg.Teams.WebhookURL == "" {
+		return cfg, errors.New("teams is missing webhook_url")
+	}
+
+	if mm := cfg.Mattermost; mm != nil {
+		if mm.WebhookURL == "" && (mm.ServerURL == "" || mm.Token == "" || mm.ChannelID == "") {
+			return cfg, errors.New("mattermost requires either webhook_url, or server_url, token and channel_id")
+		}
+	}
+
+	if email := cfg.Email; email != nil {
+		if email.Host == "" || email.From == "" || len(email.To) == 0 {
+			return cfg, errors.New("email requires host, from and to")
+		}
 	}
 
 	if len(cfg.Shell) == 0 {
@@ -78,11 +267,66 @@ func LoadConfig(ctx context.Context, file string) (ParsedConfig, error) {
 
 	cfg.ParsedDuration = dur
 
-	keyMap, err := github.ResolveSSHKeys(ctx, cfg.AuthorizedGithubUsers)
+	if cfg.MaxDuration != "" {
+		if cfg.ParsedMaxDuration, err = time.ParseDuration(cfg.MaxDuration); err != nil {
+			return cfg, fmt.Errorf("invalid max_duration: %w", err)
+		}
+	}
+
+	if cfg.MaxExtension != "" {
+		if cfg.ParsedMaxExtension, err = time.ParseDuration(cfg.MaxExtension); err != nil {
+			return cfg, fmt.Errorf("invalid max_extension: %w", err)
+		}
+	}
+
+	if cfg.ExpiredExitCode < 0 || cfg.ExpiredExitCode > 255 {
+		return cfg, errors.New("expired_exit_code must be between 0 and 255")
+	}
+
+	if cfg.MaxExtensions < 0 {
+		return cfg, errors.New("max_extensions can't be negative")
+	}
+
+	if ar := cfg.AutoResume; ar != nil {
+		if ar.NoConnectionWithin != "" {
+			if cfg.ParsedNoConnectionWithin, err = time.ParseDuration(ar.NoConnectionWithin); err != nil {
+				return cfg, fmt.Errorf("invalid auto_resume.no_connection_within: %w", err)
+			}
+		}
+
+		if ar.AfterLastDisconnect != "" {
+			if cfg.ParsedAfterLastDisconnect, err = time.ParseDuration(ar.AfterLastDisconnect); err != nil {
+				return cfg, fmt.Errorf("invalid auto_resume.after_last_disconnect: %w", err)
+			}
+		}
+	}
+
+	if cfg.Control != nil {
+		token, err := resolveControlToken(*cfg.Control)
+		if err != nil {
+			return cfg, err
+		}
+
+		cfg.ControlToken = token
+	}
+
+	allKeys, err := ResolveAuthorizedKeys(ctx, cfg.WaitConfig)
 	if err != nil {
 		return cfg, err
 	}
 
+	cfg.AllKeys = allKeys
+	return cfg, nil
+}
+
+// ResolveAuthorizedKeys returns all keys which may connect, mapped to who
+// owns them. Keys which were specified directly are their own owners.
+func ResolveAuthorizedKeys(ctx context.Context, cfg internalv1.WaitConfig) (map[string]string, error) {
+	keyMap, err := resolveKeys(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	revIndex := map[string]string{}
 
 	for _, key := range cfg.AuthorizedKeys {
@@ -95,14 +339,278 @@ func LoadConfig(ctx context.Context, file string) (ParsedConfig, error) {
 		}
 	}
 
-	cfg.AllKeys = revIndex
-	return cfg, nil
+	return revIndex, nil
+}
+
+// AuthorizedUsers returns who may connect to the breakpoint: GitHub users by
+// name, and keys which were specified directly by fingerprint.
+func (cfg ParsedConfig) AuthorizedUsers() []string {
+	var users []string
+	for key, owner := range cfg.AllKeys {
+		if owner == key {
+			if pk, _, _, _, err := gossh.ParseAuthorizedKey([]byte(key)); err == nil {
+				owner = gossh.FingerprintSHA256(pk)
+			}
+		}
+
+		if !slices.Contains(users, owner) {
+			users = append(users, owner)
+		}
+	}
+
+	slices.Sort(users)
+	return users
+}
+
+// SessionEnviron returns the environment that sessions start with: the
+// variables of `environ` (e.g. os.Environ()) which session_env allows, and
+// its additional variables.
+func (cfg ParsedConfig) SessionEnviron(environ []string) []string {
+	se := cfg.SessionEnv
+	if se == nil {
+		return environ
+	}
+
+	return append(sshd.FilterEnv(environ, se.Allow, se.Deny), expandEnv(se.Set)...)
+}
+
+// expandEnv returns `vars` in KEY=VALUE form, sorted by key.
+func expandEnv(vars map[string]string) []string {
+	keys := maps.Keys(vars)
+	slices.Sort(keys)
+
+	var env []string
+	for _, k := range keys {
+		env = append(env, fmt.Sprintf("%s=%s", k, os.ExpandEnv(vars[k])))
+	}
+	return env
+}
+
+// resolveKeys fetches the keys of all authorized users, keyed by owner.
+func resolveKeys(ctx context.Context, cfg internalv1.WaitConfig) (map[string][]string, error) {
+	reqs, err := githubKeyRequests(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, src := range cfg.KeySources {
+		var source keysource.Source
+		switch src.Type {
+		case "github":
+			source = keysource.GitHub(src.Server)
+		case "gitlab":
+			source = keysource.GitLab(src.Server)
+		case "gitea":
+			source = keysource.Gitea(src.Server)
+		case "url":
+			owner := src.Owner
+			if owner == "" {
+				owner = src.URL
+			}
+			reqs = append(reqs, keysource.Request{Source: keysource.URL(os.ExpandEnv(src.URL)), Owner: owner})
+			continue
+		}
+
+		for _, user := range src.Users {
+			owner := user
+			if src.Type != "github" {
+				owner = fmt.Sprintf("%s (%s)", user, src.Type)
+			}
+			reqs = append(reqs, keysource.Request{Source: source, User: user, Owner: owner})
+		}
+	}
+
+	var opts keysource.Options
+	if kf := cfg.KeyFetch; kf != nil {
+		opts.Parallelism = kf.Parallelism
+		opts.Tolerant = kf.Tolerant
+		opts.CacheDir = os.ExpandEnv(kf.CacheDir)
+		if kf.Timeout != "" {
+			opts.Timeout, _ = time.ParseDuration(kf.Timeout) // Validated in LoadConfig.
+		}
+	}
+
+	return keysource.Resolve(ctx, reqs, opts)
+}
+
+// githubKeyRequests determines which GitHub users are authorized, including
+// the members of authorized teams and organizations. With GitHub Enterprise
+// Server, keys are fetched from the same server as the API. Owners record why
+// each user was authorized, e.g. "alice (actor)".
+func githubKeyRequests(ctx context.Context, cfg internalv1.WaitConfig) ([]keysource.Request, error) {
+	apiURL := cfg.GithubAPIURL
+	if apiURL == "" {
+		apiURL = os.Getenv("GITHUB_API_URL")
+	}
+
+	token := os.ExpandEnv(cfg.GithubToken)
+	if token == "" {
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+
+	client, err := github.NewClient(ctx, apiURL, token)
+	if err != nil {
+		return nil, err
+	}
+
+	var users authorizedUsers
+	for _, login := range cfg.AuthorizedGithubUsers {
+		users.add(login, "")
+	}
+
+	if cfg.AuthorizeActor {
+		// Bots (e.g. dependabot[bot]) don't have keys.
+		if actor := os.Getenv("GITHUB_ACTOR"); actor != "" && !strings.HasSuffix(actor, "[bot]") {
+			users.add(actor, "actor")
+		}
+
+		if actor := os.Getenv("GITHUB_TRIGGERING_ACTOR"); actor != "" && !strings.HasSuffix(actor, "[bot]") {
+			users.add(actor, "triggering actor")
+		}
+	}
+
+	if cfg.AuthorizeCollaborators != "" {
+		repository := os.Getenv("GITHUB_REPOSITORY")
+		if repository == "" {
+			return nil, errors.New("authorize_collaborators requires GITHUB_REPOSITORY")
+		}
+
+		collaborators, err := client.Collaborators(ctx, repository, cfg.AuthorizeCollaborators)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve collaborators of %q: %w", repository, err)
+		}
+
+		zerolog.Ctx(ctx).Info().Str("repository", repository).Int("collaborators", len(collaborators)).Msg("Resolved collaborators")
+		for _, login := range collaborators {
+			users.add(login, "collaborator")
+		}
+	}
+
+	for _, team := range cfg.AuthorizedGithubTeams {
+		members, err := client.TeamMembers(ctx, team)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve members of GitHub team %q: %w", team, err)
+		}
+
+		zerolog.Ctx(ctx).Info().Str("team", team).Int("members", len(members)).Msg("Resolved team members")
+		for _, login := range members {
+			users.add(login, team)
+		}
+	}
+
+	for _, org := range cfg.AuthorizedGithubOrgMembers {
+		members, err := client.OrgMembers(ctx, org)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve members of GitHub organization %q: %w", org, err)
+		}
+
+		zerolog.Ctx(ctx).Info().Str("org", org).Int("members", len(members)).Msg("Resolved organization members")
+		for _, login := range members {
+			users.add(login, org)
+		}
+	}
+
+	var reqs []keysource.Request
+	for _, login := range users.logins {
+		reqs = append(reqs, keysource.Request{Source: client.KeySource(), User: login, Owner: users.owner(login)})
+	}
+
+	return reqs, nil
+}
+
+// authorizedUsers keeps track of GitHub users, and why they were authorized.
+type authorizedUsers struct {
+	logins  []string
+	reasons map[string][]string
+}
+
+// add records that `login` is authorized; reason is empty if the user was
+// listed explicitly.
+func (a *authorizedUsers) add(login, reason string) {
+	if !slices.Contains(a.logins, login) {
+		a.logins = append(a.logins, login)
+	}
+
+	if reason == "" {
+		return
+	}
+
+	if a.reasons == nil {
+		a.reasons = map[string][]string{}
+	}
+
+	if !slices.Contains(a.reasons[login], reason) {
+		a.reasons[login] = append(a.reasons[login], reason)
+	}
+}
+
+func (a *authorizedUsers) owner(login string) string {
+	if reasons := a.reasons[login]; len(reasons) > 0 {
+		return fmt.Sprintf("%s (%s)", login, strings.Join(reasons, ", "))
+	}
+
+	return login
+}
+
+// LoadControlSettings returns where the control server configured in `file`
+// listens, and the token that it requires (generating one if it's required but
+// unset). Used by `breakpoint start`, which passes both to `breakpoint wait`.
+func LoadControlSettings(file string) (socketPath, token string, err error) {
+	var cfg internalv1.WaitConfig
+	if err := jsonfile.Load(file, &cfg); err != nil {
+		return "", "", err
+	}
+
+	if cfg.Control != nil {
+		socketPath = cfg.Control.SocketPath
+		if token, err = resolveControlToken(*cfg.Control); err != nil {
+			return "", "", err
+		}
+	}
+
+	if socketPath == "" {
+		if socketPath, err = bcontrol.SocketPath(); err != nil {
+			return "", "", err
+		}
+	}
+
+	return socketPath, token, nil
+}
+
+func resolveControlToken(ctl internalv1.ControlConfig) (string, error) {
+	if token := os.ExpandEnv(ctl.Token); token != "" || !ctl.RequireToken {
+		return token, nil
+	}
+
+	// Allow the caller (e.g. `breakpoint start`) to pick the token.
+	if token := os.Getenv(bcontrol.TokenEnv); token != "" {
+		return token, nil
+	}
+
+	var b [32]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate control token: %w", err)
+	}
+
+	return hex.EncodeToString(b[:]), nil
 }
 
 type ParsedConfig struct {
 	internalv1.WaitConfig
 
-	AllKeys          map[string]string // Key ID -> Owned name
-	ParsedDuration   time.Duration
+	AllKeys            map[string]string // Key ID -> Owned name
+	ParsedDuration     time.Duration
+	ParsedMaxDuration  time.Duration
+	ParsedMaxExtension time.Duration
+	ParsedKeyRefresh   time.Duration
+
+	ParsedSessionOverrides []sshd.SessionOverride
+	ParsedRunAs            *sshd.Identity
+	ParsedSftp             sshd.SftpOpts
+
+	ParsedNoConnectionWithin  time.Duration
+	ParsedAfterLastDisconnect time.Duration
+
 	RegisterMetadata metadata.MD
+	ControlToken     string // Required by the control server, if set.
 }
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	internalv1 "namespacelabs.dev/breakpoint/api/private/v1"
+	"namespacelabs.dev/breakpoint/pkg/bcontrol"
+)
+
+func TestResolveGitHubKeysRecordsReasons(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v3/repos/acme/app/collaborators":
+			if r.URL.Query().Get("permission") != "push" {
+				t.Errorf("unexpected permission %q", r.URL.Query().Get("permission"))
+			}
+			fmt.Fprint(w, `[{"login": "alice"}, {"login": "carol"}]`)
+
+		case "/alice.keys", "/bob.keys", "/carol.keys", "/dave.keys":
+			fmt.Fprintf(w, "ssh-ed25519 AAAA%s\n", r.URL.Path[1:len(r.URL.Path)-5])
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	// Keys are only fetched over https.
+	prev := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = prev })
+
+	t.Setenv("GITHUB_ACTOR", "alice")
+	t.Setenv("GITHUB_TRIGGERING_ACTOR", "bob")
+	t.Setenv("GITHUB_REPOSITORY", "acme/app")
+	t.Setenv("GITHUB_TOKEN", "")
+
+	got, err := resolveKeys(context.Background(), internalv1.WaitConfig{
+		AuthorizedGithubUsers:  []string{"dave", "bob"},
+		AuthorizeActor:         true,
+		AuthorizeCollaborators: "push",
+		GithubAPIURL:           srv.URL + "/api/v3",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff(map[string][]string{
+		"alice (actor, collaborator)": {"ssh-ed25519 AAAAalice"},
+		"bob (triggering actor)":      {"ssh-ed25519 AAAAbob"},
+		"carol (collaborator)":        {"ssh-ed25519 AAAAcarol"},
+		"dave":                        {"ssh-ed25519 AAAAdave"},
+	}, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestSessionEnviron(t *testing.T) {
+	t.Setenv("WORKSPACE", "/work")
+
+	cfg := ParsedConfig{WaitConfig: internalv1.WaitConfig{
+		SessionEnv: &internalv1.SessionEnv{
+			Allow: []string{"GITHUB_*", "PATH"},
+			Deny:  []string{"GITHUB_TOKEN"},
+			Set:   map[string]string{"B": "b", "A": "$WORKSPACE/a"},
+		},
+	}}
+
+	got := cfg.SessionEnviron([]string{"PATH=/bin", "GITHUB_SHA=abc", "GITHUB_TOKEN=secret", "AWS_SECRET_ACCESS_KEY=secret"})
+	if d := cmp.Diff([]string{"PATH=/bin", "GITHUB_SHA=abc", "A=/work/a", "B=b"}, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestLoadControlSettings(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CONTROL_SECRET", "secret")
+	t.Setenv(bcontrol.TokenEnv, "")
+
+	for _, tc := range []struct {
+		name       string
+		config     string
+		socketPath string
+		token      string // "*" if a token is generated.
+	}{
+		{"default", `{}`, "", ""},
+		{"socket path", `{"control": {"socket_path": "/run/bp.sock"}}`, "/run/bp.sock", ""},
+		{"token", `{"control": {"token": "${CONTROL_SECRET}"}}`, "", "secret"},
+		{"generated token", `{"control": {"require_token": true}}`, "", "*"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(dir, "config.json")
+			if err := os.WriteFile(file, []byte(tc.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			socketPath, token, err := LoadControlSettings(file)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			wantPath := tc.socketPath
+			if wantPath == "" {
+				wantPath, _ = bcontrol.SocketPath()
+			}
+
+			if socketPath != wantPath {
+				t.Errorf("got socket path %q, want %q", socketPath, wantPath)
+			}
+
+			if tc.token == "*" {
+				if len(token) != 64 {
+					t.Errorf("expected a generated token, got %q", token)
+				}
+			} else if token != tc.token {
+				t.Errorf("got token %q, want %q", token, tc.token)
+			}
+		})
+	}
+}
+
+func TestRunAsRequiresSocketPath(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+
+	for _, tc := range []struct {
+		config  string
+		wantErr bool
+	}{
+		{`{"endpoint": "localhost:5000", "duration": "1m", "run_as": {"user": "0"}}`, true},
+		{`{"endpoint": "localhost:5000", "duration": "1m", "run_as": {"user": "0"}, "control": {"socket_path": "control.sock"}}`, true},
+		{`{"endpoint": "localhost:5000", "duration": "1m", "run_as": {"user": "0"}, "control": {"socket_path": "/run/breakpoint/control.sock"}}`, false},
+	} {
+		if err := os.WriteFile(file, []byte(tc.config), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := LoadConfig(context.Background(), file)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: got error %v, want error: %v", tc.config, err, tc.wantErr)
+			continue
+		}
+
+		if err == nil && cfg.Control.AllowedGroup != fmt.Sprint(cfg.ParsedRunAs.Gid) {
+			t.Errorf("expected allowed_group to default to the user's group, got %q", cfg.Control.AllowedGroup)
+		}
+	}
+}
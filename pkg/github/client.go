@@ -0,0 +1,126 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	gh "github.com/google/go-github/v52/github"
+	"golang.org/x/exp/slices"
+	"namespacelabs.dev/breakpoint/pkg/keysource"
+)
+
+const DefaultAPIURL = "https://api.github.com"
+
+// Client resolves GitHub users, and their keys, through the GitHub REST API.
+// It supports GitHub Enterprise Server, where the API is served under /api/v3.
+type Client struct {
+	api       *gh.Client
+	serverURL string // Where user keys are served from.
+}
+
+func NewClient(ctx context.Context, apiURL, token string) (*Client, error) {
+	if apiURL == "" {
+		apiURL = DefaultAPIURL
+	}
+
+	base, err := url.Parse(strings.TrimSuffix(apiURL, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid GitHub API url: %w", err)
+	}
+
+	var api *gh.Client
+	if token != "" {
+		api = gh.NewTokenClient(ctx, token)
+	} else {
+		api = gh.NewClient(nil)
+	}
+
+	api.BaseURL = base
+
+	return &Client{api: api, serverURL: serverURLFor(base)}, nil
+}
+
+func serverURLFor(apiURL *url.URL) string {
+	if apiURL.String() == DefaultAPIURL+"/" {
+		return defaultServerURL
+	}
+
+	server := *apiURL
+	server.Path = strings.TrimSuffix(strings.TrimSuffix(server.Path, "/"), "/api/v3")
+	return strings.TrimSuffix(server.String(), "/")
+}
+
+// TeamMembers returns the logins of the members of `team`, specified as "org/team-slug".
+func (c *Client) TeamMembers(ctx context.Context, team string) ([]string, error) {
+	org, slug, ok := strings.Cut(team, "/")
+	if !ok || org == "" || slug == "" {
+		return nil, fmt.Errorf("invalid team %q, expected org/team", team)
+	}
+
+	opts := &gh.TeamListTeamMembersOptions{ListOptions: gh.ListOptions{PerPage: 100}}
+	return listLogins(func() ([]*gh.User, *gh.Response, error) {
+		users, resp, err := c.api.Teams.ListTeamMembersBySlug(ctx, org, slug, opts)
+		if resp != nil {
+			opts.Page = resp.NextPage
+		}
+		return users, resp, err
+	})
+}
+
+// OrgMembers returns the logins of the members of `org`. Without a token (or
+// without the read:org scope), only public members are returned.
+func (c *Client) OrgMembers(ctx context.Context, org string) ([]string, error) {
+	opts := &gh.ListMembersOptions{ListOptions: gh.ListOptions{PerPage: 100}}
+	return listLogins(func() ([]*gh.User, *gh.Response, error) {
+		users, resp, err := c.api.Organizations.ListMembers(ctx, org, opts)
+		if resp != nil {
+			opts.Page = resp.NextPage
+		}
+		return users, resp, err
+	})
+}
+
+// Collaborators returns the logins of the collaborators of `repository`
+// (as "owner/repo") with at least `permission`: pull, triage, push, maintain or admin.
+func (c *Client) Collaborators(ctx context.Context, repository, permission string) ([]string, error) {
+	owner, repo, ok := strings.Cut(repository, "/")
+	if !ok || owner == "" || repo == "" {
+		return nil, fmt.Errorf("invalid repository %q, expected owner/repo", repository)
+	}
+
+	opts := &gh.ListCollaboratorsOptions{Permission: permission, ListOptions: gh.ListOptions{PerPage: 100}}
+	return listLogins(func() ([]*gh.User, *gh.Response, error) {
+		users, resp, err := c.api.Repositories.ListCollaborators(ctx, owner, repo, opts)
+		if resp != nil {
+			opts.Page = resp.NextPage
+		}
+		return users, resp, err
+	})
+}
+
+func listLogins(next func() ([]*gh.User, *gh.Response, error)) ([]string, error) {
+	var logins []string
+	for {
+		users, resp, err := next()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, u := range users {
+			if login := u.GetLogin(); login != "" && !slices.Contains(logins, login) {
+				logins = append(logins, login)
+			}
+		}
+
+		if resp.NextPage == 0 {
+			return logins, nil
+		}
+	}
+}
+
+// KeySource returns where the keys of users are fetched from.
+func (c *Client) KeySource() keysource.Source {
+	return keysource.GitHub(c.serverURL)
+}
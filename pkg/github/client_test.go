@@ -0,0 +1,81 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestResolveMembers(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/api/v3/orgs/acme/teams/oncall/members":
+			if r.URL.Query().Get("page") == "2" {
+				fmt.Fprint(w, `[{"login": "carol"}]`)
+				return
+			}
+
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v3/orgs/acme/teams/oncall/members?page=2>; rel="next"`, srv.URL))
+			fmt.Fprint(w, `[{"login": "alice"}, {"login": "bob"}]`)
+
+		case "/api/v3/orgs/acme/members":
+			fmt.Fprint(w, `[{"login": "alice"}, {"login": "dave"}]`)
+
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(context.Background(), srv.URL+"/api/v3", "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.serverURL != srv.URL {
+		t.Errorf("expected keys to be served from %q, got %q", srv.URL, c.serverURL)
+	}
+
+	team, err := c.TeamMembers(context.Background(), "acme/oncall")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff([]string{"alice", "bob", "carol"}, team); d != "" {
+		t.Errorf("team mismatch (-want +got):\n%s", d)
+	}
+
+	org, err := c.OrgMembers(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff([]string{"alice", "dave"}, org); d != "" {
+		t.Errorf("org mismatch (-want +got):\n%s", d)
+	}
+
+	if _, err := c.TeamMembers(context.Background(), "acme"); err == nil {
+		t.Errorf("expected team without slug to be rejected")
+	}
+}
+
+func TestServerURL(t *testing.T) {
+	c, err := NewClient(context.Background(), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.serverURL != "https://github.com" {
+		t.Errorf("unexpected server url %q", c.serverURL)
+	}
+}
@@ -1,9 +1,11 @@
 package httperrors
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 )
 
 type HttpError struct {
@@ -27,3 +29,13 @@ func MaybeError(resp *http.Response) error {
 
 	return nil
 }
+
+// WithoutURL removes the request's URL from errors, as it may include secrets
+// (e.g. a token in the query string, or a webhook URL which is a credential).
+func WithoutURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return fmt.Errorf("%s: %w", urlErr.Op, urlErr.Err)
+	}
+	return err
+}
@@ -2,50 +2,112 @@ package internalserver
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 	pb "namespacelabs.dev/breakpoint/api/private/v1"
 	"namespacelabs.dev/breakpoint/pkg/bcontrol"
+	"namespacelabs.dev/breakpoint/pkg/sshd"
 	"namespacelabs.dev/breakpoint/pkg/waiter"
 )
 
+type ServeOpts struct {
+	SocketPath   string          // If unset, defaults to bcontrol.SocketPath().
+	AllowedGroup string          // Members of this group may also use the socket.
+	Token        string          // If set, callers must present this token.
+	SSH          *sshd.SSHServer // If set, authorized keys may be changed.
+}
+
 type waiterService struct {
 	manager *waiter.Manager
+	ssh     *sshd.SSHServer
+	logger  zerolog.Logger
 	pb.UnimplementedControlServiceServer
 }
 
-func ListenAndServe(ctx context.Context, mgr *waiter.Manager) error {
-	socketPath, err := bcontrol.SocketPath()
-	if err != nil {
-		return err
+func ListenAndServe(ctx context.Context, mgr *waiter.Manager, opts ServeOpts) error {
+	socketPath := opts.SocketPath
+	if socketPath == "" {
+		p, err := bcontrol.SocketPath()
+		if err != nil {
+			return err
+		}
+		socketPath = p
+	}
+
+	gid := -1
+	if opts.AllowedGroup != "" {
+		g, err := lookupGroup(opts.AllowedGroup)
+		if err != nil {
+			return err
+		}
+		gid = g
+	}
+
+	dirMode, socketMode := os.FileMode(0700), os.FileMode(0600)
+	if gid >= 0 {
+		dirMode, socketMode = 0750, 0660
 	}
 
-	if err := os.MkdirAll(filepath.Dir(socketPath), 0755); err != nil {
+	dir := filepath.Dir(socketPath)
+	if err := createSocketDir(dir, dirMode, gid); err != nil {
 		return err
 	}
 
+	// Only fix up the permissions of our own directory; a custom socket path
+	// may point to a directory shared with other programs.
+	if opts.SocketPath == "" {
+		if err := restrictPath(dir, dirMode, gid); err != nil {
+			return err
+		}
+	}
+
+	if gid >= 0 {
+		if err := checkTraversable(dir, gid); err != nil {
+			return err
+		}
+	}
+
 	_ = os.Remove(socketPath) // Remove any leftovers.
 
 	defer func() {
 		_ = os.Remove(socketPath)
 	}()
 
-	var d net.ListenConfig
-	lis, err := d.Listen(ctx, "unix", socketPath)
+	lis, err := listen(ctx, socketPath, socketMode, gid)
 	if err != nil {
 		log.Fatalf("failed to listen: %v", err)
 	}
 
-	grpcServer := grpc.NewServer()
+	logger := zerolog.Ctx(ctx).With().Str("service", "control").Logger()
+
+	grpcOpts := []grpc.ServerOption{grpc.Creds(peerTransport{insecure.NewCredentials()})}
+	if opts.Token != "" {
+		grpcOpts = append(grpcOpts, grpc.UnaryInterceptor(requireToken(logger, opts.Token)))
+	}
+
+	grpcServer := grpc.NewServer(grpcOpts...)
 	pb.RegisterControlServiceServer(grpcServer, waiterService{
 		manager: mgr,
+		ssh:     opts.SSH,
+		logger:  logger,
 	})
 
 	eg, ctx := errgroup.WithContext(ctx)
@@ -57,29 +119,292 @@ func ListenAndServe(ctx context.Context, mgr *waiter.Manager) error {
 	})
 
 	eg.Go(func() error {
-		return grpcServer.Serve(lis)
+		return grpcServer.Serve(&peerCheckingListener{
+			Listener: lis,
+			logger:   logger,
+			uid:      os.Getuid(),
+			gid:      gid,
+		})
 	})
 
 	return eg.Wait()
 }
 
+// listen creates the socket within a private directory, and only moves it to
+// `socketPath` once its permissions are restricted: it's never reachable with
+// the default permissions.
+func listen(ctx context.Context, socketPath string, mode os.FileMode, gid int) (net.Listener, error) {
+	// Short names, as socket paths are limited to ~100 bytes.
+	tmpDir, err := os.MkdirTemp(filepath.Dir(socketPath), ".bp")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(tmpDir)
+
+	tmpPath := filepath.Join(tmpDir, "s")
+
+	var d net.ListenConfig
+	lis, err := d.Listen(ctx, "unix", tmpPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is removed from `socketPath` instead.
+	if ul, ok := lis.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+
+	if err := restrictPath(tmpPath, mode, gid); err != nil {
+		_ = lis.Close()
+		return nil, err
+	}
+
+	if err := os.Rename(tmpPath, socketPath); err != nil {
+		_ = lis.Close()
+		return nil, err
+	}
+
+	return lis, nil
+}
+
+// createSocketDir creates `dir` and any missing parents. Only directories
+// created here are restricted to `mode` and assigned to the group `gid`.
+func createSocketDir(dir string, mode os.FileMode, gid int) error {
+	var missing []string
+	for p := filepath.Clean(dir); ; p = filepath.Dir(p) {
+		if _, err := os.Stat(p); err == nil {
+			break
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		missing = append(missing, p)
+		if filepath.Dir(p) == p {
+			break
+		}
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], mode); err != nil {
+			return err
+		}
+
+		if err := restrictPath(missing[i], mode, gid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkTraversable fails if members of the group `gid` can't reach files
+// within `dir`.
+func checkTraversable(dir string, gid int) error {
+	for p := filepath.Clean(dir); ; p = filepath.Dir(p) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+
+		if !groupCanTraverse(info, gid) {
+			return fmt.Errorf("control: members of group %d can't reach the socket, as they may not access %q", gid, p)
+		}
+
+		if filepath.Dir(p) == p {
+			return nil
+		}
+	}
+}
+
+func restrictPath(path string, mode os.FileMode, gid int) error {
+	if gid >= 0 {
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("failed to change group of %q: %w", path, err)
+		}
+	}
+
+	return os.Chmod(path, mode)
+}
+
+func requireToken(logger zerolog.Logger, token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, v := range md.Get(bcontrol.TokenMetadataKey) {
+			if subtle.ConstantTimeCompare([]byte(v), []byte(token)) == 1 {
+				return handler(ctx, req)
+			}
+		}
+
+		logger.Warn().Str("method", info.FullMethod).Msg("Rejected control call without a valid token")
+		return nil, status.Errorf(codes.Unauthenticated, "a valid control token is required (set %s)", bcontrol.TokenEnv)
+	}
+}
+
 func (g waiterService) Extend(ctx context.Context, req *pb.ExtendRequest) (*pb.ExtendResponse, error) {
-	expiration := g.manager.ExtendWait(req.WaitFor.AsDuration())
+	res := g.manager.ExtendWait(req.WaitFor.AsDuration())
 	return &pb.ExtendResponse{
-		Expiration: timestamppb.New(expiration),
+		Expiration:  timestamppb.New(res.Expiration),
+		Clamped:     res.Clamped,
+		ClampReason: res.ClampReason,
 	}, nil
 }
 
+func (g waiterService) HoldWhileConnected(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
+	g.manager.HoldWhileConnected(ctx)
+	return &emptypb.Empty{}, nil
+}
+
 func (g waiterService) Status(ctx context.Context, req *emptypb.Empty) (*pb.StatusResponse, error) {
 	status := g.manager.Status()
-	return &pb.StatusResponse{
+	resp := &pb.StatusResponse{
 		Expiration:     timestamppb.New(status.Expiration),
 		Endpoint:       status.Endpoint,
 		NumConnections: status.NumConnections,
-	}, nil
+	}
+
+	for _, d := range status.WebhookDeliveries {
+		resp.WebhookDeliveries = append(resp.WebhookDeliveries, &pb.WebhookDelivery{
+			Time:       timestamppb.New(d.Time),
+			Event:      string(d.Event),
+			Url:        d.URL,
+			Attempts:   uint32(d.Attempts),
+			StatusCode: int32(d.StatusCode),
+			Error:      d.Error,
+		})
+	}
+
+	return resp, nil
 }
 
-func (g waiterService) Resume(ctx context.Context, req *emptypb.Empty) (*emptypb.Empty, error) {
-	g.manager.StopWait()
+func (g waiterService) Resume(ctx context.Context, req *pb.ResumeRequest) (*emptypb.Empty, error) {
+	opts := waiter.ResumeOpts{Rerun: req.GetRerun(), CancelJob: req.GetCancelJob()}
+	if opts.CancelJob && (opts.Rerun || req.ExitCode != nil) {
+		return nil, status.Errorf(codes.InvalidArgument, "canceling the job can't be combined with an exit code or a re-run")
+	}
+
+	if req.ExitCode != nil {
+		code := int(req.GetExitCode())
+		if code < 0 || code > 255 {
+			return nil, status.Errorf(codes.InvalidArgument, "exit code must be between 0 and 255, got %d", code)
+		}
+
+		opts.ExitCode = &code
+	}
+
+	g.manager.StopWait(opts)
 	return &emptypb.Empty{}, nil
 }
+
+func (g waiterService) AuthorizeKeys(ctx context.Context, req *pb.AuthorizeKeysRequest) (*pb.AuthorizeKeysResponse, error) {
+	if g.ssh == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "ssh server is not running")
+	}
+
+	if len(req.Add) > 0 {
+		if err := g.ssh.AddAuthorizedKeys(req.Add, req.Owner); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+		}
+	}
+
+	for _, match := range req.Remove {
+		revoked := g.ssh.RemoveAuthorizedKeys(match)
+		if len(revoked) == 0 {
+			return nil, status.Errorf(codes.NotFound, "no authorized key matches %q", match)
+		}
+
+		for _, k := range revoked {
+			g.logger.Info().Str("owner", k.Owner).Str("fingerprint", k.Fingerprint).Msg("Revoked authorized key")
+		}
+	}
+
+	resp := &pb.AuthorizeKeysResponse{}
+	if req.Disconnect {
+		for _, conn := range g.ssh.DisconnectUnauthorized() {
+			g.logger.Info().Str("owner", conn.Owner).Str("remote_addr", conn.RemoteAddr).Msg("Disconnected revoked connection")
+			resp.Disconnected = append(resp.Disconnected, conn.Owner)
+		}
+	}
+
+	for _, k := range g.ssh.AuthorizedKeys() {
+		resp.Keys = append(resp.Keys, authorizedKeyToProto(k))
+	}
+
+	return resp, nil
+}
+
+func (g waiterService) Invite(ctx context.Context, req *pb.InviteRequest) (*pb.InviteResponse, error) {
+	if g.ssh == nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "ssh server is not running")
+	}
+
+	if len(req.Keys) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "no keys to authorize")
+	}
+
+	dur := req.Duration.AsDuration()
+	if dur <= 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "duration must be positive")
+	}
+
+	grant := sshd.Grant{
+		Owner:    req.Owner,
+		Expires:  time.Now().Add(dur),
+		ReadOnly: req.ReadOnly,
+	}
+
+	keys, err := g.ssh.GrantAccess(req.Keys, grant)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	owner := req.Owner
+	if owner == "" {
+		owner = keys[0].Owner
+	}
+
+	g.manager.AccessGranted(waiter.AccessGrant{
+		Owner:     owner,
+		GrantedBy: g.grantedBy(ctx, req.GrantedBy),
+		Expires:   grant.Expires,
+		ReadOnly:  grant.ReadOnly,
+	})
+
+	resp := &pb.InviteResponse{Expires: timestamppb.New(grant.Expires)}
+	for _, k := range keys {
+		resp.Keys = append(resp.Keys, authorizedKeyToProto(k))
+	}
+
+	return resp, nil
+}
+
+// grantedBy identifies who issued an invite: the owner of the ssh session that
+// the caller runs in, or otherwise its local user. The name sent by the caller
+// is only used if its peer credentials are not available, and marked as such.
+func (g waiterService) grantedBy(ctx context.Context, claimed string) string {
+	creds, ok := callerCreds(ctx)
+	if !ok {
+		if claimed == "" {
+			return ""
+		}
+		return claimed + " (unverified)"
+	}
+
+	if owner, ok := g.ssh.SessionOwner(int(creds.PID)); ok {
+		return owner
+	}
+
+	if u, err := user.LookupId(strconv.Itoa(creds.UID)); err == nil {
+		return "local user " + u.Username
+	}
+
+	return fmt.Sprintf("local uid %d", creds.UID)
+}
+
+func authorizedKeyToProto(k sshd.AuthorizedKey) *pb.AuthorizedKey {
+	key := &pb.AuthorizedKey{Owner: k.Owner, Fingerprint: k.Fingerprint, ReadOnly: k.ReadOnly, Restricted: k.Restricted}
+	if !k.Expires.IsZero() {
+		key.Expires = timestamppb.New(k.Expires)
+	}
+	return key
+}
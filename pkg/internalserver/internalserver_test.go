@@ -0,0 +1,190 @@
+package internalserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"namespacelabs.dev/breakpoint/pkg/bcontrol"
+)
+
+func TestRequireToken(t *testing.T) {
+	interceptor := requireToken(zerolog.Nop(), "secret")
+	info := &grpc.UnaryServerInfo{FullMethod: "/test/Method"}
+	handler := func(ctx context.Context, req any) (any, error) { return "ok", nil }
+
+	for _, tc := range []struct {
+		name   string
+		tokens []string
+		want   codes.Code
+	}{
+		{"valid", []string{"secret"}, codes.OK},
+		{"one of several", []string{"wrong", "secret"}, codes.OK},
+		{"wrong", []string{"wrong"}, codes.Unauthenticated},
+		{"prefix", []string{"secre"}, codes.Unauthenticated},
+		{"missing", nil, codes.Unauthenticated},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			md := metadata.MD{}
+			for _, token := range tc.tokens {
+				md.Append(bcontrol.TokenMetadataKey, token)
+			}
+
+			_, err := interceptor(metadata.NewIncomingContext(context.Background(), md), nil, info, handler)
+			if got := status.Code(err); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestPeerCheckingAllowed(t *testing.T) {
+	uid, gid := os.Getuid(), os.Getgid()
+
+	for _, tc := range []struct {
+		name  string
+		gid   int
+		creds peerCreds
+		want  bool
+	}{
+		{"same user", -1, peerCreds{UID: uid, GID: gid + 1}, true},
+		{"other user", -1, peerCreds{UID: uid + 1, GID: gid}, false},
+		{"allowed group", gid, peerCreds{UID: uid + 1, GID: gid}, true},
+		{"other group", gid, peerCreds{UID: 4242424, GID: 4242424}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			l := &peerCheckingListener{logger: zerolog.Nop(), uid: uid, gid: tc.gid}
+			if got := l.allowed(tc.creds); got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestListenRestrictsSocket(t *testing.T) {
+	dir := t.TempDir()
+	socketPath := filepath.Join(dir, "control.sock")
+
+	lis, err := listen(context.Background(), socketPath, 0600, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("expected socket to be created with 0600, got %v", info.Mode().Perm())
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("expected only the socket to be left, got %v", entries)
+	}
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+}
+
+func TestPeerCheckingListener(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only verified in linux")
+	}
+
+	for _, tc := range []struct {
+		name    string
+		uid     int
+		allowed bool
+	}{
+		{"same user", os.Getuid(), true},
+		{"other user", os.Getuid() + 1, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			socketPath := filepath.Join(t.TempDir(), "control.sock")
+
+			lis, err := listen(context.Background(), socketPath, 0600, -1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer lis.Close()
+
+			l := &peerCheckingListener{Listener: lis, logger: zerolog.Nop(), uid: tc.uid, gid: -1}
+			go func() {
+				if conn, err := l.Accept(); err == nil {
+					_, _ = conn.Write([]byte("ok"))
+					_ = conn.Close()
+				}
+			}()
+
+			conn, err := net.Dial("unix", socketPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+
+			_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+			got, _ := io.ReadAll(conn)
+			if allowed := string(got) == "ok"; allowed != tc.allowed {
+				t.Errorf("got allowed=%v, want %v", allowed, tc.allowed)
+			}
+		})
+	}
+}
+
+func TestCallerCreds(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only verified in linux")
+	}
+
+	socketPath := filepath.Join(t.TempDir(), "control.sock")
+	lis, err := listen(context.Background(), socketPath, 0600, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan peerCreds, 1)
+	srv := grpc.NewServer(grpc.Creds(peerTransport{insecure.NewCredentials()}), grpc.UnaryInterceptor(
+		func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			creds, _ := callerCreds(ctx)
+			got <- creds
+			return handler(ctx, req)
+		}))
+	healthpb.RegisterHealthServer(srv, health.NewServer())
+
+	go func() {
+		_ = srv.Serve(&peerCheckingListener{Listener: lis, logger: zerolog.Nop(), uid: os.Getuid(), gid: -1})
+	}()
+	defer srv.Stop()
+
+	_, conn, err := bcontrol.Dial(context.Background(), socketPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if creds := <-got; int(creds.PID) != os.Getpid() || creds.UID != os.Getuid() {
+		t.Errorf("unexpected caller credentials %+v", creds)
+	}
+}
@@ -0,0 +1,148 @@
+package internalserver
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os/user"
+	"strconv"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+var errPeerCredsUnsupported = errors.New("peer credentials are not supported on this platform")
+
+type peerCreds struct {
+	PID int32
+	UID int
+	GID int
+}
+
+// peerCheckingListener drops connections from processes which run neither as
+// breakpoint's own user, nor as a member of the allowed group.
+type peerCheckingListener struct {
+	net.Listener
+
+	logger zerolog.Logger
+	uid    int
+	gid    int // -1 if no group is allowed.
+
+	warnOnce sync.Once
+}
+
+func (l *peerCheckingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		creds, err := peerCredentials(conn)
+		if err != nil {
+			if errors.Is(err, errPeerCredsUnsupported) {
+				// Fallback to relying on the socket's file permissions.
+				l.warnOnce.Do(func() {
+					l.logger.Warn().Msg("Unable to verify control socket callers, relying on file permissions")
+				})
+				return conn, nil
+			}
+
+			l.logger.Err(err).Msg("Failed to obtain control socket peer credentials")
+			_ = conn.Close()
+			continue
+		}
+
+		if l.allowed(creds) {
+			return &peerConn{Conn: conn, creds: creds}, nil
+		}
+
+		l.logger.Warn().Int32("pid", creds.PID).Int("uid", creds.UID).Int("gid", creds.GID).
+			Msg("Rejected control socket connection")
+		_ = conn.Close()
+	}
+}
+
+func (l *peerCheckingListener) allowed(creds peerCreds) bool {
+	if creds.UID == l.uid {
+		return true
+	}
+
+	if l.gid < 0 {
+		return false
+	}
+
+	if creds.GID == l.gid {
+		return true
+	}
+
+	// Also check the caller's supplementary groups.
+	u, err := user.LookupId(strconv.Itoa(creds.UID))
+	if err != nil {
+		return false
+	}
+
+	groups, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(groups, strconv.Itoa(l.gid))
+}
+
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return -1, err
+	}
+
+	return strconv.Atoi(g.Gid)
+}
+
+// peerConn is a connection whose peer credentials were verified.
+type peerConn struct {
+	net.Conn
+	creds peerCreds
+}
+
+// peerTransport makes the peer credentials of connections available to
+// handlers, see callerCreds.
+type peerTransport struct {
+	credentials.TransportCredentials
+}
+
+type peerAuthInfo struct {
+	credentials.CommonAuthInfo
+	creds peerCreds
+}
+
+func (peerAuthInfo) AuthType() string { return "peercred" }
+
+func (t peerTransport) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	if pc, ok := conn.(*peerConn); ok {
+		return conn, peerAuthInfo{CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity}, creds: pc.creds}, nil
+	}
+	return t.TransportCredentials.ServerHandshake(conn)
+}
+
+func (t peerTransport) Clone() credentials.TransportCredentials {
+	return peerTransport{t.TransportCredentials.Clone()}
+}
+
+// callerCreds returns the peer credentials of the caller, if they're known.
+func callerCreds(ctx context.Context) (peerCreds, bool) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return peerCreds{}, false
+	}
+
+	info, ok := p.AuthInfo.(peerAuthInfo)
+	return info.creds, ok
+}
@@ -0,0 +1,33 @@
+package internalserver
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+func peerCredentials(conn net.Conn) (peerCreds, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return peerCreds{}, fmt.Errorf("unexpected connection type %T", conn)
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return peerCreds{}, err
+	}
+
+	var ucred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return peerCreds{}, err
+	}
+
+	if credErr != nil {
+		return peerCreds{}, credErr
+	}
+
+	return peerCreds{PID: ucred.Pid, UID: int(ucred.Uid), GID: int(ucred.Gid)}, nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package internalserver
+
+import "net"
+
+func peerCredentials(conn net.Conn) (peerCreds, error) {
+	return peerCreds{}, errPeerCredsUnsupported
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package internalserver
+
+import (
+	"os"
+	"syscall"
+)
+
+func groupCanTraverse(info os.FileInfo, gid int) bool {
+	perm := info.Mode().Perm()
+	if perm&0001 != 0 {
+		return true
+	}
+
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(st.Gid) == gid && perm&0010 != 0
+}
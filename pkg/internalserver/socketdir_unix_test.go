@@ -0,0 +1,84 @@
+//go:build !windows
+
+package internalserver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestCustomSocketDirWithGroup(t *testing.T) {
+	// A group other than our primary group, which we may assign files to.
+	gid := -1
+	if os.Getuid() == 0 {
+		gid = 4242
+	} else if groups, _ := os.Getgroups(); len(groups) > 0 {
+		for _, g := range groups {
+			if g != os.Getgid() {
+				gid = g
+			}
+		}
+	}
+	if gid < 0 {
+		t.Skip("requires root, or a supplementary group")
+	}
+
+	// Not within t.TempDir(), whose parent is private.
+	base, err := os.MkdirTemp("", "bp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(base) })
+
+	if err := os.Chmod(base, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(base, "run", "breakpoint")
+	if err := createSocketDir(dir, 0750, gid); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{filepath.Join(base, "run"), dir} {
+		info, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st := info.Sys().(*syscall.Stat_t); int(st.Gid) != gid || info.Mode().Perm() != 0750 {
+			t.Errorf("%s: expected gid %d and 0750, got gid %d and %v", p, gid, st.Gid, info.Mode().Perm())
+		}
+	}
+
+	// Existing directories are left as they are.
+	if info, _ := os.Stat(base); info.Mode().Perm() != 0755 {
+		t.Errorf("expected existing directory to be unchanged, got %v", info.Mode().Perm())
+	}
+
+	if err := checkTraversable(dir, gid); err != nil {
+		t.Error(err)
+	}
+
+	lis, err := listen(context.Background(), filepath.Join(dir, "control.sock"), 0660, gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = lis.Close()
+
+	// The group can't reach sockets within existing private directories.
+	private := filepath.Join(base, "private")
+	if err := os.Mkdir(private, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := createSocketDir(filepath.Join(private, "breakpoint"), 0750, gid); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkTraversable(filepath.Join(private, "breakpoint"), gid); err == nil {
+		t.Error("expected the group to be unable to reach the socket")
+	}
+}
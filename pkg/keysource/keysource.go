@@ -0,0 +1,251 @@
+package keysource
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	DefaultTimeout     = 10 * time.Second
+	DefaultParallelism = 4
+
+	maxKeysSize = 1 << 20
+)
+
+// ErrUnknownUser is returned when the source doesn't know the user.
+var ErrUnknownUser = errors.New("unknown user")
+
+// Keys grant shell access, so they must not be tampered with in transit.
+var errInsecureURL = errors.New("https is required")
+
+// Source resolves the keys of a user.
+type Source interface {
+	Name() string
+	URL(user string) string
+}
+
+// userKeysSource serves keys at <server>/<user>.keys, which GitHub, GitLab
+// and Gitea all support.
+type userKeysSource struct {
+	name   string
+	server string
+}
+
+func (s userKeysSource) Name() string { return s.name }
+
+func (s userKeysSource) URL(user string) string {
+	return fmt.Sprintf("%s/%s.keys", s.server, url.PathEscape(user))
+}
+
+// GitHub returns a source for github.com, or a GitHub Enterprise Server if server is set.
+func GitHub(server string) Source {
+	return userKeysSource{"github", serverOrDefault(server, "https://github.com")}
+}
+
+// GitLab returns a source for gitlab.com, or a self-managed instance if server is set.
+func GitLab(server string) Source {
+	return userKeysSource{"gitlab", serverOrDefault(server, "https://gitlab.com")}
+}
+
+// Gitea returns a source for a Gitea (or Forgejo) instance.
+func Gitea(server string) Source {
+	return userKeysSource{"gitea", strings.TrimSuffix(server, "/")}
+}
+
+func serverOrDefault(server, def string) string {
+	if server == "" {
+		return def
+	}
+	return strings.TrimSuffix(server, "/")
+}
+
+// urlSource serves a fixed authorized_keys file; the user is ignored.
+type urlSource struct {
+	url string
+}
+
+// URL returns a source which fetches an authorized_keys file.
+func URL(keysURL string) Source { return urlSource{keysURL} }
+
+func (s urlSource) Name() string           { return "url" }
+func (s urlSource) URL(user string) string { return s.url }
+
+// Request asks for the keys of User (if the source needs one) to be assigned to Owner.
+type Request struct {
+	Source Source
+	User   string
+	Owner  string
+}
+
+type Options struct {
+	// Applies to each request; defaults to DefaultTimeout.
+	Timeout time.Duration
+	// How many requests are issued concurrently; defaults to DefaultParallelism.
+	Parallelism int
+	// If set, unknown users and failed requests (with no cached keys) are
+	// skipped with a warning, rather than failing resolution.
+	Tolerant bool
+	// If set, fetched keys are cached here, and used when a later request fails.
+	CacheDir string
+}
+
+// Resolve fetches keys for all requests, and returns them by owner.
+func Resolve(ctx context.Context, reqs []Request, opts Options) (map[string][]string, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	if opts.Parallelism <= 0 {
+		opts.Parallelism = DefaultParallelism
+	}
+
+	l := zerolog.Ctx(ctx)
+
+	var mu sync.Mutex
+	result := map[string][]string{}
+
+	eg, ctx := errgroup.WithContext(ctx)
+	eg.SetLimit(opts.Parallelism)
+
+	for _, req := range reqs {
+		req := req // Capture.
+
+		eg.Go(func() error {
+			t := time.Now()
+			url := req.Source.URL(req.User)
+
+			keys, err := fetch(ctx, url, opts)
+			if err != nil {
+				if !errors.Is(err, ErrUnknownUser) && !errors.Is(err, errInsecureURL) {
+					if cached, cacheErr := readCache(opts.CacheDir, url); cacheErr == nil {
+						l.Warn().Err(err).Str("source", req.Source.Name()).Str("owner", req.Owner).Msg("Failed to fetch keys, using cached keys")
+						keys, err = cached, nil
+					}
+				}
+			} else if opts.CacheDir != "" {
+				if err := writeCache(opts.CacheDir, url, keys); err != nil {
+					l.Warn().Err(err).Msg("Failed to cache keys")
+				}
+			}
+
+			if err != nil {
+				if opts.Tolerant {
+					l.Warn().Err(err).Str("source", req.Source.Name()).Str("owner", req.Owner).Msg("Skipping keys")
+					return nil
+				}
+
+				if req.User != "" {
+					return fmt.Errorf("failed to fetch SSH keys for %s user %q: %w", req.Source.Name(), req.User, err)
+				}
+
+				return fmt.Errorf("failed to fetch SSH keys from %s: %w", url, err)
+			}
+
+			if len(keys) == 0 {
+				l.Warn().Str("source", req.Source.Name()).Str("owner", req.Owner).Dur("took", time.Since(t)).Msg("No keys found")
+				return nil
+			}
+
+			l.Info().Str("source", req.Source.Name()).Str("owner", req.Owner).Int("keys", len(keys)).Dur("took", time.Since(t)).Msg("Resolved keys")
+
+			mu.Lock()
+			result[req.Owner] = append(result[req.Owner], keys...)
+			mu.Unlock()
+			return nil
+		})
+	}
+
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func fetch(ctx context.Context, keysURL string, opts Options) ([]string, error) {
+	if u, err := url.Parse(keysURL); err != nil {
+		return nil, err
+	} else if u.Scheme != "https" {
+		return nil, fmt.Errorf("refusing to fetch keys from %s://%s: %w", u.Scheme, u.Host, errInsecureURL)
+	}
+
+	ctx, done := context.WithTimeout(ctx, opts.Timeout)
+	defer done()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, keysURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrUnknownUser
+
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	contents, err := io.ReadAll(io.LimitReader(resp.Body, maxKeysSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	return parseKeys(string(contents)), nil
+}
+
+func parseKeys(contents string) []string {
+	var keys []string
+	for _, line := range strings.Split(contents, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			keys = append(keys, line)
+		}
+	}
+	return keys
+}
+
+func cachePath(dir, url string) string {
+	h := sha256.Sum256([]byte(url))
+	return filepath.Join(dir, hex.EncodeToString(h[:])+".keys")
+}
+
+func readCache(dir, url string) ([]string, error) {
+	if dir == "" {
+		return nil, os.ErrNotExist
+	}
+
+	contents, err := os.ReadFile(cachePath(dir, url))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseKeys(string(contents)), nil
+}
+
+func writeCache(dir, url string, keys []string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(cachePath(dir, url), []byte(strings.Join(keys, "\n")+"\n"), 0600)
+}
@@ -0,0 +1,130 @@
+package keysource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/atomic"
+)
+
+func TestResolve(t *testing.T) {
+	down := atomic.NewBool(false)
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/alice.keys":
+			fmt.Fprint(w, "ssh-ed25519 AAAAalice\n\nssh-rsa AAAAalice2\n")
+		case "/team.keys":
+			fmt.Fprint(w, "# The team's keys.\nssh-ed25519 AAAAteam\n")
+		case "/slow.keys":
+			time.Sleep(200 * time.Millisecond)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	trustServer(t, srv)
+
+	ctx := context.Background()
+	cacheDir := t.TempDir()
+
+	reqs := []Request{
+		{Source: GitLab(srv.URL), User: "alice", Owner: "alice"},
+		{Source: URL(srv.URL + "/team.keys"), Owner: "team"},
+	}
+
+	got, err := Resolve(ctx, reqs, Options{CacheDir: cacheDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string][]string{
+		"alice": {"ssh-ed25519 AAAAalice", "ssh-rsa AAAAalice2"},
+		"team":  {"ssh-ed25519 AAAAteam"},
+	}
+	if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+
+	// Unknown users fail resolution, unless tolerant.
+	unknown := append(reqs, Request{Source: Gitea(srv.URL), User: "mallory", Owner: "mallory"})
+	if _, err := Resolve(ctx, unknown, Options{}); !errors.Is(err, ErrUnknownUser) {
+		t.Errorf("expected unknown user to fail, got %v", err)
+	}
+
+	if got, err := Resolve(ctx, unknown, Options{Tolerant: true}); err != nil {
+		t.Errorf("expected unknown user to be skipped, got %v", err)
+	} else if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+
+	// Requests time out.
+	slow := []Request{{Source: GitHub(srv.URL), User: "slow", Owner: "slow"}}
+	if _, err := Resolve(ctx, slow, Options{Timeout: 50 * time.Millisecond}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected request to time out, got %v", err)
+	}
+
+	// Failed requests fall back to the cache.
+	down.Store(true)
+	if got, err := Resolve(ctx, reqs, Options{CacheDir: cacheDir}); err != nil {
+		t.Errorf("expected cached keys to be used, got %v", err)
+	} else if d := cmp.Diff(want, got); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+
+	if _, err := Resolve(ctx, reqs, Options{}); err == nil {
+		t.Errorf("expected resolution to fail without a cache")
+	}
+}
+
+func TestResolveRequiresHTTPS(t *testing.T) {
+	var paths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		fmt.Fprint(w, "ssh-ed25519 AAAAinjected\n")
+	}))
+	defer srv.Close()
+
+	cacheDir := t.TempDir()
+	if err := writeCache(cacheDir, srv.URL+"/alice.keys", []string{"ssh-ed25519 AAAAcached"}); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := []Request{{Source: GitHub(srv.URL), User: "alice", Owner: "alice"}}
+	if _, err := Resolve(context.Background(), reqs, Options{CacheDir: cacheDir}); !errors.Is(err, errInsecureURL) {
+		t.Errorf("expected plain http to be refused, got %v", err)
+	}
+
+	if len(paths) != 0 {
+		t.Errorf("expected no requests, got %v", paths)
+	}
+}
+
+func TestUserIsEscaped(t *testing.T) {
+	for user, want := range map[string]string{
+		"alice":            "https://gitlab.com/alice.keys",
+		"../admin":         "https://gitlab.com/..%2Fadmin.keys",
+		"bob?token=x#frag": "https://gitlab.com/bob%3Ftoken=x%23frag.keys",
+	} {
+		if got := GitLab("").URL(user); got != want {
+			t.Errorf("%q: got %q, want %q", user, got, want)
+		}
+	}
+}
+
+// trustServer makes requests trust the test server's certificate.
+func trustServer(t *testing.T, srv *httptest.Server) {
+	prev := http.DefaultTransport
+	http.DefaultTransport = srv.Client().Transport
+	t.Cleanup(func() { http.DefaultTransport = prev })
+}
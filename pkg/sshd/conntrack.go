@@ -0,0 +1,83 @@
+package sshd
+
+import (
+	"net"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// ConnectionInfo describes an authenticated connection.
+type ConnectionInfo struct {
+	Owner      string // Who owns the key used to authenticate.
+	User       string // The requested SSH user.
+	RemoteAddr string
+}
+
+type contextKey struct{ name string }
+
+var trackedConnKey = &contextKey{"tracked-conn"}
+
+type trackedConn struct {
+	conn net.Conn
+
+	once sync.Once
+	mu   sync.Mutex
+	user string
+	key  ssh.PublicKey   // Set once the connection is authenticated.
+	info *ConnectionInfo // Set once the connection is first used.
+}
+
+func (tc *trackedConn) used() *ConnectionInfo {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.info
+}
+
+func (tc *trackedConn) authenticated(user string, key ssh.PublicKey) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.user = user
+	tc.key = key
+}
+
+func (tc *trackedConn) publicKey() (string, ssh.PublicKey) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.user, tc.key
+}
+
+// trackUse wraps channel handlers so that `onOpened` is called the first time
+// that a connection opens a channel. Channels can only be opened after the
+// connection is authenticated, so at that point we know who's connecting.
+// Channels of connections whose key has since been revoked are rejected.
+func trackUse(handlers map[string]ssh.ChannelHandler, keys *keySet, onOpened func(ConnectionInfo)) {
+	for name, handler := range handlers {
+		handler := handler
+
+		handlers[name] = func(srv *ssh.Server, conn *gossh.ServerConn, newChan gossh.NewChannel, ctx ssh.Context) {
+			key, ok := connKey(ctx, keys)
+			if !ok {
+				_ = newChan.Reject(gossh.Prohibited, "key is no longer authorized")
+				return
+			}
+
+			if tc, ok := ctx.Value(trackedConnKey).(*trackedConn); ok {
+				tc.once.Do(func() {
+					info := ConnectionInfo{Owner: key.Owner, User: ctx.User(), RemoteAddr: ctx.RemoteAddr().String()}
+
+					tc.mu.Lock()
+					tc.info = &info
+					tc.mu.Unlock()
+
+					if onOpened != nil {
+						onOpened(info)
+					}
+				})
+			}
+
+			handler(srv, conn, newChan, ctx)
+		}
+	}
+}
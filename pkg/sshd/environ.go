@@ -0,0 +1,88 @@
+package sshd
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// SessionOverride changes how sessions of some owners are started.
+type SessionOverride struct {
+	// Owners (or key fingerprints) that the override applies to.
+	Owners []string
+	// If set, replace SSHServerOpts.Shell and Dir.
+	Shell []string
+	Dir   string
+	// Added to SSHServerOpts.Env, in KEY=VALUE form.
+	Env []string
+}
+
+// sessionSettings returns the shell, working directory and environment that
+// sessions of `key` start with. Variables requested by the client are only
+// included if they match one of `opts.AcceptEnv`.
+func sessionSettings(opts SSHServerOpts, key sshKey, requested []string) (shell []string, dir string, env, rejected []string) {
+	shell, dir = opts.Shell, opts.Dir
+	env = slices.Clone(opts.Env)
+
+	if id := opts.Identity; id != nil {
+		env = append(env, id.env()...)
+		if dir == "" {
+			dir = id.dir()
+		}
+	}
+
+	for _, o := range opts.Overrides {
+		if !key.matches(o.Owners) {
+			continue
+		}
+
+		if len(o.Shell) > 0 {
+			shell = o.Shell
+		}
+		if o.Dir != "" {
+			dir = o.Dir
+		}
+		env = append(env, o.Env...)
+		break
+	}
+
+	for _, kv := range requested {
+		name, _, _ := strings.Cut(kv, "=")
+		if MatchEnv(opts.AcceptEnv, name) {
+			env = append(env, kv)
+		} else {
+			rejected = append(rejected, name)
+		}
+	}
+
+	return shell, dir, env, rejected
+}
+
+// MatchEnv returns true if the variable `name` matches one of `patterns`,
+// where `*` matches any sequence of characters (e.g. `LC_*`).
+func MatchEnv(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterEnv returns the variables of `env` (in KEY=VALUE form) that match
+// `allow` (or all of them, if it's empty), and don't match `deny`.
+func FilterEnv(env, allow, deny []string) []string {
+	var filtered []string
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if len(allow) > 0 && !MatchEnv(allow, name) {
+			continue
+		}
+		if MatchEnv(deny, name) {
+			continue
+		}
+		filtered = append(filtered, kv)
+	}
+	return filtered
+}
@@ -0,0 +1,100 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// Identity is a Unix user (and group) which sessions run as, instead of the
+// user which runs the server.
+type Identity struct {
+	Username string
+	Uid      uint32
+	Gid      uint32
+	Groups   []uint32 // Supplementary groups.
+	HomeDir  string
+}
+
+// LookupIdentity resolves a user, and optionally a group, by name or id. If
+// `group` is empty, the user's primary group is used.
+func LookupIdentity(username, group string) (*Identity, error) {
+	u, err := lookupUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	id := &Identity{Username: u.Username, HomeDir: u.HomeDir}
+
+	if id.Uid, err = parseID(u.Uid); err != nil {
+		return nil, fmt.Errorf("user %q: %w", username, err)
+	}
+
+	gid := u.Gid
+	if group != "" {
+		g, err := lookupGroup(group)
+		if err != nil {
+			return nil, err
+		}
+		gid = g.Gid
+	}
+
+	if id.Gid, err = parseID(gid); err != nil {
+		return nil, fmt.Errorf("group %q: %w", gid, err)
+	}
+
+	groupIds, err := u.GroupIds()
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve the groups of %q: %w", username, err)
+	}
+
+	for _, g := range groupIds {
+		parsed, err := parseID(g)
+		if err != nil {
+			return nil, fmt.Errorf("group %q: %w", g, err)
+		}
+		id.Groups = append(id.Groups, parsed)
+	}
+
+	return id, nil
+}
+
+func lookupUser(name string) (*user.User, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupId(name)
+	}
+	return user.Lookup(name)
+}
+
+func lookupGroup(name string) (*user.Group, error) {
+	if _, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return user.LookupGroupId(name)
+	}
+	return user.LookupGroup(name)
+}
+
+func parseID(id string) (uint32, error) {
+	v, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported id %q", id)
+	}
+	return uint32(v), nil
+}
+
+// env returns the variables which describe the user.
+func (id *Identity) env() []string {
+	return []string{
+		"HOME=" + id.HomeDir,
+		"USER=" + id.Username,
+		"LOGNAME=" + id.Username,
+	}
+}
+
+// dir returns the user's home directory, if it exists.
+func (id *Identity) dir() string {
+	if st, err := os.Stat(id.HomeDir); err == nil && st.IsDir() {
+		return id.HomeDir
+	}
+	return ""
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+
+package sshd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+)
+
+// check returns an error if the server can't run processes as `id`.
+func (id *Identity) check() error {
+	if euid := os.Geteuid(); euid != 0 && (uint32(euid) != id.Uid || uint32(os.Getegid()) != id.Gid) {
+		return fmt.Errorf("running sessions as %s (uid %d, gid %d) requires breakpoint to run as root, but it runs as uid %d", id.Username, id.Uid, id.Gid, euid)
+	}
+	return nil
+}
+
+// apply makes `cmd` run as `id`.
+func (id *Identity) apply(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid:    id.Uid,
+		Gid:    id.Gid,
+		Groups: id.Groups,
+		// Changing groups requires privileges, even if they're the same.
+		NoSetGroups: os.Geteuid() != 0,
+	}
+}
+
+// own hands a socket (and the directory it's in) over to `id`, so that its
+// processes can connect to it.
+func (id *Identity) own(socketPath string) error {
+	for _, p := range []string{filepath.Dir(socketPath), socketPath} {
+		if err := os.Chown(p, int(id.Uid), int(id.Gid)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
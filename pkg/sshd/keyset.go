@@ -0,0 +1,353 @@
+package sshd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/exp/slices"
+)
+
+// AuthorizedKey describes a key which may connect.
+type AuthorizedKey struct {
+	Owner       string
+	Fingerprint string
+	Expires     time.Time // Zero if the key doesn't expire.
+	ReadOnly    bool
+	Restricted  bool // Only allowed commands may be run, see Policy.
+}
+
+// Grant describes how keys are authorized by GrantAccess.
+type Grant struct {
+	Owner string // Defaults to the key's fingerprint.
+	// If set, the keys are no longer accepted after this time, and
+	// connections which were authenticated with them are closed.
+	Expires time.Time
+	// Read-only keys can't start shells, run commands or forward ports; they
+	// may only observe the shared terminal, and read files over SFTP.
+	ReadOnly bool
+}
+
+// keySet holds the authorized keys, which can be changed while serving: the
+// resolved set is replaced when it's refreshed, while keys added or removed
+// through the control server persist across refreshes.
+type keySet struct {
+	mu       sync.RWMutex
+	resolved []sshKey
+	added    []sshKey
+	removed  []string // Fingerprints.
+
+	observers []string  // Owners or fingerprints whose keys are read-only.
+	policies  []*Policy // The first policy which applies to a key is used.
+}
+
+func parseKeys(keys map[string]string) ([]sshKey, error) {
+	var parsed []sshKey
+	for keyStr, owner := range keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyStr))
+		if err != nil {
+			return nil, err
+		}
+
+		// Keys which were specified directly are their own owners; refer to them by fingerprint instead.
+		if owner == keyStr {
+			owner = gossh.FingerprintSHA256(key)
+		}
+
+		parsed = append(parsed, sshKey{Key: key, Owner: owner})
+	}
+
+	return parsed, nil
+}
+
+func (ks *keySet) lookup(key ssh.PublicKey) (sshKey, bool) {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	if ks.isRemoved(key) {
+		return sshKey{}, false
+	}
+
+	if k, ok := lookupKey(ks.added, key); ok {
+		return ks.annotate(k), true
+	}
+
+	if k, ok := lookupKey(ks.resolved, key); ok {
+		return ks.annotate(k), true
+	}
+
+	return sshKey{}, false
+}
+
+// annotate applies observers and policies to a key.
+func (ks *keySet) annotate(k sshKey) sshKey {
+	if k.matches(ks.observers) {
+		k.ReadOnly = true
+	}
+
+	for _, p := range ks.policies {
+		if p.appliesTo(k) {
+			if p.Restricted {
+				k.policy = p
+			}
+			break
+		}
+	}
+
+	return k
+}
+
+func (ks *keySet) isRemoved(key ssh.PublicKey) bool {
+	fp := gossh.FingerprintSHA256(key)
+	for _, removed := range ks.removed {
+		if removed == fp {
+			return true
+		}
+	}
+	return false
+}
+
+func (ks *keySet) setResolved(keys []sshKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	ks.resolved = keys
+}
+
+func (ks *keySet) add(keys []sshKey) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	for _, k := range keys {
+		fp := gossh.FingerprintSHA256(k.Key)
+
+		// Adding a key undoes its removal.
+		var removed []string
+		for _, r := range ks.removed {
+			if r != fp {
+				removed = append(removed, r)
+			}
+		}
+		ks.removed = removed
+
+		// The latest grant of a key replaces previous ones.
+		var added []sshKey
+		for _, a := range ks.added {
+			if !ssh.KeysEqual(a.Key, k.Key) {
+				added = append(added, a)
+			}
+		}
+		ks.added = append(added, k)
+	}
+}
+
+// remove revokes keys matching the key itself, its fingerprint, or its owner.
+// Returns the revoked keys.
+func (ks *keySet) remove(match string) []AuthorizedKey {
+	match = strings.TrimSpace(match)
+
+	var fingerprint string
+	if pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(match)); err == nil {
+		fingerprint = gossh.FingerprintSHA256(pk)
+	}
+
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	var revoked []AuthorizedKey
+	for _, k := range ks.effective() {
+		fp := gossh.FingerprintSHA256(k.Key)
+		if fp == match || fp == fingerprint || k.Owner == match || ownerName(k.Owner) == match {
+			ks.removed = append(ks.removed, fp)
+			revoked = append(revoked, k.authorized())
+		}
+	}
+
+	return revoked
+}
+
+// effective must be called with mu held.
+func (ks *keySet) effective() []sshKey {
+	var keys []sshKey
+	now := time.Now()
+	seen := map[string]bool{}
+	for _, k := range append(slices.Clone(ks.added), ks.resolved...) {
+		fp := gossh.FingerprintSHA256(k.Key)
+		if seen[fp] || ks.isRemoved(k.Key) || k.expired(now) {
+			continue
+		}
+		seen[fp] = true
+		keys = append(keys, ks.annotate(k))
+	}
+	return keys
+}
+
+func (ks *keySet) list() []AuthorizedKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	var keys []AuthorizedKey
+	for _, k := range ks.effective() {
+		keys = append(keys, k.authorized())
+	}
+	return keys
+}
+
+func (k sshKey) authorized() AuthorizedKey {
+	return AuthorizedKey{
+		Owner:       k.Owner,
+		Fingerprint: gossh.FingerprintSHA256(k.Key),
+		Expires:     k.Expires,
+		ReadOnly:    k.ReadOnly,
+		Restricted:  k.policy != nil,
+	}
+}
+
+// matches returns true if the key, or its owner, is listed in `owners`.
+func (k sshKey) matches(owners []string) bool {
+	fp := gossh.FingerprintSHA256(k.Key)
+	for _, o := range owners {
+		if o == fp || o == k.Owner || o == ownerName(k.Owner) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerName strips the reason from owners such as "alice (actor)".
+func ownerName(owner string) string {
+	name, _, _ := strings.Cut(owner, " (")
+	return name
+}
+
+// connRegistry keeps track of open connections, so that those whose key is
+// revoked can be disconnected.
+type connRegistry struct {
+	mu    sync.Mutex
+	conns map[*trackedConn]struct{}
+}
+
+func (r *connRegistry) add(tc *trackedConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conns == nil {
+		r.conns = map[*trackedConn]struct{}{}
+	}
+	r.conns[tc] = struct{}{}
+}
+
+func (r *connRegistry) remove(tc *trackedConn) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.conns, tc)
+}
+
+func (r *connRegistry) all() []*trackedConn {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var conns []*trackedConn
+	for tc := range r.conns {
+		conns = append(conns, tc)
+	}
+	return conns
+}
+
+// SetAuthorizedKeys replaces the resolved set of authorized keys (key to
+// owner). Keys added or removed with AddAuthorizedKeys and
+// RemoveAuthorizedKeys are preserved.
+func (s *SSHServer) SetAuthorizedKeys(keys map[string]string) error {
+	parsed, err := parseKeys(keys)
+	if err != nil {
+		return err
+	}
+
+	s.keys.setResolved(parsed)
+	return nil
+}
+
+// AddAuthorizedKeys authorizes additional keys, in authorized_keys format.
+func (s *SSHServer) AddAuthorizedKeys(keys []string, owner string) error {
+	_, err := s.GrantAccess(keys, Grant{Owner: owner})
+	return err
+}
+
+// GrantAccess authorizes additional keys, in authorized_keys format, possibly
+// only for a limited time. Returns the authorized keys.
+func (s *SSHServer) GrantAccess(keys []string, grant Grant) ([]AuthorizedKey, error) {
+	var parsed []sshKey
+	var granted []AuthorizedKey
+	for _, keyStr := range keys {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keyStr))
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", keyStr, err)
+		}
+
+		k := sshKey{Key: key, Owner: grant.Owner, Expires: grant.Expires, ReadOnly: grant.ReadOnly}
+		if k.Owner == "" {
+			k.Owner = gossh.FingerprintSHA256(key)
+		}
+
+		parsed = append(parsed, k)
+		granted = append(granted, k.authorized())
+	}
+
+	s.keys.add(parsed)
+
+	if !grant.Expires.IsZero() {
+		time.AfterFunc(time.Until(grant.Expires), func() {
+			for _, info := range s.disconnect(func(pk ssh.PublicKey) bool {
+				return slices.ContainsFunc(parsed, func(k sshKey) bool { return ssh.KeysEqual(pk, k.Key) })
+			}) {
+				s.logger.Info().Str("owner", info.Owner).Str("remote_addr", info.RemoteAddr).Msg("Closed connection, access expired")
+			}
+		})
+	}
+
+	return granted, nil
+}
+
+// RemoveAuthorizedKeys revokes keys which match either the key itself (in
+// authorized_keys format), its fingerprint, or its owner.
+func (s *SSHServer) RemoveAuthorizedKeys(match string) []AuthorizedKey {
+	return s.keys.remove(match)
+}
+
+// AuthorizedKeys returns the keys which may currently connect.
+func (s *SSHServer) AuthorizedKeys() []AuthorizedKey {
+	return s.keys.list()
+}
+
+// DisconnectUnauthorized closes connections which were authenticated with a
+// key that is no longer authorized.
+func (s *SSHServer) DisconnectUnauthorized() []ConnectionInfo {
+	return s.disconnect(func(ssh.PublicKey) bool { return true })
+}
+
+// disconnect closes connections whose key is no longer authorized, and
+// matches `match`.
+func (s *SSHServer) disconnect(match func(ssh.PublicKey) bool) []ConnectionInfo {
+	var disconnected []ConnectionInfo
+	for _, tc := range s.conns.all() {
+		user, pk := tc.publicKey()
+		if pk == nil {
+			continue // Not authenticated yet.
+		}
+
+		if _, allowed := s.keys.lookup(pk); allowed || !match(pk) {
+			continue
+		}
+
+		info := ConnectionInfo{User: user, RemoteAddr: tc.conn.RemoteAddr().String()}
+		if used := tc.used(); used != nil {
+			info = *used
+		}
+
+		_ = tc.conn.Close()
+		disconnected = append(disconnected, info)
+	}
+
+	return disconnected
+}
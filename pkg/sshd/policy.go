@@ -0,0 +1,126 @@
+package sshd
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	shlex "github.com/anmitsu/go-shlex"
+)
+
+// Policy limits what the keys of some owners may do.
+type Policy struct {
+	// Owners (or key fingerprints) that the policy applies to; if empty, it
+	// applies to everyone.
+	Owners []string
+	// If set, only commands which match one of AllowedCommands may be run,
+	// and shells, SFTP and port forwarding are not available. Commands are
+	// run directly, rather than through the shell, so that they can't be
+	// extended with e.g. `;` or `$(...)`.
+	Restricted bool
+	// Patterns matched against the command's arguments, one by one, where
+	// `*` matches any sequence of characters within an argument. Arguments
+	// which `*` matches may not contain `..` path elements.
+	AllowedCommands []string
+
+	allowed [][]argPattern
+}
+
+// argPattern matches a single argument; literal is set if it has no wildcards.
+type argPattern struct {
+	re      *regexp.Regexp
+	literal bool
+}
+
+func compilePolicies(policies []Policy) []*Policy {
+	var compiled []*Policy
+	for _, p := range policies {
+		p := p
+		p.allowed = nil
+		for _, pattern := range p.AllowedCommands {
+			// Patterns that can't be parsed never match; they're rejected
+			// when the configuration is loaded.
+			if args, err := compileCommandPattern(pattern); err == nil {
+				p.allowed = append(p.allowed, args)
+			}
+		}
+		compiled = append(compiled, &p)
+	}
+	return compiled
+}
+
+func compileCommandPattern(pattern string) ([]argPattern, error) {
+	tokens, err := shlex.Split(pattern, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(tokens) == 0 {
+		return nil, errors.New("empty pattern")
+	}
+
+	var args []argPattern
+	for _, token := range tokens {
+		parts := strings.Split(token, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+		args = append(args, argPattern{
+			re:      regexp.MustCompile("^" + strings.Join(parts, ".*") + "$"),
+			literal: len(parts) == 1,
+		})
+	}
+	return args, nil
+}
+
+func matchArgs(patterns []argPattern, args []string) bool {
+	if len(patterns) != len(args) {
+		return false
+	}
+
+	for i, arg := range args {
+		if !patterns[i].re.MatchString(arg) {
+			return false
+		}
+
+		if !patterns[i].literal && hasDotDot(arg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasDotDot returns true if arg has a `..` path element, e.g. `a/../b`.
+func hasDotDot(arg string) bool {
+	for _, elem := range strings.FieldsFunc(arg, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) appliesTo(k sshKey) bool {
+	return len(p.Owners) == 0 || k.matches(p.Owners)
+}
+
+// commandArgs returns the arguments to run `command` with, if it's allowed.
+func (p *Policy) commandArgs(command string) ([]string, error) {
+	args, err := shlex.Split(command, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(args) == 0 {
+		return nil, errors.New("empty command")
+	}
+
+	for _, patterns := range p.allowed {
+		if matchArgs(patterns, args) {
+			return args, nil
+		}
+	}
+
+	return nil, errors.New("command is not allowed")
+}
@@ -14,7 +14,9 @@ import (
 	"github.com/gliderlabs/ssh"
 )
 
-func handlePty(session io.ReadWriter, ptyReq ssh.Pty, winCh <-chan ssh.Window, cmd *exec.Cmd) error {
+// handlePty runs `cmd` in a pty until its output ends; `started` is called
+// once it's running.
+func handlePty(session io.ReadWriter, ptyReq ssh.Pty, winCh <-chan ssh.Window, cmd *exec.Cmd, started func()) error {
 	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
 	ptyFile, err := pty.Start(cmd)
 	if err != nil {
@@ -23,6 +25,8 @@ func handlePty(session io.ReadWriter, ptyReq ssh.Pty, winCh <-chan ssh.Window, c
 
 	defer ptyFile.Close()
 
+	started()
+
 	go syncWinSize(ptyFile, winCh)
 	go func() {
 		_, _ = io.Copy(ptyFile, session) // stdin
@@ -32,6 +36,21 @@ func handlePty(session io.ReadWriter, ptyReq ssh.Pty, winCh <-chan ssh.Window, c
 	return nil
 }
 
+type unixPty struct{ *os.File }
+
+func (p unixPty) Resize(width, height int) { setWinsize(p.File, width, height) }
+
+func startPty(cmd *exec.Cmd, ptyReq ssh.Pty) (ptyFile, error) {
+	cmd.Env = append(cmd.Env, fmt.Sprintf("TERM=%s", ptyReq.Term))
+	f, err := pty.Start(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	setWinsize(f, ptyReq.Window.Width, ptyReq.Window.Height)
+	return unixPty{f}, nil
+}
+
 func syncWinSize(ptyFile *os.File, winCh <-chan ssh.Window) {
 	for win := range winCh {
 		setWinsize(ptyFile, win.Width, win.Height)
@@ -39,6 +58,14 @@ func syncWinSize(ptyFile *os.File, winCh <-chan ssh.Window) {
 }
 
 func setWinsize(f *os.File, w, h int) {
-	syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), uintptr(syscall.TIOCSWINSZ),
-		uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
+	// Not using Fd(), which races with the file being closed.
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	_ = rc.Control(func(fd uintptr) {
+		syscall.Syscall(syscall.SYS_IOCTL, fd, uintptr(syscall.TIOCSWINSZ),
+			uintptr(unsafe.Pointer(&struct{ h, w, x, y uint16 }{uint16(h), uint16(w), 0, 0})))
+	})
 }
@@ -10,6 +10,10 @@ import (
 	"github.com/gliderlabs/ssh"
 )
 
-func handlePty(session io.ReadWriter, ptyReq ssh.Pty, winCh <-chan ssh.Window, cmd *exec.Cmd) error {
+func handlePty(session io.ReadWriter, ptyReq ssh.Pty, winCh <-chan ssh.Window, cmd *exec.Cmd, started func()) error {
 	return errors.New("pty not supported in windows")
 }
+
+func startPty(cmd *exec.Cmd, ptyReq ssh.Pty) (ptyFile, error) {
+	return nil, errors.New("pty not supported in windows")
+}
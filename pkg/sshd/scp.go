@@ -0,0 +1,501 @@
+package sshd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	shlex "github.com/anmitsu/go-shlex"
+	"github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog"
+)
+
+// scpArgs returns the arguments of `command` if it runs scp in server mode,
+// i.e. `scp -t` (to receive files) or `scp -f` (to send them).
+func scpArgs(command string) ([]string, bool) {
+	args, err := shlex.Split(command, true)
+	if err != nil || len(args) == 0 || args[0] != "scp" {
+		return nil, false
+	}
+
+	req, err := parseScpArgs(args[1:])
+	return args[1:], err == nil && (req.sink || req.source)
+}
+
+type scpRequest struct {
+	sink      bool // -t
+	source    bool // -f
+	recursive bool // -r
+	preserve  bool // -p
+	targetDir bool // -d
+	paths     []string
+}
+
+func parseScpArgs(args []string) (scpRequest, error) {
+	var req scpRequest
+	for i, arg := range args {
+		if arg == "--" {
+			req.paths = append(req.paths, args[i+1:]...)
+			break
+		}
+
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			req.paths = append(req.paths, arg)
+			continue
+		}
+
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 't':
+				req.sink = true
+			case 'f':
+				req.source = true
+			case 'r':
+				req.recursive = true
+			case 'p':
+				req.preserve = true
+			case 'd':
+				req.targetDir = true
+			case 'v', 'q':
+			default:
+				return req, fmt.Errorf("unsupported flag -%c", flag)
+			}
+		}
+	}
+
+	switch {
+	case req.sink == req.source:
+		return req, errors.New("expected either -t or -f")
+	case len(req.paths) == 0:
+		return req, errors.New("missing path")
+	case req.sink && len(req.paths) > 1:
+		return req, errors.New("expected a single target")
+	}
+
+	return req, nil
+}
+
+// ServeScp runs scp in server mode, as requested by `args` (e.g. `-t dir`),
+// with the same root and read-only policies as SFTP.
+func ServeScp(logger zerolog.Logger, rw io.ReadWriter, s SftpSession, args []string) error {
+	req, err := parseScpArgs(args)
+	if err != nil {
+		return err
+	}
+
+	fs, err := newSftpFS(logger, "scp", s)
+	if err != nil {
+		return err
+	}
+
+	c := &scpConn{fs: fs, req: req, r: bufio.NewReader(rw), w: rw, dir: fs.startDir(s.Dir)}
+	if req.sink {
+		err = c.sink(req.paths[0])
+	} else {
+		err = c.source(req.paths)
+	}
+
+	if err == nil && c.failed {
+		return errors.New("scp: some files were not transferred")
+	}
+
+	return err
+}
+
+// scpConn implements the scp protocol: each message is a line, which the
+// other side acknowledges with a single 0 byte, or 1 (2 if fatal) followed
+// by an error message.
+type scpConn struct {
+	fs     *sftpFS
+	req    scpRequest
+	r      *bufio.Reader
+	w      io.Writer
+	dir    string // Where relative paths start.
+	failed bool
+}
+
+func (c *scpConn) path(p string) string {
+	if path.IsAbs(p) {
+		return path.Clean(p)
+	}
+	return path.Join(c.dir, p)
+}
+
+func (c *scpConn) ack() error {
+	_, err := c.w.Write([]byte{0})
+	return err
+}
+
+// warn reports a non-fatal error to the other side.
+func (c *scpConn) warn(err error) error {
+	c.failed = true
+	_, werr := fmt.Fprintf(c.w, "\x01scp: %s\n", strings.ReplaceAll(err.Error(), "\n", " "))
+	return werr
+}
+
+func (c *scpConn) readAck() error {
+	b, err := c.r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if b == 0 {
+		return nil
+	}
+
+	msg, _ := c.r.ReadString('\n')
+	return errors.New(strings.TrimSpace(msg))
+}
+
+func (c *scpConn) send(format string, args ...any) error {
+	if _, err := fmt.Fprintf(c.w, format, args...); err != nil {
+		return err
+	}
+	return c.readAck()
+}
+
+func (c *scpConn) source(paths []string) error {
+	// Wait for the sink to be ready.
+	if err := c.readAck(); err != nil {
+		return err
+	}
+
+	for _, p := range paths {
+		p = c.path(p)
+
+		info, err := c.stat(p)
+		switch {
+		case err != nil:
+			err = c.warn(err)
+		case info.IsDir() && !c.req.recursive:
+			err = c.warn(fmt.Errorf("%s: not a regular file", p))
+		case info.IsDir():
+			err = c.sendDir(p, info)
+		default:
+			err = c.sendFile(p, info)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *scpConn) stat(p string) (os.FileInfo, error) {
+	hp, err := c.fs.hostPath(p, true)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", p, err)
+	}
+	return os.Stat(hp)
+}
+
+func (c *scpConn) sendTimes(info os.FileInfo) error {
+	if !c.req.preserve {
+		return nil
+	}
+
+	t := info.ModTime().Unix()
+	return c.send("T%d 0 %d 0\n", t, t)
+}
+
+func (c *scpConn) sendFile(p string, info os.FileInfo) error {
+	if !info.Mode().IsRegular() {
+		return c.warn(fmt.Errorf("%s: not a regular file", p))
+	}
+
+	f, err := c.fs.open(p, os.O_RDONLY, 0)
+	if err != nil {
+		return c.warn(err)
+	}
+
+	defer f.Close()
+
+	if err := c.sendTimes(info); err != nil {
+		return err
+	}
+
+	if err := c.send("C%04o %d %s\n", info.Mode().Perm(), info.Size(), path.Base(p)); err != nil {
+		return err
+	}
+
+	if _, err := io.CopyN(c.w, f, info.Size()); err != nil {
+		return err
+	}
+
+	return c.send("\x00")
+}
+
+func (c *scpConn) sendDir(p string, info os.FileInfo) error {
+	hp, err := c.fs.hostPath(p, true)
+	if err != nil {
+		return c.warn(err)
+	}
+
+	entries, err := os.ReadDir(hp)
+	if err != nil {
+		return c.warn(err)
+	}
+
+	if err := c.sendTimes(info); err != nil {
+		return err
+	}
+
+	if err := c.send("D%04o 0 %s\n", info.Mode().Perm(), path.Base(p)); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		child := path.Join(p, e.Name())
+
+		info, err := c.stat(child)
+		switch {
+		case err != nil:
+			err = c.warn(err)
+		case info.IsDir():
+			err = c.sendDir(child, info)
+		default:
+			err = c.sendFile(child, info)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.send("E\n")
+}
+
+func (c *scpConn) sink(target string) error {
+	target = c.path(target)
+
+	if err := c.fs.denyWrites("scp", target); err != nil {
+		_, _ = fmt.Fprintf(c.w, "\x02scp: %s: read-only\n", target)
+		return err
+	}
+
+	info, err := c.stat(target)
+	targetIsDir := err == nil && info.IsDir()
+	if c.req.targetDir && !targetIsDir {
+		_, _ = fmt.Fprintf(c.w, "\x02scp: %s: not a directory\n", target)
+		return fmt.Errorf("%s: not a directory", target)
+	}
+
+	if err := c.ack(); err != nil {
+		return err
+	}
+
+	var dirs []string // Directories being received.
+	dest := func(name string) string {
+		switch {
+		case len(dirs) > 0:
+			return path.Join(dirs[len(dirs)-1], name)
+		case targetIsDir:
+			return path.Join(target, name)
+		default:
+			return target
+		}
+	}
+
+	var mtime time.Time
+	for {
+		line, err := c.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return errors.New("unexpected empty message")
+		}
+
+		switch line[0] {
+		case '\x01', '\x02':
+			c.failed = true
+			c.fs.log.Warn().Str("message", line[1:]).Msg("scp: error from the client")
+			if line[0] == '\x02' {
+				return errors.New(line[1:])
+			}
+
+		case 'T':
+			var mtimeSec, atimeSec int64
+			if _, err := fmt.Sscanf(line, "T%d 0 %d 0", &mtimeSec, &atimeSec); err != nil {
+				return fmt.Errorf("invalid message %q", line)
+			}
+			mtime = time.Unix(mtimeSec, 0)
+			if err := c.ack(); err != nil {
+				return err
+			}
+
+		case 'C', 'D':
+			mode, size, name, err := parseScpHeader(line)
+			if err != nil {
+				return err
+			}
+
+			p := dest(name)
+			if line[0] == 'D' {
+				if !c.req.recursive {
+					return errors.New("received a directory, without -r")
+				}
+
+				err = c.mkdir(p, mode, mtime)
+				if err == nil {
+					dirs = append(dirs, p)
+				}
+			} else {
+				err = c.receiveFile(p, mode, size, mtime)
+			}
+
+			mtime = time.Time{}
+			if err := c.reply(err); err != nil {
+				return err
+			}
+
+		case 'E':
+			if len(dirs) == 0 {
+				return errors.New("unexpected end of directory")
+			}
+			dirs = dirs[:len(dirs)-1]
+			if err := c.ack(); err != nil {
+				return err
+			}
+
+		default:
+			return fmt.Errorf("invalid message %q", line)
+		}
+	}
+}
+
+// reply acknowledges a message, or reports the error which handling it failed with.
+func (c *scpConn) reply(err error) error {
+	var protoErr scpProtocolError
+	switch {
+	case err == nil:
+		return c.ack()
+	case errors.As(err, &protoErr):
+		return err
+	default:
+		return c.warn(err)
+	}
+}
+
+// scpProtocolError is returned if the connection can't continue.
+type scpProtocolError struct{ error }
+
+func (c *scpConn) mkdir(p string, mode os.FileMode, mtime time.Time) error {
+	hp, err := c.fs.hostPath(p, true)
+	if err != nil {
+		return err
+	}
+
+	if info, err := os.Stat(hp); err == nil && info.IsDir() {
+		return nil
+	}
+
+	err = os.Mkdir(hp, mode|0700)
+	c.fs.logOp("mkdir", p, "", err)
+	if err == nil && !mtime.IsZero() {
+		_ = os.Chtimes(hp, mtime, mtime)
+	}
+	return err
+}
+
+func (c *scpConn) receiveFile(p string, mode os.FileMode, size int64, mtime time.Time) error {
+	f, err := c.fs.open(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if err := c.ack(); err != nil {
+		_ = f.Close()
+		return scpProtocolError{err}
+	}
+
+	// Always consume the data, so that the connection can continue.
+	_, copyErr := io.CopyN(f, c.r, size)
+	if copyErr != nil {
+		if _, err := io.CopyN(io.Discard, c.r, size-f.written.Load()); err != nil {
+			_ = f.Close()
+			return scpProtocolError{err}
+		}
+	}
+
+	closeErr := f.Close()
+
+	if err := c.readAck(); err != nil {
+		return scpProtocolError{err}
+	}
+
+	if copyErr == nil && !mtime.IsZero() {
+		if hp, err := c.fs.hostPath(p, true); err == nil {
+			_ = os.Chtimes(hp, mtime, mtime)
+		}
+	}
+
+	if copyErr != nil {
+		return copyErr
+	}
+	return closeErr
+}
+
+// parseScpHeader parses `C0644 123 name` (or D for directories).
+func parseScpHeader(line string) (os.FileMode, int64, string, error) {
+	parts := strings.SplitN(line[1:], " ", 3)
+	if len(parts) != 3 {
+		return 0, 0, "", scpProtocolError{fmt.Errorf("invalid message %q", line)}
+	}
+
+	mode, err := strconv.ParseUint(parts[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", scpProtocolError{fmt.Errorf("invalid mode in %q", line)}
+	}
+
+	size, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size < 0 {
+		return 0, 0, "", scpProtocolError{fmt.Errorf("invalid size in %q", line)}
+	}
+
+	name := parts[2]
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		return 0, 0, "", scpProtocolError{fmt.Errorf("invalid name %q", name)}
+	}
+
+	return os.FileMode(mode).Perm(), size, name, nil
+}
+
+func serveScpSession(session ssh.Session, log zerolog.Logger, opts SSHServerOpts, key sshKey, args []string) {
+	s := sftpSession(opts, key)
+	log.Info().Strs("args", args).Str("root", s.Root).Bool("read_only", s.ReadOnly).Msg("scp: session started")
+
+	var err error
+	switch {
+	case len(opts.ScpCommand) > 0:
+		err = runHelperCommand(session, opts, opts.ScpCommand, append(s.Args(), append([]string{"--"}, args...)...), s.Dir)
+
+	case opts.Identity != nil:
+		err = fmt.Errorf("no scp command to run as %s", opts.Identity.Username)
+		fmt.Fprintf(session.Stderr(), "scp is not available.\n")
+
+	default:
+		err = ServeScp(log, session, s, args)
+	}
+
+	if err != nil {
+		log.Err(err).Msg("scp: session done with error")
+		session.Exit(1)
+		return
+	}
+
+	log.Info().Msg("scp: session done")
+	session.Exit(0)
+}
@@ -0,0 +1,61 @@
+package sshd
+
+import (
+	"sync"
+)
+
+// Processes are only followed up to this many ancestors.
+const maxSessionProcDepth = 64
+
+// sessionProcs tracks the processes which sessions start, so that processes
+// running within a session (e.g. `breakpoint invite`) can be attributed to it.
+type sessionProcs struct {
+	mu    sync.Mutex
+	procs map[int]string // pid -> owner
+}
+
+// add registers `pid` as started by a session of `owner`, until the returned
+// function is called.
+func (p *sessionProcs) add(pid int, owner string) func() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.procs == nil {
+		p.procs = map[int]string{}
+	}
+	p.procs[pid] = owner
+
+	return func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		delete(p.procs, pid)
+	}
+}
+
+// owner returns the owner of the session which `pid` runs in: the session
+// started it, or one of its ancestors.
+func (p *sessionProcs) owner(pid int) (string, bool) {
+	for i := 0; i < maxSessionProcDepth && pid > 1; i++ {
+		p.mu.Lock()
+		owner, ok := p.procs[pid]
+		p.mu.Unlock()
+
+		if ok {
+			return owner, true
+		}
+
+		ppid, err := parentPID(pid)
+		if err != nil {
+			return "", false
+		}
+		pid = ppid
+	}
+
+	return "", false
+}
+
+// SessionOwner returns the owner of the session which process `pid` runs in,
+// if any.
+func (s *SSHServer) SessionOwner(pid int) (string, bool) {
+	return s.procs.owner(pid)
+}
@@ -0,0 +1,29 @@
+package sshd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+func parentPID(pid int) (int, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+
+	// The command name is within parentheses, and may itself contain spaces
+	// and parentheses: `pid (comm) state ppid ...`.
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, fmt.Errorf("unexpected stat format for %d", pid)
+	}
+
+	fields := bytes.Fields(stat[end+1:])
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("unexpected stat format for %d", pid)
+	}
+
+	return strconv.Atoi(string(fields[1]))
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sshd
+
+import "errors"
+
+func parentPID(pid int) (int, error) {
+	return 0, errors.New("process ancestry is not supported on this platform")
+}
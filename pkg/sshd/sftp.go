@@ -2,26 +2,129 @@ package sshd
 
 import (
 	"io"
+	"os"
+	"os/exec"
 
 	"github.com/gliderlabs/ssh"
 	"github.com/pkg/sftp"
 	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
 )
 
-func makeSftpHandler(logger zerolog.Logger) ssh.SubsystemHandler {
+// SftpOpts configures what SFTP sessions may access.
+type SftpOpts struct {
+	// Directory which SFTP sessions are confined to; the whole filesystem if unset.
+	Root string
+	// If set, SFTP sessions may not modify files.
+	ReadOnly bool
+	// Owners (or key fingerprints) whose SFTP sessions may not modify files.
+	ReadOnlyOwners []string
+}
+
+// SftpSession configures how a single SFTP session is served.
+type SftpSession struct {
+	Owner    string
+	Root     string // See SftpOpts.Root.
+	Dir      string // Where relative paths start, unless Root is set.
+	ReadOnly bool
+}
+
+// Args returns the flags which pass the session to SftpCommand.
+func (s SftpSession) Args() []string {
+	args := []string{"--owner=" + s.Owner, "--root=" + s.Root, "--dir=" + s.Dir}
+	if s.ReadOnly {
+		args = append(args, "--read-only")
+	}
+	return args
+}
+
+func makeSftpHandler(logger zerolog.Logger, keys *keySet, opts SSHServerOpts) ssh.SubsystemHandler {
 	return func(sess ssh.Session) {
-		server, err := sftp.NewServer(sess, sftp.WithDebug(io.Discard))
-		if err != nil {
-			logger.Err(err).Msg("sftp: failed to init server")
+		key, ok := connKey(sess.Context(), keys)
+		if !ok || key.policy != nil {
+			logger.Warn().Str("owner", key.Owner).Msg("sftp: denied, not allowed for this key")
 			return
 		}
 
-		defer server.Close()
+		s := sftpSession(opts, key)
+
+		logger := logger.With().Stringer("remote_addr", sess.RemoteAddr()).Logger()
+		logger.Info().Str("owner", s.Owner).Str("root", s.Root).Bool("read_only", s.ReadOnly).Msg("sftp: session started")
 
-		if err := server.Serve(); err != nil && err != io.EOF {
+		var err error
+		switch {
+		case len(opts.SftpCommand) > 0:
+			err = runHelperCommand(sess, opts, opts.SftpCommand, s.Args(), s.Dir)
+
+		case opts.Identity != nil:
+			logger.Warn().Str("owner", key.Owner).Msg("sftp: denied, no sftp command to run as " + opts.Identity.Username)
+			return
+
+		default:
+			err = ServeSftp(logger, sess, s)
+		}
+
+		if err != nil && err != io.EOF {
 			logger.Err(err).Msg("sftp: session done with error")
 		} else {
 			logger.Info().Msg("sftp: session done")
 		}
 	}
 }
+
+// sftpSession returns how SFTP (and scp) sessions of `key` are served.
+func sftpSession(opts SSHServerOpts, key sshKey) SftpSession {
+	_, dir, _, _ := sessionSettings(opts, key, nil)
+	return SftpSession{
+		Owner:    key.Owner,
+		Root:     opts.Sftp.Root,
+		Dir:      dir,
+		ReadOnly: key.ReadOnly || opts.Sftp.ReadOnly || key.matches(opts.Sftp.ReadOnlyOwners),
+	}
+}
+
+// ServeSftp serves SFTP over `rwc` until the client disconnects. Transfers and
+// changes to files are logged to `logger`.
+func ServeSftp(logger zerolog.Logger, rwc io.ReadWriteCloser, s SftpSession) error {
+	fs, err := newSftpFS(logger, "sftp", s)
+	if err != nil {
+		return err
+	}
+
+	server := sftp.NewRequestServer(rwc, sftp.Handlers{FileGet: fs, FilePut: fs, FileCmd: fs, FileList: fs}, sftp.WithStartDirectory(fs.startDir(s.Dir)))
+
+	defer server.Close()
+
+	return server.Serve()
+}
+
+// runHelperCommand serves SFTP or scp by running `command` (see SftpCommand
+// and ScpCommand), as Identity if set.
+func runHelperCommand(sess ssh.Session, opts SSHServerOpts, command, args []string, dir string) error {
+	cmd := exec.Command(command[0], append(slices.Clone(command[1:]), args...)...)
+	cmd.Stdout = sess
+	cmd.Stderr = os.Stderr
+	cmd.Dir = dir
+	if id := opts.Identity; id != nil {
+		cmd.Env = id.env()
+		id.apply(cmd)
+	}
+
+	// Not setting Stdin, as Wait would then block until the client sends
+	// more data, even after the command exits.
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	go func() {
+		_, _ = io.Copy(stdin, sess)
+		_ = stdin.Close()
+	}()
+
+	return cmd.Wait()
+}
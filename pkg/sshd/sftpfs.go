@@ -0,0 +1,430 @@
+package sshd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/rs/zerolog"
+	"go.uber.org/atomic"
+)
+
+// sftpFS serves SFTP (and scp) requests from the host's filesystem, optionally
+// confined to a root directory. Transfers and changes are logged.
+type sftpFS struct {
+	log      zerolog.Logger
+	proto    string // Prefixes log messages.
+	root     string // Resolved; empty if the whole filesystem is served.
+	readOnly bool
+}
+
+var _ sftp.OpenFileWriter = &sftpFS{}
+var _ sftp.PosixRenameFileCmder = &sftpFS{}
+var _ sftp.LstatFileLister = &sftpFS{}
+
+func newSftpFS(log zerolog.Logger, proto string, s SftpSession) (*sftpFS, error) {
+	fs := &sftpFS{log: log.With().Str("owner", s.Owner).Logger(), proto: proto, readOnly: s.ReadOnly}
+
+	if s.Root != "" {
+		root, err := filepath.EvalSymlinks(s.Root)
+		if err != nil {
+			return nil, err
+		}
+
+		if fs.root, err = filepath.Abs(root); err != nil {
+			return nil, err
+		}
+	}
+
+	return fs, nil
+}
+
+// startDir returns where relative paths start.
+func (fs *sftpFS) startDir(dir string) string {
+	if fs.root != "" {
+		return "/"
+	}
+
+	if dir == "" {
+		dir, _ = os.Getwd()
+	}
+
+	dir = filepath.ToSlash(dir)
+	if !strings.HasPrefix(dir, "/") {
+		dir = "/" + dir // E.g. C:/Users.
+	}
+
+	return dir
+}
+
+// hostPath maps a path of the session to the host's filesystem. Within a root,
+// symlinks are resolved to make sure that they don't lead outside of it; the
+// last element is only resolved if `follow` is set.
+func (fs *sftpFS) hostPath(p string, follow bool) (string, error) {
+	hp := fs.join(p)
+	if fs.root == "" || hp == fs.root {
+		return hp, nil
+	}
+
+	dir, rest := hp, ""
+	if !follow {
+		dir, rest = filepath.Split(hp)
+	}
+
+	// Resolve the deepest parent which exists.
+	for {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			resolved = filepath.Join(resolved, rest)
+			if !fs.within(resolved) {
+				return "", sftp.ErrSSHFxPermissionDenied
+			}
+			return resolved, nil
+		}
+
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", err
+		}
+
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+}
+
+// within returns true if the host path p is within the root.
+func (fs *sftpFS) within(p string) bool {
+	return fs.root == "" || p == fs.root || strings.HasPrefix(p, fs.root+string(filepath.Separator))
+}
+
+// join maps a path of the session to the host's filesystem, without checks.
+func (fs *sftpFS) join(p string) string {
+	if fs.root == "" && runtime.GOOS == "windows" && len(p) >= 3 && p[0] == '/' && p[2] == ':' {
+		p = p[1:] // /C:/Users -> C:/Users
+	}
+	return filepath.Join(fs.root, filepath.FromSlash(p))
+}
+
+// sessionPath maps a path of the host's filesystem to the session, if it's
+// within the root.
+func (fs *sftpFS) sessionPath(p string) string {
+	if fs.root != "" && filepath.IsAbs(p) {
+		if rel, err := filepath.Rel(fs.root, p); err == nil && !strings.HasPrefix(rel, "..") {
+			return "/" + filepath.ToSlash(rel)
+		}
+	}
+	return filepath.ToSlash(p)
+}
+
+func (fs *sftpFS) denyWrites(op, path string) error {
+	if fs.readOnly {
+		fs.log.Warn().Str("op", op).Str("path", path).Msg(fs.proto + ": denied, read-only")
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	return nil
+}
+
+func (fs *sftpFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return fs.open(r.Filepath, os.O_RDONLY, 0)
+}
+
+func (fs *sftpFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	if err := fs.denyWrites(strings.ToLower(r.Method), r.Filepath); err != nil {
+		return nil, err
+	}
+	return fs.open(r.Filepath, os.O_WRONLY|openFlags(r.Pflags()), 0644)
+}
+
+func (fs *sftpFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	if err := fs.denyWrites(strings.ToLower(r.Method), r.Filepath); err != nil {
+		return nil, err
+	}
+	return fs.open(r.Filepath, os.O_RDWR|openFlags(r.Pflags()), 0644)
+}
+
+// openFlags doesn't include O_APPEND, which doesn't work with WriteAt.
+func openFlags(pflags sftp.FileOpenFlags) int {
+	var flags int
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+	return flags
+}
+
+func (fs *sftpFS) open(path string, flags int, perm os.FileMode) (*sftpFile, error) {
+	p, err := fs.hostPath(path, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if fs.root != "" {
+		// hostPath resolves symlinks, so the last element is only a symlink
+		// if it's dangling (or was replaced since). Following it could create
+		// a file outside of the root.
+		flags |= oNoFollow
+	}
+
+	f, err := os.OpenFile(p, flags, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	// A parent directory may have been replaced since it was checked.
+	if opened, ok := openedPath(f); ok && !fs.within(opened) {
+		_ = f.Close()
+		fs.log.Warn().Str("path", path).Str("opened", opened).Msg(fs.proto + ": denied, opened file is outside of the root")
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+
+	return &sftpFile{File: f, fs: fs, path: path, write: flags&(os.O_WRONLY|os.O_RDWR) != 0}, nil
+}
+
+func (fs *sftpFS) Filecmd(r *sftp.Request) error {
+	op := strings.ToLower(r.Method)
+	if err := fs.denyWrites(op, r.Filepath); err != nil {
+		return err
+	}
+
+	err := fs.filecmd(r)
+	fs.logOp(op, r.Filepath, r.Target, err)
+	return err
+}
+
+func (fs *sftpFS) logOp(op, path, target string, err error) {
+	ev := fs.log.Info().Str("op", op).Str("path", path)
+	if target != "" {
+		ev = ev.Str("target", target)
+	}
+	ev.Err(err).Msg(fs.proto + ": file operation")
+}
+
+func (fs *sftpFS) PosixRename(r *sftp.Request) error {
+	return fs.Filecmd(r)
+}
+
+func (fs *sftpFS) filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		p, err := fs.hostPath(r.Filepath, true)
+		if err != nil {
+			return err
+		}
+		return setstat(p, r.AttrFlags(), r.Attributes())
+
+	case "Rename", "PosixRename", "Link":
+		from, err := fs.hostPath(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		to, err := fs.hostPath(r.Target, false)
+		if err != nil {
+			return err
+		}
+		if r.Method == "Link" {
+			return os.Link(from, to)
+		}
+		return os.Rename(from, to)
+
+	case "Symlink":
+		// Filepath is the link's target, which is checked when it's followed.
+		p, err := fs.hostPath(r.Target, false)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(fs.join(r.Filepath), p)
+
+	case "Mkdir":
+		p, err := fs.hostPath(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		return os.Mkdir(p, 0755)
+
+	case "Rmdir", "Remove":
+		p, err := fs.hostPath(r.Filepath, false)
+		if err != nil {
+			return err
+		}
+		return os.Remove(p)
+	}
+
+	return sftp.ErrSSHFxOpUnsupported
+}
+
+func setstat(p string, flags sftp.FileAttrFlags, attrs *sftp.FileStat) error {
+	if flags.Size {
+		if err := os.Truncate(p, int64(attrs.Size)); err != nil {
+			return err
+		}
+	}
+
+	if flags.Permissions {
+		if err := os.Chmod(p, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+
+	if flags.Acmodtime {
+		if err := os.Chtimes(p, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+
+	if flags.UidGid {
+		if err := os.Chown(p, int(attrs.UID), int(attrs.GID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (fs *sftpFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		p, err := fs.hostPath(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			return nil, err
+		}
+
+		var infos listerAt
+		for _, e := range entries {
+			if info, err := e.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+		return infos, nil
+
+	case "Stat":
+		p, err := fs.hostPath(r.Filepath, true)
+		if err != nil {
+			return nil, err
+		}
+
+		info, err := os.Stat(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{info}, nil
+
+	case "Readlink":
+		p, err := fs.hostPath(r.Filepath, false)
+		if err != nil {
+			return nil, err
+		}
+
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		return listerAt{linkTarget(fs.sessionPath(target))}, nil
+	}
+
+	return nil, sftp.ErrSSHFxOpUnsupported
+}
+
+func (fs *sftpFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	p, err := fs.hostPath(r.Filepath, false)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	return listerAt{info}, nil
+}
+
+// sftpFile counts the bytes transferred, which are logged once it's closed.
+type sftpFile struct {
+	*os.File
+	fs    *sftpFS
+	path  string
+	write bool
+
+	read, written atomic.Int64
+}
+
+func (f *sftpFile) Read(b []byte) (int, error) {
+	n, err := f.File.Read(b)
+	f.read.Add(int64(n))
+	return n, err
+}
+
+func (f *sftpFile) Write(b []byte) (int, error) {
+	n, err := f.File.Write(b)
+	f.written.Add(int64(n))
+	return n, err
+}
+
+// ReadFrom is used by io.Copy, instead of Write.
+func (f *sftpFile) ReadFrom(r io.Reader) (int64, error) {
+	n, err := f.File.ReadFrom(r)
+	f.written.Add(n)
+	return n, err
+}
+
+func (f *sftpFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := f.File.ReadAt(b, off)
+	f.read.Add(int64(n))
+	return n, err
+}
+
+func (f *sftpFile) WriteAt(b []byte, off int64) (int, error) {
+	n, err := f.File.WriteAt(b, off)
+	f.written.Add(int64(n))
+	return n, err
+}
+
+func (f *sftpFile) Close() error {
+	err := f.File.Close()
+	f.fs.log.Info().Str("path", f.path).Bool("write", f.write).
+		Int64("bytes_read", f.read.Load()).Int64("bytes_written", f.written.Load()).
+		Err(err).Msg(f.fs.proto + ": closed file")
+	return err
+}
+
+type listerAt []os.FileInfo
+
+func (l listerAt) ListAt(ls []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(ls, l[offset:])
+	if n < len(ls) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// linkTarget is returned for Readlink requests, which use the name as the target.
+type linkTarget string
+
+func (t linkTarget) Name() string       { return string(t) }
+func (t linkTarget) Size() int64        { return 0 }
+func (t linkTarget) Mode() os.FileMode  { return os.ModeSymlink }
+func (t linkTarget) ModTime() time.Time { return time.Time{} }
+func (t linkTarget) IsDir() bool        { return false }
+func (t linkTarget) Sys() any           { return nil }
@@ -0,0 +1,12 @@
+package sshd
+
+import (
+	"fmt"
+	"os"
+)
+
+// openedPath returns the path of an open file, as tracked by the kernel.
+func openedPath(f *os.File) (string, bool) {
+	p, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", f.Fd()))
+	return p, err == nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package sshd
+
+import "os"
+
+// openedPath is only available in linux.
+func openedPath(f *os.File) (string, bool) {
+	return "", false
+}
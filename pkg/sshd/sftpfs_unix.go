@@ -0,0 +1,7 @@
+//go:build !windows
+
+package sshd
+
+import "syscall"
+
+const oNoFollow = syscall.O_NOFOLLOW
@@ -0,0 +1,7 @@
+//go:build windows
+
+package sshd
+
+// Windows has no equivalent to O_NOFOLLOW; creating symlinks requires
+// privileges that sessions usually don't have.
+const oNoFollow = 0
@@ -8,7 +8,9 @@ import (
 	"io"
 	"net"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/gliderlabs/ssh"
@@ -19,6 +21,12 @@ import (
 	"golang.org/x/exp/slices"
 )
 
+// With PersistentSessions, `ssh -t ... attach` reattaches to a detached shell.
+const attachCommand = "attach"
+
+// OwnerEnv is set in sessions to the owner of the key which authenticated them.
+const OwnerEnv = "BREAKPOINT_SESSION_OWNER"
+
 type SSHServerOpts struct {
 	AllowedUsers   []string
 	AuthorizedKeys map[string]string // Key to owner
@@ -26,52 +34,205 @@ type SSHServerOpts struct {
 	Shell          []string
 	Dir            string
 
+	// Variables which clients may set (e.g. with SendEnv); `*` matches any
+	// sequence of characters.
+	AcceptEnv []string
+	// Change the shell, directory or environment of some owners' sessions;
+	// the first override which applies to a key is used.
+	Overrides []SessionOverride
+
+	// If set, sessions run as this user, and start in its home directory
+	// unless Dir is set. Requires the server to run as root.
+	Identity *Identity
+	// Serves SFTP over stdin and stdout, with SftpSession.Args appended.
+	// Required to serve SFTP with Identity; otherwise, SFTP is served
+	// in-process if unset.
+	SftpCommand []string
+	// Like SftpCommand, runs scp in server mode, with SftpSession.Args, `--`
+	// and the arguments of scp (e.g. `-t dir`) appended.
+	ScpCommand []string
+	// Applies to both SFTP and scp.
+	Sftp SftpOpts
+
+	// If set, interactive sessions share a single terminal: the first one
+	// starts it, and later ones attach to it.
+	SharedTerminal bool
+	// Owners (or key fingerprints) which may only observe the shared terminal.
+	Observers []string
+	// If set, interactive shells keep running when the session disconnects;
+	// the next interactive session of the same owner (or `ssh -t ... attach`)
+	// reattaches to it.
+	PersistentSessions bool
+	// Limit what the keys of some owners may do; the first policy which
+	// applies to a key is used.
+	Policies []Policy
+
 	InteractiveMOTD func(io.Writer)
+
+	// Called whenever a connection is opened or closed.
+	OnConnectionsChanged func()
+	// Called when an authenticated connection is first used, and when it is closed.
+	OnConnectionOpened func(ConnectionInfo)
+	OnConnectionClosed func(ConnectionInfo)
 }
 
 type sshKey struct {
 	Key   ssh.PublicKey
 	Owner string
+
+	Expires  time.Time // Zero if the key doesn't expire.
+	ReadOnly bool
+
+	policy *Policy // Set if the key may only run allowed commands.
+}
+
+func (k sshKey) expired(now time.Time) bool {
+	return !k.Expires.IsZero() && !now.Before(k.Expires)
 }
 
 type SSHServer struct {
 	Server         *ssh.Server
 	NumConnections func() uint32
+	HostKey        gossh.PublicKey
+
+	logger    zerolog.Logger
+	keys      *keySet
+	conns     *connRegistry
+	terminals *terminalRegistry
+	procs     *sessionProcs
 }
 
 func MakeServer(ctx context.Context, opts SSHServerOpts) (*SSHServer, error) {
-	var authorizedKeys []sshKey
-	for key, owner := range opts.AuthorizedKeys {
-		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
-		if err != nil {
+	authorizedKeys, err := parseKeys(opts.AuthorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Identity != nil {
+		if err := opts.Identity.check(); err != nil {
 			return nil, err
 		}
-		authorizedKeys = append(authorizedKeys, sshKey{key, owner})
 	}
 
+	keys := &keySet{resolved: authorizedKeys, observers: opts.Observers, policies: compilePolicies(opts.Policies)}
+	conns := &connRegistry{}
+	terminals := &terminalRegistry{}
+	procs := &sessionProcs{}
+
 	l := zerolog.Ctx(ctx).With().Str("service", "sshd").Logger()
 
 	connCount := atomic.NewUint32(0)
+	connectionsChanged := func() {
+		if opts.OnConnectionsChanged != nil {
+			opts.OnConnectionsChanged()
+		}
+	}
 
 	srv := &ssh.Server{
 		Handler: func(session ssh.Session) {
-			key, _ := lookupKey(authorizedKeys, session.PublicKey())
+			key, ok := keys.lookup(session.PublicKey())
 			sessionLog := l.With().Stringer("remote_addr", session.RemoteAddr()).Str("owner", key.Owner).Logger()
 
+			// The key may have been revoked after the connection was established.
+			if !ok {
+				sessionLog.Warn().Str("user", session.User()).Msg("rejected session, key is no longer authorized")
+				fmt.Fprintf(session.Stderr(), "This key is no longer authorized.\n")
+				session.Exit(1)
+				return
+			}
+
 			sessionLog.Info().Str("user", session.User()).Msg("incoming ssh session")
 
-			args := opts.Shell[1:]
-			if session.RawCommand() != "" {
+			// scp is built-in, so that it works without an scp binary, and is
+			// confined to the SFTP root. Restricted keys may only run scp if
+			// it's allowed.
+			if args, ok := scpArgs(session.RawCommand()); ok {
+				if key.policy != nil {
+					if _, err := key.policy.commandArgs(session.RawCommand()); err != nil {
+						sessionLog.Warn().Err(err).Str("command", session.RawCommand()).Msg("denied command, restricted by policy")
+						fmt.Fprintf(session.Stderr(), "Command not allowed: %s\n", session.RawCommand())
+						session.Exit(1)
+						return
+					}
+				}
+
+				serveScpSession(session, sessionLog, opts, key, args)
+				return
+			}
+
+			ptyReq, winCh, isPty := session.Pty()
+			attach := opts.PersistentSessions && session.RawCommand() == attachCommand
+			interactive := isPty && (session.RawCommand() == "" || attach)
+			shared := opts.SharedTerminal && interactive
+
+			if attach && !isPty {
+				fmt.Fprintf(session.Stderr(), "attach requires a terminal, try `ssh -t`.\n")
+				session.Exit(1)
+				return
+			}
+
+			if key.ReadOnly && !shared {
+				sessionLog.Info().Msg("rejected session of read-only key")
+				if opts.SharedTerminal {
+					fmt.Fprintf(session.Stderr(), "This key only has read-only access: it may only observe the shared terminal, with an interactive session.\n")
+				} else {
+					fmt.Fprintf(session.Stderr(), "This key only has read-only access: shells and commands are not available.\n")
+				}
+				session.Exit(1)
+				return
+			}
+
+			shell, dir, env, rejected := sessionSettings(opts, key, session.Environ())
+			if len(rejected) > 0 {
+				sessionLog.Debug().Strs("env", rejected).Msg("ignored environment variables which are not accepted")
+			}
+
+			args := shell
+			if session.RawCommand() != "" && !attach {
 				if runtime.GOOS == "windows" {
-					args = []string{"/C", session.RawCommand()}
+					args = []string{shell[0], "/C", session.RawCommand()}
 				} else {
-					args = []string{"-c", session.RawCommand()}
+					args = []string{shell[0], "-c", session.RawCommand()}
 				}
 			}
 
-			cmd := exec.Command(opts.Shell[0], args...)
-			cmd.Env = slices.Clone(opts.Env)
-			cmd.Dir = opts.Dir
+			if key.policy != nil {
+				if session.RawCommand() == "" || attach {
+					sessionLog.Warn().Msg("denied shell, restricted by policy")
+					fmt.Fprintf(session.Stderr(), "This key may only run the following commands:\n")
+					for _, pattern := range key.policy.AllowedCommands {
+						fmt.Fprintf(session.Stderr(), "  %s\n", pattern)
+					}
+					session.Exit(1)
+					return
+				}
+
+				allowed, err := key.policy.commandArgs(session.RawCommand())
+				if err != nil {
+					sessionLog.Warn().Err(err).Str("command", session.RawCommand()).Msg("denied command, restricted by policy")
+					fmt.Fprintf(session.Stderr(), "Command not allowed: %s\n", session.RawCommand())
+					session.Exit(1)
+					return
+				}
+
+				// The runner's scp would not be confined to the SFTP root.
+				if strings.TrimSuffix(filepath.Base(allowed[0]), ".exe") == "scp" {
+					sessionLog.Warn().Str("command", session.RawCommand()).Msg("denied command, scp is only available with -t or -f")
+					fmt.Fprintf(session.Stderr(), "Command not allowed: %s\n", session.RawCommand())
+					session.Exit(1)
+					return
+				}
+
+				sessionLog.Info().Str("command", session.RawCommand()).Msg("running allowed command")
+				args = allowed
+			}
+
+			cmd := exec.Command(args[0], args[1:]...)
+			cmd.Env = append(env, fmt.Sprintf("%s=%s", OwnerEnv, key.Owner))
+			cmd.Dir = dir
+			if opts.Identity != nil {
+				opts.Identity.apply(cmd)
+			}
 
 			if ssh.AgentRequested(session) {
 				l, err := ssh.NewAgentListener()
@@ -79,13 +240,16 @@ func MakeServer(ctx context.Context, opts SSHServerOpts) (*SSHServer, error) {
 					fmt.Fprintf(session, "Failed to forward agent.\n")
 				} else {
 					defer l.Close()
+					if opts.Identity != nil {
+						if err := opts.Identity.own(l.Addr().String()); err != nil {
+							sessionLog.Warn().Err(err).Msg("failed to hand over agent socket")
+						}
+					}
 					go ssh.ForwardAgentConnections(l, session)
 					cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", "SSH_AUTH_SOCK", l.Addr().String()))
 				}
 			}
 
-			ptyReq, winCh, isPty := session.Pty()
-
 			sessionLog.Info().Bool("ssh_agent", ssh.AgentRequested(session)).Bool("pty", isPty).Msg("ssh session")
 
 			ctx, cancel := context.WithCancel(session.Context())
@@ -94,13 +258,55 @@ func MakeServer(ctx context.Context, opts SSHServerOpts) (*SSHServer, error) {
 			// Make sure that the connection with the client is kept alive.
 			go keepAlive(ctx, sessionLog, session)
 
+			if interactive && (opts.SharedTerminal || opts.PersistentSessions) {
+				start := func() (*terminal, error) {
+					t, err := startTerminal(cmd, ptyReq, key.Owner)
+					if err != nil {
+						return nil, err
+					}
+
+					// Anyone with access to a shared terminal may type into it.
+					owner := key.Owner
+					if shared {
+						owner += " (shared terminal)"
+					}
+
+					untrack := procs.add(cmd.Process.Pid, owner)
+					go func() {
+						<-t.done
+						untrack()
+					}()
+
+					return t, nil
+				}
+
+				name := sharedTerminalName
+				if !shared {
+					if detached, ok := terminals.detached(key.Owner); ok {
+						name = detached
+					} else if attach {
+						fmt.Fprintf(session.Stderr(), "There is no detached session to attach to.\n")
+						session.Exit(1)
+						return
+					} else {
+						name = terminals.newName(key.Owner)
+					}
+				}
+
+				serveTerminal(session, sessionLog, terminals, name, opts.PersistentSessions, key, winCh, start, opts.InteractiveMOTD)
+				return
+			}
+
+			untrack := func() {}
+			track := func() { untrack = procs.add(cmd.Process.Pid, key.Owner) }
+
 			if isPty {
 				// Print MOTD only if no command was provided
 				if opts.InteractiveMOTD != nil && session.RawCommand() == "" {
 					opts.InteractiveMOTD(session)
 				}
 
-				if err := handlePty(session, ptyReq, winCh, cmd); err != nil {
+				if err := handlePty(session, ptyReq, winCh, cmd, track); err != nil {
 					sessionLog.Err(err).Msg("pty start failed")
 					session.Exit(1)
 					return
@@ -113,10 +319,12 @@ func MakeServer(ctx context.Context, opts SSHServerOpts) (*SSHServer, error) {
 					session.Exit(1)
 					return
 				}
+				track()
 			}
 
 			// XXX pass exit code to caller?
 			err := cmd.Wait()
+			untrack()
 			sessionLog.Info().Err(err).Msg("ssh session end")
 		},
 
@@ -125,33 +333,61 @@ func MakeServer(ctx context.Context, opts SSHServerOpts) (*SSHServer, error) {
 		},
 
 		PublicKeyHandler: func(ctx ssh.Context, key ssh.PublicKey) bool {
-			_, allowed := lookupKey(authorizedKeys, key)
+			_, allowed := keys.lookup(key)
+			if tc, ok := ctx.Value(trackedConnKey).(*trackedConn); ok && allowed {
+				tc.authenticated(ctx.User(), key)
+			}
 			return allowed
 		},
 
 		LocalPortForwardingCallback: func(ctx ssh.Context, destinationHost string, destinationPort uint32) bool {
 			sessionLog := l.With().Stringer("remote_addr", ctx.RemoteAddr()).Logger()
+			if key, ok := connKey(ctx, keys); !ok || key.ReadOnly || key.policy != nil {
+				sessionLog.Warn().Str("owner", key.Owner).Str("dst", fmt.Sprintf("%s:%d", destinationHost, destinationPort)).Msg("Denied port forward, not allowed for this key")
+				return false
+			}
 			sessionLog.Info().Str("dst", fmt.Sprintf("%s:%d", destinationHost, destinationPort)).Msg("Port forward request")
 			return true
 		},
 
 		SubsystemHandlers: map[string]ssh.SubsystemHandler{
-			"sftp": makeSftpHandler(l),
+			"sftp": makeSftpHandler(l, keys, opts),
 		},
 
 		ConnCallback: func(ctx ssh.Context, conn net.Conn) net.Conn {
+			tc := &trackedConn{conn: conn}
+			ctx.SetValue(trackedConnKey, tc)
+			conns.add(tc)
+
 			connCount.Inc()
+			connectionsChanged()
+
+			// Capture the channel here: the ssh library keeps updating the
+			// context's values while the handshake is in progress.
+			done := ctx.Done()
 			go func() {
-				<-ctx.Done()
+				<-done
+				conns.remove(tc)
 				connCount.Dec()
+				connectionsChanged()
+
+				if info := tc.used(); info != nil && opts.OnConnectionClosed != nil {
+					opts.OnConnectionClosed(*info)
+				}
 			}()
 
 			return conn
 		},
 	}
 
+	go func() {
+		<-ctx.Done()
+		terminals.closeAll()
+	}()
+
 	srv.ChannelHandlers = maps.Clone(ssh.DefaultChannelHandlers)
 	srv.ChannelHandlers["direct-tcpip"] = ssh.DirectTCPIPHandler
+	trackUse(srv.ChannelHandlers, keys, opts.OnConnectionOpened)
 
 	t := time.Now()
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
@@ -171,14 +407,31 @@ func MakeServer(ctx context.Context, opts SSHServerOpts) (*SSHServer, error) {
 	return &SSHServer{
 		Server:         srv,
 		NumConnections: connCount.Load,
+		HostKey:        signer.PublicKey(),
+		logger:         l,
+		keys:           keys,
+		conns:          conns,
+		terminals:      terminals,
+		procs:          procs,
 	}, nil
 }
 
 func lookupKey(allowed []sshKey, key ssh.PublicKey) (sshKey, bool) {
+	now := time.Now()
 	for _, allowed := range allowed {
-		if ssh.KeysEqual(key, allowed.Key) {
+		if ssh.KeysEqual(key, allowed.Key) && !allowed.expired(now) {
 			return allowed, true
 		}
 	}
 	return sshKey{}, false
 }
+
+// connKey returns the key which authenticated the connection, if it's still authorized.
+func connKey(ctx ssh.Context, keys *keySet) (sshKey, bool) {
+	pk, ok := ctx.Value(ssh.ContextKeyPublicKey).(ssh.PublicKey)
+	if !ok {
+		return sshKey{}, false
+	}
+
+	return keys.lookup(pk)
+}
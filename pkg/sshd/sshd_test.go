@@ -0,0 +1,884 @@
+package sshd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+type testServer struct {
+	Addr   string
+	Signer gossh.Signer
+	Server *SSHServer
+}
+
+// startTestServer starts a server which authorizes a freshly generated key,
+// owned by "alice".
+func startTestServer(t *testing.T, opts SSHServerOpts) testServer {
+	t.Helper()
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if opts.AuthorizedKeys == nil {
+		opts.AuthorizedKeys = map[string]string{
+			string(gossh.MarshalAuthorizedKey(signer.PublicKey())): "alice",
+		}
+	}
+
+	if opts.Shell == nil {
+		opts.Shell = []string{"/bin/sh"}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	srv, err := MakeServer(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		_ = srv.Server.Serve(lis)
+	}()
+
+	t.Cleanup(func() {
+		_ = srv.Server.Close()
+	})
+
+	return testServer{Addr: lis.Addr().String(), Signer: signer, Server: srv}
+}
+
+func (ts testServer) dial(t *testing.T, user string) *gossh.Client {
+	t.Helper()
+
+	client, err := gossh.Dial("tcp", ts.Addr, &gossh.ClientConfig{
+		User:            user,
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(ts.Signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return client
+}
+
+func run(t *testing.T, client *gossh.Client, cmd string) (string, error) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer session.Close()
+
+	out, err := session.CombinedOutput(cmd)
+	return string(out), err
+}
+
+func TestConnectionTracking(t *testing.T) {
+	opened := make(chan ConnectionInfo, 1)
+	closed := make(chan ConnectionInfo, 1)
+
+	ts := startTestServer(t, SSHServerOpts{
+		OnConnectionOpened: func(ci ConnectionInfo) { opened <- ci },
+		OnConnectionClosed: func(ci ConnectionInfo) { closed <- ci },
+	})
+
+	client := ts.dial(t, "runner")
+
+	out, err := run(t, client, "echo hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.TrimSpace(out) != "hello" {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	select {
+	case ci := <-opened:
+		if ci.Owner != "alice" || ci.User != "runner" {
+			t.Errorf("unexpected connection info %+v", ci)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not reported as opened")
+	}
+
+	_ = client.Close()
+
+	select {
+	case ci := <-closed:
+		if ci.Owner != "alice" {
+			t.Errorf("unexpected connection info %+v", ci)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection was not reported as closed")
+	}
+}
+
+func TestRevokeKeys(t *testing.T) {
+	ts := startTestServer(t, SSHServerOpts{})
+
+	client := ts.dial(t, "runner")
+	if _, err := run(t, client, "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	if revoked := ts.Server.RemoveAuthorizedKeys("alice"); len(revoked) != 1 || revoked[0].Owner != "alice" {
+		t.Fatalf("unexpected revoked keys %+v", revoked)
+	}
+
+	// A refresh doesn't undo the revocation.
+	if err := ts.Server.SetAuthorizedKeys(map[string]string{
+		string(gossh.MarshalAuthorizedKey(ts.Signer.PublicKey())): "alice",
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := ts.Server.AuthorizedKeys(); len(keys) != 0 {
+		t.Errorf("expected no authorized keys, got %+v", keys)
+	}
+
+	if disconnected := ts.Server.DisconnectUnauthorized(); len(disconnected) != 1 || disconnected[0].Owner != "alice" {
+		t.Errorf("unexpected disconnected connections %+v", disconnected)
+	}
+
+	if err := client.Wait(); err == nil {
+		t.Errorf("expected connection to be closed")
+	}
+
+	if _, err := gossh.Dial("tcp", ts.Addr, &gossh.ClientConfig{
+		User:            "runner",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(ts.Signer)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	}); err == nil {
+		t.Fatal("expected revoked key to be rejected")
+	}
+
+	// Adding the key back authorizes it again.
+	if err := ts.Server.AddAuthorizedKeys([]string{string(gossh.MarshalAuthorizedKey(ts.Signer.PublicKey()))}, "alice (re-added)"); err != nil {
+		t.Fatal(err)
+	}
+
+	client = ts.dial(t, "runner")
+	defer client.Close()
+
+	if _, err := run(t, client, "true"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRevokedKeyKeepsConnection(t *testing.T) {
+	root := t.TempDir()
+
+	ts := startTestServer(t, SSHServerOpts{
+		Policies: []Policy{{Owners: []string{"alice"}, Restricted: true, AllowedCommands: []string{"true"}}},
+		Sftp:     SftpOpts{Root: root},
+	})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	// Opened before the key is revoked, used after.
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	ts.Server.RemoveAuthorizedKeys("alice")
+
+	if out, err := session.CombinedOutput("echo pwned"); err == nil || strings.Contains(string(out), "pwned") {
+		t.Errorf("expected session of revoked key to be rejected, got %q (%v)", out, err)
+	}
+
+	for _, cmd := range []string{"echo pwned", "scp -t /"} {
+		if session, err := client.NewSession(); err == nil {
+			out, err := session.CombinedOutput(cmd)
+			_ = session.Close()
+			t.Errorf("expected %q to be rejected, got %q (%v)", cmd, out, err)
+		}
+	}
+
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("expected nothing to be written, got %v", entries)
+	}
+}
+
+func TestSessionOwner(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process ancestry is only available in linux")
+	}
+
+	ts := startTestServer(t, SSHServerOpts{})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A child of the session's shell.
+	if err := session.Start("sleep 10 & echo $!; wait"); err != nil {
+		t.Fatal(err)
+	}
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pid, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if owner, ok := ts.Server.SessionOwner(pid); !ok || owner != "alice" {
+		t.Errorf("expected process to belong to alice's session, got %q (%v)", owner, ok)
+	}
+
+	if owner, ok := ts.Server.SessionOwner(os.Getpid()); ok {
+		t.Errorf("expected process not to belong to a session, got %q", owner)
+	}
+}
+
+func TestGrantAccess(t *testing.T) {
+	ts := startTestServer(t, SSHServerOpts{AuthorizedKeys: map[string]string{}})
+	key := string(gossh.MarshalAuthorizedKey(ts.Signer.PublicKey()))
+
+	if _, err := ts.Server.GrantAccess([]string{key}, Grant{Owner: "bob", Expires: time.Now().Add(time.Second), ReadOnly: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := ts.dial(t, "runner")
+	out, err := run(t, client, "true")
+	if err == nil || !strings.Contains(out, "read-only") {
+		t.Errorf("expected read-only key to be refused, got %q (%v)", out, err)
+	}
+	_ = client.Close()
+
+	// The latest grant replaces the previous one, and outlives its expiration.
+	if _, err := ts.Server.GrantAccess([]string{key}, Grant{Owner: "bob", Expires: time.Now().Add(2 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+
+	client = ts.dial(t, "runner")
+	if _, err := run(t, client, "true"); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := make(chan error, 1)
+	go func() { closed <- client.Wait() }()
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Fatal("expected connection to be closed once access expired")
+	}
+
+	if keys := ts.Server.AuthorizedKeys(); len(keys) != 0 {
+		t.Errorf("expected no authorized keys, got %+v", keys)
+	}
+}
+
+func TestRestrictedPolicy(t *testing.T) {
+	ts := startTestServer(t, SSHServerOpts{
+		Policies: []Policy{
+			{Owners: []string{"bob"}},
+			{Owners: []string{"alice"}, Restricted: true, AllowedCommands: []string{"echo hello *"}},
+		},
+	})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	out, err := run(t, client, "echo hello world")
+	if err != nil || out != "hello world\n" {
+		t.Errorf("expected allowed command to run, got %q (%v)", out, err)
+	}
+
+	// Commands don't go through the shell, so they can't be chained.
+	out, err = run(t, client, "echo hello 'world; echo pwned'")
+	if err != nil || out != "hello world; echo pwned\n" {
+		t.Errorf("expected command to run without a shell, got %q (%v)", out, err)
+	}
+
+	// Wildcards only match a single argument.
+	out, err = run(t, client, "echo hello world; echo pwned")
+	if err == nil || !strings.Contains(out, "not allowed") {
+		t.Errorf("expected command with extra arguments to be denied, got %q (%v)", out, err)
+	}
+
+	out, err = run(t, client, "id")
+	if err == nil || !strings.Contains(out, "not allowed") {
+		t.Errorf("expected command to be denied, got %q (%v)", out, err)
+	}
+
+	out, err = run(t, client, "")
+	if err == nil || !strings.Contains(out, "echo hello *") {
+		t.Errorf("expected shell to be denied, got %q (%v)", out, err)
+	}
+
+	if conn, err := client.Dial("tcp", ts.Addr); err == nil {
+		_ = conn.Close()
+		t.Error("expected port forwarding to be denied")
+	}
+
+	if keys := ts.Server.AuthorizedKeys(); len(keys) != 1 || !keys[0].Restricted {
+		t.Errorf("expected key to be restricted, got %+v", keys)
+	}
+}
+
+func TestSessionSettings(t *testing.T) {
+	dir := t.TempDir()
+	ts := startTestServer(t, SSHServerOpts{
+		Env:       []string{"BASE=base"},
+		AcceptEnv: []string{"LC_*"},
+		Overrides: []SessionOverride{
+			{Owners: []string{"bob"}, Dir: "/"},
+			{Owners: []string{"alice"}, Dir: dir, Env: []string{"EXTRA=extra"}},
+		},
+	})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+
+	for k, v := range map[string]string{"LC_TEST": "accepted", "SECRET": "rejected"} {
+		if err := session.Setenv(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, err := session.CombinedOutput(`echo "$(pwd) $BASE $EXTRA $LC_TEST ${SECRET:-unset} $` + OwnerEnv + `"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := fmt.Sprintf("%s base extra accepted unset alice\n", dir); string(out) != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	id, err := LookupIdentity("nobody", "")
+	if err != nil {
+		t.Skip(err)
+	}
+
+	ts := startTestServer(t, SSHServerOpts{Env: []string{"HOME=/root", "USER=root"}, Identity: id})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	out, err := run(t, client, "echo $(id -u) $(id -g) $HOME $USER")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := fmt.Sprintf("%d %d %s %s\n", id.Uid, id.Gid, id.HomeDir, id.Username); out != want {
+		t.Errorf("expected %q, got %q", want, out)
+	}
+}
+
+func TestScopedSftp(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink("/etc", filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := startTestServer(t, SSHServerOpts{Sftp: SftpOpts{Root: root}})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	c, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	f, err := c.Create("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	if contents, err := os.ReadFile(filepath.Join(root, "hello.txt")); err != nil || string(contents) != "hello" {
+		t.Errorf("expected file to be written within the root, got %q (%v)", contents, err)
+	}
+
+	for _, p := range []string{"/etc/passwd", "../../etc/passwd", "/escape/passwd"} {
+		if _, err := c.Stat(p); err == nil {
+			t.Errorf("expected %q to be inaccessible", p)
+		}
+	}
+
+	// Read-only owners may still read files.
+	ts = startTestServer(t, SSHServerOpts{Sftp: SftpOpts{Root: root, ReadOnlyOwners: []string{"alice"}}})
+
+	client = ts.dial(t, "runner")
+	defer client.Close()
+
+	c, err = sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := c.Create("denied.txt"); err == nil {
+		t.Error("expected read-only session to be denied writes")
+	}
+
+	if err := c.Remove("hello.txt"); err == nil {
+		t.Error("expected read-only session to be denied removals")
+	}
+
+	f, err = c.Open("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if contents, err := io.ReadAll(f); err != nil || string(contents) != "hello" {
+		t.Errorf("expected to read the file, got %q (%v)", contents, err)
+	}
+}
+
+func TestSftpDanglingSymlink(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.Symlink(filepath.Join(outside, "created.txt"), filepath.Join(root, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := startTestServer(t, SSHServerOpts{Sftp: SftpOpts{Root: root}})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	c, err := sftp.NewClient(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if f, err := c.Create("/dangling"); err == nil {
+		_, _ = f.Write([]byte("pwned"))
+		_ = f.Close()
+		t.Error("expected creating a file through a dangling symlink to fail")
+	}
+
+	// Also as `scp created.txt host:/dangling`.
+	stdin, stdout := startScp(t, client, "scp -t /dangling")
+	expectScpAck(t, stdout)
+	fmt.Fprintf(stdin, "C0644 5 created.txt\n")
+	if b, err := stdout.ReadByte(); err != nil || b == 0 {
+		fmt.Fprintf(stdin, "pwned\x00")
+	}
+	_ = stdin.Close()
+
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("expected nothing to be written outside of the root, got %v", entries)
+	}
+}
+
+func TestScp(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink("/etc", filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := startTestServer(t, SSHServerOpts{Sftp: SftpOpts{Root: root}})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	// Upload, as `scp up.txt host:/`.
+	stdin, stdout := startScp(t, client, "scp -t /")
+	expectScpAck(t, stdout)
+	fmt.Fprintf(stdin, "C0644 5 up.txt\n")
+	expectScpAck(t, stdout)
+	fmt.Fprintf(stdin, "hello\x00")
+	expectScpAck(t, stdout)
+	_ = stdin.Close()
+
+	if contents, err := os.ReadFile(filepath.Join(root, "up.txt")); err != nil || string(contents) != "hello" {
+		t.Errorf("expected file to be written within the root, got %q (%v)", contents, err)
+	}
+
+	// Download, as `scp host:/up.txt .`.
+	stdin, stdout = startScp(t, client, "scp -f /up.txt")
+	fmt.Fprintf(stdin, "\x00")
+	if header, err := stdout.ReadString('\n'); err != nil || header != "C0644 5 up.txt\n" {
+		t.Fatalf("unexpected header %q (%v)", header, err)
+	}
+	fmt.Fprintf(stdin, "\x00")
+	contents := make([]byte, 6)
+	if _, err := io.ReadFull(stdout, contents); err != nil || string(contents) != "hello\x00" {
+		t.Errorf("expected to read the file, got %q (%v)", contents, err)
+	}
+	_ = stdin.Close()
+
+	for _, p := range []string{"/etc/passwd", "../../etc/passwd", "/escape/passwd"} {
+		stdin, stdout = startScp(t, client, "scp -f "+p)
+		fmt.Fprintf(stdin, "\x00")
+		if b, err := stdout.ReadByte(); err != nil || b == 'C' {
+			t.Errorf("expected %q to be inaccessible", p)
+		}
+		_ = stdin.Close()
+	}
+
+	// Read-only owners may not upload files.
+	ts = startTestServer(t, SSHServerOpts{Sftp: SftpOpts{Root: root, ReadOnlyOwners: []string{"alice"}}})
+
+	client = ts.dial(t, "runner")
+	defer client.Close()
+
+	stdin, stdout = startScp(t, client, "scp -t /")
+	if b, err := stdout.ReadByte(); err != nil || b != 2 {
+		t.Errorf("expected read-only session to be denied uploads, got %v (%v)", b, err)
+	}
+	_ = stdin.Close()
+}
+
+func TestRestrictedScp(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "up.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := startTestServer(t, SSHServerOpts{
+		Policies: []Policy{{Owners: []string{"alice"}, Restricted: true, AllowedCommands: []string{"scp -f *", "scp -t *", "scp * *"}}},
+		Sftp:     SftpOpts{Root: root, ReadOnlyOwners: []string{"alice"}},
+	})
+
+	client := ts.dial(t, "runner")
+	defer client.Close()
+
+	// Served by the built-in scp, within the root.
+	stdin, stdout := startScp(t, client, "scp -f /up.txt")
+	fmt.Fprintf(stdin, "\x00")
+	if header, err := stdout.ReadString('\n'); err != nil || header != "C0644 5 up.txt\n" {
+		t.Errorf("unexpected header %q (%v)", header, err)
+	}
+	_ = stdin.Close()
+
+	stdin, stdout = startScp(t, client, "scp -f /etc/passwd")
+	fmt.Fprintf(stdin, "\x00")
+	if b, err := stdout.ReadByte(); err != nil || b == 'C' {
+		t.Error("expected files outside of the root to be inaccessible")
+	}
+	_ = stdin.Close()
+
+	stdin, stdout = startScp(t, client, "scp -t /")
+	if b, err := stdout.ReadByte(); err != nil || b != 2 {
+		t.Errorf("expected read-only session to be denied uploads, got %v (%v)", b, err)
+	}
+	_ = stdin.Close()
+
+	// The runner's scp is never used, even if allowed.
+	for _, cmd := range []string{"scp /etc/passwd /tmp/copied", "scp -r -f /"} {
+		if out, err := run(t, client, cmd); err == nil || !strings.Contains(out, "not allowed") {
+			t.Errorf("expected %q to be denied, got %q (%v)", cmd, out, err)
+		}
+	}
+
+	if _, err := os.Stat("/tmp/copied"); err == nil {
+		t.Error("expected the runner's scp not to run")
+	}
+}
+
+// startScp starts `cmd` in a new session, which is served by the built-in scp.
+func startScp(t *testing.T, client *gossh.Client, cmd string) (io.WriteCloser, *bufio.Reader) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = session.Close() })
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := session.Start(cmd); err != nil {
+		t.Fatal(err)
+	}
+
+	return stdin, bufio.NewReader(stdout)
+}
+
+func expectScpAck(t *testing.T, r *bufio.Reader) {
+	t.Helper()
+
+	if b, err := r.ReadByte(); err != nil || b != 0 {
+		line, _ := r.ReadString('\n')
+		t.Fatalf("expected ack, got %v %q (%v)", b, line, err)
+	}
+}
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func waitForOutput(t *testing.T, out *syncBuffer, substr string) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !strings.Contains(out.String(), substr) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q, got %q", substr, out.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func startInteractive(t *testing.T, client *gossh.Client) (*gossh.Session, io.Writer, *syncBuffer) {
+	t.Helper()
+	return startInteractiveCommand(t, client, "")
+}
+
+// startInteractiveCommand starts a session with a pty, running `cmd` or a shell if empty.
+func startInteractiveCommand(t *testing.T, client *gossh.Client, cmd string) (*gossh.Session, io.Writer, *syncBuffer) {
+	t.Helper()
+
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := session.RequestPty("xterm", 40, 80, gossh.TerminalModes{}); err != nil {
+		t.Fatal(err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &syncBuffer{}
+	session.Stdout = out
+	session.Stderr = out
+
+	if cmd == "" {
+		err = session.Shell()
+	} else {
+		err = session.Start(cmd)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return session, stdin, out
+}
+
+func TestSharedTerminal(t *testing.T) {
+	ts := startTestServer(t, SSHServerOpts{SharedTerminal: true, Observers: []string{"bob"}})
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bobSigner, err := gossh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.Server.AddAuthorizedKeys([]string{string(gossh.MarshalAuthorizedKey(bobSigner.PublicKey()))}, "bob"); err != nil {
+		t.Fatal(err)
+	}
+
+	bob, err := gossh.Dial("tcp", ts.Addr, &gossh.ClientConfig{
+		User:            "runner",
+		Auth:            []gossh.AuthMethod{gossh.PublicKeys(bobSigner)},
+		HostKeyCallback: gossh.InsecureIgnoreHostKey(),
+		Timeout:         10 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bob.Close()
+
+	// Observers can't start the shared terminal.
+	bobSession, _, bobOut := startInteractive(t, bob)
+	if err := bobSession.Wait(); err == nil {
+		t.Errorf("expected observer session to fail without a shared terminal")
+	}
+	waitForOutput(t, bobOut, "Nobody is sharing a terminal yet")
+
+	alice := ts.dial(t, "runner")
+	defer alice.Close()
+
+	aliceSession, aliceIn, aliceOut := startInteractive(t, alice)
+	fmt.Fprintf(aliceIn, "echo first-$((1+1))\n")
+	waitForOutput(t, aliceOut, "first-2")
+
+	// Output from before attaching is replayed.
+	bobSession, bobIn, bobOut := startInteractive(t, bob)
+	waitForOutput(t, bobOut, "Attached to the terminal shared by alice (read-only)")
+	waitForOutput(t, bobOut, "first-2")
+
+	// Input of observers is ignored.
+	fmt.Fprintf(bobIn, "echo observer-$((1+1))\n")
+	fmt.Fprintf(aliceIn, "echo second-$((1+1))\n")
+	waitForOutput(t, bobOut, "second-2")
+
+	if strings.Contains(aliceOut.String(), "observer") {
+		t.Errorf("observer input reached the terminal: %q", aliceOut.String())
+	}
+
+	fmt.Fprintf(aliceIn, "exit 3\n")
+
+	for _, session := range []*gossh.Session{aliceSession, bobSession} {
+		var exitErr *gossh.ExitError
+		if err := session.Wait(); !errors.As(err, &exitErr) || exitErr.ExitStatus() != 3 {
+			t.Errorf("expected exit status 3, got %v", err)
+		}
+	}
+}
+
+func TestPersistentSessions(t *testing.T) {
+	ts := startTestServer(t, SSHServerOpts{PersistentSessions: true})
+
+	client := ts.dial(t, "runner")
+
+	// Nothing to attach to yet.
+	session, _, out := startInteractiveCommand(t, client, "attach")
+	if err := session.Wait(); err == nil {
+		t.Errorf("expected attach to fail without a detached session")
+	}
+	waitForOutput(t, out, "no detached session")
+
+	_, stdin, out := startInteractive(t, client)
+	fmt.Fprintf(stdin, "X=persisted-$((40+2)); echo started-$((1+1))\n")
+	waitForOutput(t, out, "started-2")
+
+	// Losing the connection detaches the shell, which keeps running.
+	_ = client.Close()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, ok := ts.Server.terminals.detached("alice"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("shell was not detached")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	client = ts.dial(t, "runner")
+	defer client.Close()
+
+	session, stdin, out = startInteractiveCommand(t, client, "attach")
+	waitForOutput(t, out, "Reattached to the session")
+	waitForOutput(t, out, "started-2") // Replayed.
+
+	fmt.Fprintf(stdin, "echo $X\n")
+	waitForOutput(t, out, "persisted-42")
+
+	fmt.Fprintf(stdin, "exit\n")
+	if err := session.Wait(); err != nil {
+		t.Errorf("expected shell to exit cleanly, got %v", err)
+	}
+}
+
+func TestCommandPatternEscapes(t *testing.T) {
+	p := compilePolicies([]Policy{{Restricted: true, AllowedCommands: []string{"cat /var/log/*", "git log *..*"}}})[0]
+
+	for _, tc := range []struct {
+		command string
+		allowed bool
+	}{
+		{"cat /var/log/syslog", true},
+		{"cat '/var/log/with space'", true},
+		{"cat /var/log/x /etc/shadow", false},
+		{"cat /var/log/../../etc/shadow", false},
+		{"cat /var/log/a/../../../etc/shadow", false},
+		{"cat /var/log/..", false},
+		{"cat /etc/shadow", false},
+		{"cat", false},
+		{"git log main..HEAD", true},
+		{"git log ../x..y", false},
+	} {
+		if _, err := p.commandArgs(tc.command); (err == nil) != tc.allowed {
+			t.Errorf("%q: got allowed=%v, want %v", tc.command, err == nil, tc.allowed)
+		}
+	}
+}
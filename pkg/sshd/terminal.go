@@ -0,0 +1,393 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// How much output is replayed to sessions which attach to a terminal.
+	scrollbackSize = 64 * 1024
+	// How many chunks of output may be pending for a session before it's
+	// detached, so that a slow client doesn't hold up everyone else.
+	maxPendingOutput = 256
+
+	sharedTerminalName = "shared"
+)
+
+var errNoTerminal = errors.New("no terminal to attach to")
+
+// ptyFile is a running pty, see startPty.
+type ptyFile interface {
+	io.ReadWriteCloser
+	Resize(width, height int)
+}
+
+// terminal is a shell running in a pty, which several sessions can attach
+// to. Output is broadcast to all of them, while only sessions which are not
+// read-only can write to it.
+type terminal struct {
+	owner   string // Who started the terminal.
+	started time.Time
+	pty     ptyFile
+	cmd     *exec.Cmd
+	done    chan struct{} // Closed when the shell exits.
+
+	mu         sync.Mutex
+	exitCode   int
+	clients    map[*terminalClient]struct{}
+	detachedAt time.Time // When the last client detached.
+	scrollback []byte
+}
+
+type terminalClient struct {
+	owner    string
+	readOnly bool
+	output   chan []byte // Closed when detached, or when the terminal exits.
+}
+
+func startTerminal(cmd *exec.Cmd, ptyReq ssh.Pty, owner string) (*terminal, error) {
+	p, err := startPty(cmd, ptyReq)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &terminal{
+		owner:   owner,
+		started: time.Now(),
+		pty:     p,
+		cmd:     cmd,
+		done:    make(chan struct{}),
+		clients: map[*terminalClient]struct{}{},
+	}
+
+	go t.pump()
+
+	return t, nil
+}
+
+func (t *terminal) pump() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.pty.Read(buf)
+		if n > 0 {
+			t.broadcast(append([]byte(nil), buf[:n]...))
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if err := t.cmd.Wait(); errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+
+	_ = t.pty.Close()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.exitCode = exitCode
+	close(t.done)
+	for c := range t.clients {
+		close(c.output)
+	}
+	t.clients = nil
+}
+
+func (t *terminal) broadcast(data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.scrollback = append(t.scrollback, data...)
+	if len(t.scrollback) > 2*scrollbackSize {
+		t.scrollback = append([]byte(nil), t.scrollback[len(t.scrollback)-scrollbackSize:]...)
+	}
+
+	for c := range t.clients {
+		select {
+		case c.output <- data:
+		default:
+			t.removeClientLocked(c)
+		}
+	}
+}
+
+func (t *terminal) exited() bool {
+	select {
+	case <-t.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// addClient registers a new client, and returns the output it should replay.
+func (t *terminal) addClient(owner string, readOnly bool) (*terminalClient, []byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.clients == nil {
+		return nil, nil, errNoTerminal // Exited.
+	}
+
+	c := &terminalClient{owner: owner, readOnly: readOnly, output: make(chan []byte, maxPendingOutput)}
+	t.clients[c] = struct{}{}
+
+	replay := t.scrollback
+	if len(replay) > scrollbackSize {
+		replay = replay[len(replay)-scrollbackSize:]
+	}
+
+	return c, append([]byte(nil), replay...), nil
+}
+
+func (t *terminal) removeClient(c *terminalClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.removeClientLocked(c)
+}
+
+func (t *terminal) removeClientLocked(c *terminalClient) {
+	if _, ok := t.clients[c]; ok {
+		delete(t.clients, c)
+		close(c.output)
+
+		if len(t.clients) == 0 {
+			t.detachedAt = time.Now()
+		}
+	}
+}
+
+func (t *terminal) numClients() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.clients)
+}
+
+// serve forwards the terminal's output to `session`, and the session's input
+// and window changes to the terminal (unless the client is read-only). Returns
+// once either the session ends, or the terminal exits.
+func (t *terminal) serve(c *terminalClient, replay []byte, session io.ReadWriter, winCh <-chan ssh.Window) (exitCode int, exited bool) {
+	if _, err := session.Write(replay); err != nil {
+		t.removeClient(c)
+		return 0, false
+	}
+
+	inputDone := make(chan struct{})
+	go func() {
+		defer close(inputDone)
+		if c.readOnly {
+			_, _ = io.Copy(io.Discard, session)
+		} else {
+			_, _ = io.Copy(t.pty, session)
+		}
+	}()
+
+	go func() {
+		for win := range winCh {
+			if !c.readOnly {
+				t.pty.Resize(win.Width, win.Height)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case data, ok := <-c.output:
+			if !ok {
+				if t.exited() {
+					t.mu.Lock()
+					defer t.mu.Unlock()
+					return t.exitCode, true
+				}
+
+				return 0, false // Detached because it was too slow.
+			}
+
+			if _, err := session.Write(data); err != nil {
+				t.removeClient(c)
+				return 0, false
+			}
+
+		case <-inputDone:
+			t.removeClient(c)
+			return 0, false
+		}
+	}
+}
+
+// Close terminates the shell.
+func (t *terminal) Close() error {
+	if t.cmd.Process != nil {
+		_ = t.cmd.Process.Kill()
+	}
+	return t.pty.Close()
+}
+
+// terminalRegistry keeps track of the terminals that sessions can attach to.
+type terminalRegistry struct {
+	mu        sync.Mutex
+	terminals map[string]*terminal
+	lastID    int
+}
+
+// detached returns the name of the terminal which `owner` most recently
+// detached from, if any is still running.
+func (r *terminalRegistry) detached(owner string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var name string
+	var latest time.Time
+	for n, t := range r.terminals {
+		if t.exited() {
+			delete(r.terminals, n)
+			continue
+		}
+
+		if t.owner != owner {
+			continue
+		}
+
+		t.mu.Lock()
+		detachedAt, attached := t.detachedAt, len(t.clients)
+		t.mu.Unlock()
+
+		if attached == 0 && !detachedAt.Before(latest) {
+			name, latest = n, detachedAt
+		}
+	}
+
+	return name, name != ""
+}
+
+// newName returns a name for a new terminal of `owner`.
+func (r *terminalRegistry) newName(owner string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lastID++
+	return fmt.Sprintf("%s#%d", owner, r.lastID)
+}
+
+// closeAll terminates all terminals, e.g. when the server shuts down.
+func (r *terminalRegistry) closeAll() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for name, t := range r.terminals {
+		_ = t.Close()
+		delete(r.terminals, name)
+	}
+}
+
+// join attaches a new client to the named terminal. If the terminal is not
+// running, it's started with `start`, unless `start` is nil.
+func (r *terminalRegistry) join(name, owner string, readOnly bool, start func() (*terminal, error)) (*terminal, *terminalClient, []byte, bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if t, ok := r.terminals[name]; ok && !t.exited() {
+		if c, replay, err := t.addClient(owner, readOnly); err == nil {
+			return t, c, replay, false, nil
+		}
+	}
+
+	if start == nil {
+		return nil, nil, nil, false, errNoTerminal
+	}
+
+	t, err := start()
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+
+	c, replay, err := t.addClient(owner, readOnly)
+	if err != nil {
+		return nil, nil, nil, false, err
+	}
+
+	if r.terminals == nil {
+		r.terminals = map[string]*terminal{}
+	}
+	r.terminals[name] = t
+
+	return t, c, replay, true, nil
+}
+
+// leave is called once a client is done with a terminal. Unless `keep` is
+// set, the terminal is closed when its last client leaves.
+func (r *terminalRegistry) leave(name string, t *terminal, keep bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !t.exited() && (keep || t.numClients() > 0) {
+		return
+	}
+
+	if r.terminals[name] == t {
+		delete(r.terminals, name)
+	}
+
+	_ = t.Close()
+}
+
+// serveTerminal attaches the session to the named terminal. Sessions which
+// are not read-only start it (with `start`), if it's not running yet. If
+// `keep` is set, the terminal keeps running after the session detaches.
+func serveTerminal(session ssh.Session, log zerolog.Logger, terminals *terminalRegistry, name string, keep bool, key sshKey, winCh <-chan ssh.Window, start func() (*terminal, error), motd func(io.Writer)) {
+	if key.ReadOnly {
+		start = nil
+	}
+
+	t, c, replay, started, err := terminals.join(name, key.Owner, key.ReadOnly, start)
+	if err != nil {
+		switch {
+		case !errors.Is(err, errNoTerminal):
+			log.Err(err).Msg("pty start failed")
+		case name == sharedTerminalName:
+			fmt.Fprintf(session.Stderr(), "Nobody is sharing a terminal yet, try again once someone has connected.\n")
+		default:
+			fmt.Fprintf(session.Stderr(), "There is no detached session to attach to.\n")
+		}
+		session.Exit(1)
+		return
+	}
+
+	switch {
+	case started:
+		if motd != nil {
+			motd(session)
+		}
+
+	case t.owner == key.Owner && name != sharedTerminalName:
+		fmt.Fprintf(session, "Reattached to the session started at %s.\r\n", t.started.Format(time.Kitchen))
+
+	default:
+		mode := "read-write"
+		if key.ReadOnly {
+			mode = "read-only"
+		}
+		fmt.Fprintf(session, "Attached to the terminal shared by %s (%s).\r\n", t.owner, mode)
+	}
+
+	log.Info().Str("terminal", name).Str("terminal_owner", t.owner).Bool("read_only", key.ReadOnly).Int("attached", t.numClients()).Msg("attached to terminal")
+
+	exitCode, exited := t.serve(c, replay, session, winCh)
+	terminals.leave(name, t, keep)
+
+	log.Info().Str("terminal", name).Str("terminal_owner", t.owner).Bool("exited", exited).Msg("detached from terminal")
+
+	if exited {
+		_ = session.Exit(exitCode)
+	}
+}
@@ -0,0 +1,296 @@
+package waiter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/rs/zerolog"
+	"namespacelabs.dev/breakpoint/pkg/httperrors"
+)
+
+// errUpdateUnsupported is returned by chat providers which can't edit messages.
+var errUpdateUnsupported = errors.New("message updates are not supported")
+
+// chatProvider posts the breakpoint's message to a chat service, and keeps it up to date.
+type chatProvider interface {
+	Name() string
+	Post(context.Context, chatMessage) error
+	Update(context.Context, chatMessage) error
+}
+
+// chatFinisher is implemented by providers which do something other than
+// updating the message when the breakpoint ends, e.g. deleting it.
+type chatFinisher interface {
+	Finish(context.Context, chatMessage, Outcome) error
+}
+
+// chatMessage is a provider-neutral rendition of renderGitHubMessage.
+type chatMessage struct {
+	Title  string
+	Fields []chatField
+	Footer string
+}
+
+type chatField struct {
+	Name  string
+	Value string
+	URL   string // If set, Value links to it.
+	Code  bool   // If set, Value is rendered as code.
+
+	// Rendered in parenthesis after Value, e.g. "(main)".
+	Detail    string
+	DetailURL string
+}
+
+func renderChatMessage(props renderGitHubProps, endpoint string, exp time.Time, maxDurationReached bool) chatMessage {
+	msg := chatMessage{
+		Title: "Workflow failed",
+		Fields: []chatField{
+			{Name: "Repository", Value: "github.com/" + props.Repository, URL: fmt.Sprintf("https://github.com/%s/tree/%s", props.Repository, props.RefName), Detail: props.RefName},
+			{Name: "Workflow", Value: props.Workflow, Detail: "Run #" + props.RunNumber, DetailURL: fmt.Sprintf("https://github.com/%s/actions/runs/%s", props.Repository, props.RunID)},
+		},
+		Footer: fmt.Sprintf("Actor: %s", props.Actor),
+	}
+
+	if props.PushEvent != nil && props.PushEvent.HeadCommit != nil && props.PushEvent.HeadCommit.Message != nil {
+		msg.Fields = append(msg.Fields, chatField{Name: "Commit", Value: *props.PushEvent.HeadCommit.Message, URL: maybeCommitURL(props.Repository, *props.PushEvent)})
+	}
+
+	if endpoint != "" && !exp.IsZero() {
+		host, port, _ := net.SplitHostPort(endpoint)
+
+		msg.Fields = append(msg.Fields,
+			chatField{Name: "SSH", Value: fmt.Sprintf("ssh -p %s runner@%s", port, host), Code: true},
+			chatField{Name: "Expires", Value: fmt.Sprintf("%s (%s)", humanize.Time(exp), exp.Format(Stamp))},
+		)
+
+		if maxDurationReached {
+			msg.Fields = append(msg.Fields, chatField{Name: "Note", Value: "maximum duration reached, this breakpoint can't be extended further."})
+		}
+	}
+
+	return msg
+}
+
+// markdown renders the message as a single block of markdown.
+func (msg chatMessage) markdown() string {
+	var lines []string
+	lines = append(lines, "#### "+msg.Title)
+	for _, f := range msg.Fields {
+		lines = append(lines, fmt.Sprintf("**%s:** %s", f.Name, f.markdown()))
+	}
+	lines = append(lines, "", "_"+msg.Footer+"_")
+	return strings.Join(lines, "\n")
+}
+
+// markdown renders a field with common markdown, as understood by Discord,
+// Mattermost and Teams.
+func (f chatField) markdown() string {
+	value := markdownLink(f.Value, f.URL)
+	if f.Code {
+		value = "`" + f.Value + "`"
+	}
+
+	if f.Detail != "" {
+		value += fmt.Sprintf(" (%s)", markdownLink(f.Detail, f.DetailURL))
+	}
+
+	return value
+}
+
+func markdownLink(text, url string) string {
+	if url == "" {
+		return text
+	}
+
+	return fmt.Sprintf("[%s](%s)", text, url)
+}
+
+type chatNotifier struct {
+	provider chatProvider
+	m        *Manager
+	logger   zerolog.Logger
+	props    renderGitHubProps
+
+	mu          sync.Mutex
+	closed      bool
+	unsupported bool // The provider can't update messages.
+	updated     chan struct{}
+	stop        chan struct{}
+	loopDone    chan struct{}
+}
+
+func startChatNotifier(ctx context.Context, m *Manager, provider chatProvider) *chatNotifier {
+	n := &chatNotifier{
+		provider: provider,
+		m:        m,
+		logger:   zerolog.Ctx(ctx).With().Str("notifier", provider.Name()).Logger(),
+		props:    prepareGitHubProps(ctx),
+		updated:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		loopDone: make(chan struct{}),
+	}
+
+	if err := provider.Post(ctx, n.render(false)); err != nil {
+		n.logger.Err(err).Msg("Failed to post message")
+		return nil
+	}
+
+	go n.loop(ctx)
+	m.Subscribe(n.onEvent)
+
+	return n
+}
+
+func (n *chatNotifier) render(leaving bool) chatMessage {
+	if leaving {
+		return renderChatMessage(n.props, "", time.Time{}, false)
+	}
+
+	msg := renderChatMessage(n.props, n.m.Endpoint(), n.m.Expiration(), n.m.MaxDurationReached())
+	if grants := n.m.Grants(); len(grants) > 0 {
+		var guests []string
+		for _, g := range grants {
+			guests = append(guests, g.String())
+		}
+		msg.Fields = append(msg.Fields, chatField{Name: "Guests", Value: strings.Join(guests, ", ")})
+	}
+
+	return msg
+}
+
+func (n *chatNotifier) onEvent(ev Event) {
+	if ev.Type != EventExtended && ev.Type != EventAccessGranted {
+		return
+	}
+
+	select {
+	case n.updated <- struct{}{}:
+	default:
+	}
+}
+
+func (n *chatNotifier) loop(ctx context.Context) {
+	defer close(n.loopDone)
+
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-n.stop:
+			return
+
+		case <-t.C:
+		case <-n.updated:
+		}
+
+		if !n.update(ctx, false) {
+			return
+		}
+	}
+}
+
+// update returns false if no further updates should be attempted.
+func (n *chatNotifier) update(ctx context.Context, leaving bool) bool {
+	n.mu.Lock()
+	skip := n.unsupported || (n.closed && !leaving)
+	n.mu.Unlock()
+
+	if skip {
+		return false
+	}
+
+	ctx, done := context.WithTimeout(ctx, 10*time.Second)
+	defer done()
+
+	err := n.provider.Update(ctx, n.render(leaving))
+	switch {
+	case errors.Is(err, errUpdateUnsupported):
+		n.mu.Lock()
+		n.unsupported = true
+		n.mu.Unlock()
+		return false
+
+	case err != nil:
+		n.logger.Warn().Err(err).Msg("Failed to update message")
+	}
+
+	return true
+}
+
+func (n *chatNotifier) Close() error {
+	n.mu.Lock()
+	n.closed = true
+	n.mu.Unlock()
+
+	close(n.stop)
+	<-n.loopDone
+
+	// Not using the manager's context, as the final update happens while shutting down.
+	if f, ok := n.provider.(chatFinisher); ok {
+		ctx, done := context.WithTimeout(context.Background(), 10*time.Second)
+		defer done()
+
+		if err := f.Finish(ctx, n.render(true), n.m.Outcome()); err != nil {
+			n.logger.Warn().Err(err).Msg("Failed to finish message")
+		}
+
+		return nil
+	}
+
+	n.update(context.Background(), true)
+	return nil
+}
+
+// doJSON sends `body` as JSON, and decodes the response into `out` if set.
+func doJSON(ctx context.Context, method, url string, headers map[string]string, body, out any) error {
+	serialized, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	// Errors don't include the URL, which is the credential of Discord, Teams
+	// and Mattermost webhooks.
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(serialized))
+	if err != nil {
+		return httperrors.WithoutURL(err)
+	}
+
+	req.Header.Set("User-Agent", "Breakpoint/1.0")
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return httperrors.WithoutURL(err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return httperrors.MaybeError(resp)
+	}
+
+	if out == nil {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,88 @@
+package waiter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+	"namespacelabs.dev/breakpoint/pkg/httperrors"
+)
+
+const discordColorRed = 0xd73a49
+
+// discordNotifier posts an embed through a Discord webhook, and edits it as
+// the breakpoint changes.
+type discordNotifier struct {
+	webhookURL string
+	messageID  string
+}
+
+func newDiscordNotifier(conf v1.Discord) *discordNotifier {
+	return &discordNotifier{webhookURL: os.ExpandEnv(conf.WebhookURL)}
+}
+
+func (d *discordNotifier) Name() string { return "discord" }
+
+func (d *discordNotifier) Post(ctx context.Context, msg chatMessage) error {
+	u, err := url.Parse(d.webhookURL)
+	if err != nil {
+		return httperrors.WithoutURL(err)
+	}
+
+	// Have Discord return the message, so that it can be edited later.
+	q := u.Query()
+	q.Set("wait", "true")
+	u.RawQuery = q.Encode()
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+
+	if err := doJSON(ctx, http.MethodPost, u.String(), nil, discordPayload(msg), &resp); err != nil {
+		return err
+	}
+
+	d.messageID = resp.ID
+	return nil
+}
+
+func (d *discordNotifier) Update(ctx context.Context, msg chatMessage) error {
+	if d.messageID == "" {
+		return errUpdateUnsupported
+	}
+
+	u, err := url.Parse(d.webhookURL)
+	if err != nil {
+		return httperrors.WithoutURL(err)
+	}
+
+	// Preserves query parameters, such as thread_id.
+	u.Path += fmt.Sprintf("/messages/%s", d.messageID)
+	q := u.Query()
+	q.Del("wait")
+	u.RawQuery = q.Encode()
+
+	return doJSON(ctx, http.MethodPatch, u.String(), nil, discordPayload(msg), nil)
+}
+
+func discordPayload(msg chatMessage) map[string]any {
+	var fields []map[string]any
+	for _, f := range msg.Fields {
+		fields = append(fields, map[string]any{
+			"name":  f.Name,
+			"value": f.markdown(),
+		})
+	}
+
+	return map[string]any{
+		"embeds": []map[string]any{{
+			"title":  msg.Title,
+			"color":  discordColorRed,
+			"fields": fields,
+			"footer": map[string]any{"text": msg.Footer},
+		}},
+	}
+}
@@ -0,0 +1,252 @@
+package waiter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+)
+
+const defaultSMTPPort = 587
+
+// emailNotifier sends an email when the endpoint is allocated and,
+// optionally, a summary when the breakpoint ends.
+type emailNotifier struct {
+	m      *Manager
+	conf   v1.Email
+	logger zerolog.Logger
+
+	sent chan struct{} // Closed once the initial email was sent (or failed).
+
+	mu        sync.Mutex
+	connected []string // Who connected, in order.
+	guests    []string // Who was granted temporary access.
+	reason    string   // Why the breakpoint was automatically resumed, if it was.
+}
+
+func startEmailNotifier(ctx context.Context, m *Manager, conf v1.Email) *emailNotifier {
+	n := &emailNotifier{
+		m:      m,
+		conf:   conf,
+		logger: zerolog.Ctx(ctx).With().Str("notifier", "email").Logger(),
+		sent:   make(chan struct{}),
+	}
+
+	if conf.SendSummary {
+		m.Subscribe(n.onEvent)
+	}
+
+	// Don't hold up the allocation on a slow mail server.
+	go func() {
+		defer close(n.sent)
+
+		if err := sendMail(conf, n.subject("Breakpoint available"), n.allocatedBody()); err != nil {
+			n.logger.Err(err).Msg("Failed to send email")
+		}
+	}()
+
+	return n
+}
+
+func (n *emailNotifier) onEvent(ev Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	switch ev.Type {
+	case EventConnectionOpened:
+		if !slices.Contains(n.connected, ev.Owner) {
+			n.connected = append(n.connected, ev.Owner)
+		}
+
+	case EventAccessGranted:
+		n.guests = append(n.guests, ev.Grant.String())
+
+	case EventExpired:
+		n.reason = ev.Reason
+	}
+}
+
+func (n *emailNotifier) Close() error {
+	<-n.sent
+
+	if !n.conf.SendSummary {
+		return nil
+	}
+
+	if err := sendMail(n.conf, n.subject("Breakpoint ended"), n.summaryBody()); err != nil {
+		n.logger.Err(err).Msg("Failed to send summary email")
+	}
+
+	return nil
+}
+
+func (n *emailNotifier) subject(prefix string) string {
+	subject := prefix
+	if ci := n.m.ci; ci.Repository != "" {
+		subject += ": " + ci.Repository
+		if ci.Workflow != "" {
+			subject += fmt.Sprintf(" (%s)", ci.Workflow)
+		}
+	}
+
+	return subject
+}
+
+func (n *emailNotifier) allocatedBody() string {
+	tctx := n.m.TemplateContext()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "A breakpoint is waiting for you to connect:\n\n")
+	fmt.Fprintf(&b, "    ssh -p %s runner@%s\n\n", tctx.Port, tctx.Host)
+	fmt.Fprintf(&b, "It expires at %s.\n", tctx.Expiration.Format(Stamp))
+	writeCIDetails(&b, tctx.CI)
+	return b.String()
+}
+
+func (n *emailNotifier) summaryBody() string {
+	outcome := n.m.Outcome()
+
+	n.mu.Lock()
+	connected := slices.Clone(n.connected)
+	guests := slices.Clone(n.guests)
+	reason := n.reason
+	n.mu.Unlock()
+
+	var b strings.Builder
+	switch {
+	case outcome.Expired && reason != "":
+		fmt.Fprintf(&b, "The breakpoint was resumed automatically, %s.\n", reason)
+	case outcome.Expired:
+		fmt.Fprintf(&b, "The breakpoint expired.\n")
+	case outcome.Rerun:
+		fmt.Fprintf(&b, "The breakpoint was resumed, to run the command again.\n")
+	case outcome.ExitCode != nil:
+		fmt.Fprintf(&b, "The breakpoint was resumed, with exit code %d.\n", *outcome.ExitCode)
+	default:
+		fmt.Fprintf(&b, "The breakpoint was resumed.\n")
+	}
+
+	fmt.Fprintf(&b, "It was held for %s.\n", time.Since(n.m.started).Round(time.Second))
+
+	if len(connected) == 0 {
+		fmt.Fprintf(&b, "Nobody connected.\n")
+	} else {
+		fmt.Fprintf(&b, "Connected: %s.\n", strings.Join(connected, ", "))
+	}
+
+	if len(guests) > 0 {
+		fmt.Fprintf(&b, "Invited: %s.\n", strings.Join(guests, ", "))
+	}
+
+	writeCIDetails(&b, n.m.ci)
+	return b.String()
+}
+
+func writeCIDetails(b *strings.Builder, ci CIMetadata) {
+	if ci.RunURL != "" {
+		fmt.Fprintf(b, "\nWorkflow run: %s\n", ci.RunURL)
+	}
+
+	if ci.Actor != "" {
+		fmt.Fprintf(b, "Actor: %s\n", ci.Actor)
+	}
+}
+
+func sendMail(conf v1.Email, subject, body string) error {
+	host := os.ExpandEnv(conf.Host)
+	port := conf.Port
+	if port == 0 {
+		port = defaultSMTPPort
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// Bound the whole exchange.
+	_ = conn.SetDeadline(time.Now().Add(time.Minute))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	defer c.Close()
+
+	if conf.StartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return fmt.Errorf("starttls: %w", err)
+		}
+	}
+
+	if username := os.ExpandEnv(conf.Username); username != "" {
+		if err := c.Auth(smtp.PlainAuth("", username, os.ExpandEnv(conf.Password), host)); err != nil {
+			return fmt.Errorf("auth: %w", err)
+		}
+	}
+
+	from := os.ExpandEnv(conf.From)
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+
+	for _, to := range conf.To {
+		if err := c.Rcpt(os.ExpandEnv(to)); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(formatMessage(from, conf.To, subject, body)); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+func formatMessage(from string, to []string, subject, body string) []byte {
+	var recipients []string
+	for _, r := range to {
+		recipients = append(recipients, os.ExpandEnv(r))
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(recipients, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", encodeHeader(subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return b.Bytes()
+}
+
+// encodeHeader removes line breaks, which would start a new header, and encodes
+// non-ASCII text as per RFC 2047.
+func encodeHeader(value string) string {
+	value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	return mime.QEncoding.Encode("utf-8", value)
+}
@@ -0,0 +1,188 @@
+package waiter
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+)
+
+type receivedMail struct {
+	From string
+	To   []string
+	Data string
+}
+
+// startSMTPServer serves a minimal SMTP server, which accepts every message.
+func startSMTPServer(t *testing.T) (string, int, chan receivedMail) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { lis.Close() })
+
+	received := make(chan receivedMail, 10)
+
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+
+			go serveSMTP(conn, received)
+		}
+	}()
+
+	addr := lis.Addr().(*net.TCPAddr)
+	return addr.IP.String(), addr.Port, received
+}
+
+func serveSMTP(conn net.Conn, received chan receivedMail) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(line string) { _, _ = conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost ESMTP")
+
+	var mail receivedMail
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		cmd := strings.TrimRight(line, "\r\n")
+		switch verb := strings.ToUpper(strings.SplitN(cmd, " ", 2)[0]); verb {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+
+		case "MAIL":
+			mail = receivedMail{From: strings.Trim(strings.TrimPrefix(cmd[4:], " FROM:"), "<>")}
+			reply("250 OK")
+
+		case "RCPT":
+			mail.To = append(mail.To, strings.Trim(strings.TrimPrefix(cmd[4:], " TO:"), "<>"))
+			reply("250 OK")
+
+		case "DATA":
+			reply("354 Go ahead")
+
+			var data strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				data.WriteString(line)
+			}
+
+			mail.Data = data.String()
+			received <- mail
+			reply("250 OK")
+
+		case "QUIT":
+			reply("221 Bye")
+			return
+
+		default:
+			reply("502 Not implemented")
+		}
+	}
+}
+
+func TestEmailNotifier(t *testing.T) {
+	host, port, received := startSMTPServer(t)
+
+	t.Setenv("GITHUB_ACTIONS", "true")
+	t.Setenv("GITHUB_STEP_SUMMARY", "")
+	t.Setenv("GITHUB_OUTPUT", "")
+	t.Setenv("GITHUB_SERVER_URL", "https://github.com")
+	t.Setenv("GITHUB_REPOSITORY", "org/repo")
+	t.Setenv("GITHUB_RUN_ID", "1234")
+	t.Setenv("EMAIL_RECIPIENT", "oncall@example.com")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, mctx := NewManager(ctx, ManagerOpts{
+		InitialDur: time.Hour,
+		Email: []v1.Email{{
+			Host:        host,
+			Port:        port,
+			From:        "breakpoint@example.com",
+			To:          []string{"${EMAIL_RECIPIENT}"},
+			SendSummary: true,
+		}},
+	})
+	m.SetConnectionCountCallback(func() uint32 { return 0 })
+	m.SetEndpoint("127.0.0.1:1234")
+
+	allocated := waitForMail(t, received)
+	if allocated.From != "breakpoint@example.com" || len(allocated.To) != 1 || allocated.To[0] != "oncall@example.com" {
+		t.Errorf("unexpected envelope: %+v", allocated)
+	}
+
+	for _, want := range []string{
+		"Subject: Breakpoint available: org/repo",
+		"ssh -p 1234 runner@127.0.0.1",
+		"Workflow run: https://github.com/org/repo/actions/runs/1234",
+	} {
+		if !strings.Contains(allocated.Data, want) {
+			t.Errorf("expected %q in:\n%s", want, allocated.Data)
+		}
+	}
+
+	m.ConnectionOpened("alice", "10.0.0.1:5678")
+
+	code := 2
+	m.StopWait(ResumeOpts{ExitCode: &code})
+	<-mctx.Done()
+
+	summary := waitForMail(t, received)
+	for _, want := range []string{
+		"Subject: Breakpoint ended: org/repo",
+		"resumed, with exit code " + strconv.Itoa(code),
+		"Connected: alice.",
+	} {
+		if !strings.Contains(summary.Data, want) {
+			t.Errorf("expected %q in:\n%s", want, summary.Data)
+		}
+	}
+}
+
+func TestEmailSubjectIsEncoded(t *testing.T) {
+	msg := string(formatMessage("breakpoint@example.com", []string{"oncall@example.com"},
+		"Breakpoint available: org/repo (deploy\r\nBcc: attacker@example.com)", "body"))
+
+	if strings.Contains(msg, "\r\nBcc:") {
+		t.Errorf("subject injected a header:\n%s", msg)
+	}
+
+	msg = string(formatMessage("breakpoint@example.com", []string{"oncall@example.com"}, "Breakpoint available: café", "body"))
+	if !strings.Contains(msg, "Subject: =?utf-8?q?Breakpoint_available:_caf=C3=A9?=\r\n") {
+		t.Errorf("expected an encoded subject in:\n%s", msg)
+	}
+}
+
+func waitForMail(t *testing.T, received chan receivedMail) receivedMail {
+	t.Helper()
+
+	select {
+	case mail := <-received:
+		return mail
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email received")
+		return receivedMail{}
+	}
+}
@@ -0,0 +1,133 @@
+package waiter
+
+import (
+	"fmt"
+	"time"
+)
+
+type EventType string
+
+const (
+	EventAllocated        EventType = "allocated"
+	EventConnectionOpened EventType = "connection_opened"
+	EventConnectionClosed EventType = "connection_closed"
+	EventExtended         EventType = "extended"
+	EventExpiringSoon     EventType = "expiring_soon"
+	EventResumed          EventType = "resumed"
+	EventExpired          EventType = "expired"
+	EventAccessGranted    EventType = "access_granted"
+
+	// How long before expiration EventExpiringSoon is emitted.
+	expiringSoonWarning = 5 * time.Minute
+)
+
+// Event describes a change in the lifecycle of a breakpoint.
+type Event struct {
+	Type       EventType
+	Time       time.Time
+	Endpoint   string
+	Expiration time.Time
+
+	MaxDurationReached bool
+
+	// Set on connection events.
+	Owner      string
+	RemoteAddr string
+
+	// Set on EventExtended.
+	Extension *ExtendResult
+
+	// Set on EventResumed.
+	Resume *ResumeOpts
+
+	// Set on EventExpired, when the breakpoint was automatically resumed.
+	Reason string
+
+	// Set on EventAccessGranted; Owner is who was granted access.
+	Grant *AccessGrant
+}
+
+// AccessGrant describes temporary access granted to a running breakpoint,
+// e.g. with `breakpoint invite`.
+type AccessGrant struct {
+	Owner     string
+	GrantedBy string
+	Expires   time.Time
+	ReadOnly  bool
+}
+
+// Subscribe registers a function that is called for each lifecycle event.
+// Events are delivered one at a time, in the order in which they happened,
+// even when emitted concurrently; `f` must not block.
+func (m *Manager) Subscribe(f func(Event)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribers = append(m.subscribers, f)
+}
+
+func (m *Manager) emit(ev Event) {
+	m.emitMu.Lock()
+	defer m.emitMu.Unlock()
+
+	m.mu.Lock()
+	subscribers := m.subscribers
+	ev.Time = time.Now()
+	ev.Endpoint = m.endpoint
+	ev.Expiration = m.expiration
+	ev.MaxDurationReached = m.maxDurationReached
+	m.mu.Unlock()
+
+	for _, f := range subscribers {
+		f(ev)
+	}
+}
+
+// ConnectionOpened is called when an authenticated connection is established.
+func (m *Manager) ConnectionOpened(owner, remoteAddr string) {
+	m.logger.Info().Str("owner", owner).Str("remote_addr", remoteAddr).Msg("Connection opened")
+	m.emit(Event{Type: EventConnectionOpened, Owner: owner, RemoteAddr: remoteAddr})
+}
+
+// ConnectionClosed is called when an authenticated connection is closed.
+func (m *Manager) ConnectionClosed(owner, remoteAddr string) {
+	m.logger.Info().Str("owner", owner).Str("remote_addr", remoteAddr).Msg("Connection closed")
+	m.emit(Event{Type: EventConnectionClosed, Owner: owner, RemoteAddr: remoteAddr})
+}
+
+// AccessGranted is called when somebody is granted temporary access.
+func (m *Manager) AccessGranted(grant AccessGrant) {
+	m.logger.Info().Str("owner", grant.Owner).Str("granted_by", grant.GrantedBy).
+		Time("expires", grant.Expires).Bool("read_only", grant.ReadOnly).Msg("Access granted")
+
+	m.mu.Lock()
+	m.grants = append(m.grants, grant)
+	m.mu.Unlock()
+
+	m.emit(Event{Type: EventAccessGranted, Owner: grant.Owner, Grant: &grant})
+}
+
+// Grants returns the temporary access grants which haven't expired.
+func (m *Manager) Grants() []AccessGrant {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var grants []AccessGrant
+	now := time.Now()
+	for _, g := range m.grants {
+		if g.Expires.After(now) {
+			grants = append(grants, g)
+		}
+	}
+	return grants
+}
+
+func (g AccessGrant) String() string {
+	str := fmt.Sprintf("%s (until %s", g.Owner, g.Expires.Format(time.Kitchen))
+	if g.ReadOnly {
+		str += ", read-only"
+	}
+	if g.GrantedBy != "" {
+		str += ", invited by " + g.GrantedBy
+	}
+	return str + ")"
+}
@@ -0,0 +1,300 @@
+package waiter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v52/github"
+	"github.com/rs/zerolog"
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+)
+
+const checkRunName = "breakpoint"
+
+// writeGitHubStepInfo makes the connection details visible in the workflow
+// run's summary, and available to subsequent steps as outputs.
+func writeGitHubStepInfo(tctx TemplateContext) error {
+	if path := os.Getenv("GITHUB_STEP_SUMMARY"); path != "" {
+		var b strings.Builder
+		fmt.Fprintf(&b, "### Breakpoint\n\n")
+		fmt.Fprintf(&b, "```\nssh -p %s runner@%s\n```\n\n", tctx.Port, tctx.Host)
+		fmt.Fprintf(&b, "Expires at %s.\n\n", tctx.Expiration.Format(Stamp))
+
+		if err := appendToFile(path, b.String()); err != nil {
+			return fmt.Errorf("failed to write step summary: %w", err)
+		}
+	}
+
+	if path := os.Getenv("GITHUB_OUTPUT"); path != "" {
+		var b strings.Builder
+		fmt.Fprintf(&b, "endpoint=%s\n", tctx.Endpoint)
+		fmt.Fprintf(&b, "host=%s\n", tctx.Host)
+		fmt.Fprintf(&b, "port=%s\n", tctx.Port)
+		fmt.Fprintf(&b, "expires=%s\n", tctx.Expiration.UTC().Format("2006-01-02T15:04:05Z07:00"))
+
+		if err := appendToFile(path, b.String()); err != nil {
+			return fmt.Errorf("failed to write step outputs: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func appendToFile(path, contents string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(contents); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func newGitHubClient(ctx context.Context, conf v1.GitHub) (*github.Client, error) {
+	token := os.ExpandEnv(conf.Token)
+	if token == "" {
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+
+	if token == "" {
+		return nil, fmt.Errorf("github: no token available, set GITHUB_TOKEN")
+	}
+
+	client := github.NewTokenClient(ctx, token)
+
+	// Support GitHub Enterprise Server.
+	if apiURL := os.Getenv("GITHUB_API_URL"); apiURL != "" {
+		base, err := url.Parse(strings.TrimSuffix(apiURL, "/") + "/")
+		if err != nil {
+			return nil, fmt.Errorf("github: invalid GITHUB_API_URL: %w", err)
+		}
+		client.BaseURL = base
+	}
+
+	return client, nil
+}
+
+// CancelJob cancels the GitHub Actions workflow run that the breakpoint
+// belongs to. GitHub cancels the run asynchronously, so it may take a few
+// seconds before the job stops.
+func CancelJob(ctx context.Context, conf *v1.GitHub) error {
+	ci := ciMetadataFromEnv()
+	if ci.Provider != "github" {
+		return errors.New("canceling the job is only supported in GitHub Actions")
+	}
+
+	owner, repo, ok := splitRepository(ci.Repository)
+	if !ok {
+		return fmt.Errorf("github: invalid GITHUB_REPOSITORY %q", ci.Repository)
+	}
+
+	runID, err := strconv.ParseInt(ci.RunID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("github: invalid GITHUB_RUN_ID %q", ci.RunID)
+	}
+
+	var c v1.GitHub
+	if conf != nil {
+		c = *conf
+	}
+
+	client, err := newGitHubClient(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := client.Actions.CancelWorkflowRunByID(ctx, owner, repo, runID); err != nil {
+		// The cancelation was accepted, and is carried out asynchronously.
+		var accepted *github.AcceptedError
+		if errors.As(err, &accepted) {
+			return nil
+		}
+
+		return fmt.Errorf("github: failed to cancel workflow run: %w", err)
+	}
+
+	return nil
+}
+
+func splitRepository(repository string) (string, string, bool) {
+	owner, repo, ok := strings.Cut(repository, "/")
+	return owner, repo, ok && owner != "" && repo != ""
+}
+
+// githubCommentNotifier posts the breakpoint's message as a pull request comment.
+type githubCommentNotifier struct {
+	client      *github.Client
+	owner, repo string
+	number      int
+	deleteOnEnd bool
+
+	commentID int64
+}
+
+func (g *githubCommentNotifier) Name() string { return "github/pr_comment" }
+
+func (g *githubCommentNotifier) Post(ctx context.Context, msg chatMessage) error {
+	comment, _, err := g.client.Issues.CreateComment(ctx, g.owner, g.repo, g.number, &github.IssueComment{
+		Body: github.String(msg.markdown()),
+	})
+	if err != nil {
+		return err
+	}
+
+	g.commentID = comment.GetID()
+	return nil
+}
+
+func (g *githubCommentNotifier) Update(ctx context.Context, msg chatMessage) error {
+	_, _, err := g.client.Issues.EditComment(ctx, g.owner, g.repo, g.commentID, &github.IssueComment{
+		Body: github.String(msg.markdown()),
+	})
+	return err
+}
+
+func (g *githubCommentNotifier) Finish(ctx context.Context, msg chatMessage, outcome Outcome) error {
+	if g.deleteOnEnd {
+		_, err := g.client.Issues.DeleteComment(ctx, g.owner, g.repo, g.commentID)
+		return err
+	}
+
+	msg.Fields = append(msg.Fields, chatField{Name: "Status", Value: describeOutcome(outcome)})
+	return g.Update(ctx, msg)
+}
+
+// githubCheckRunNotifier reports the breakpoint as an in-progress check run,
+// which is completed when the breakpoint ends.
+type githubCheckRunNotifier struct {
+	client      *github.Client
+	owner, repo string
+	sha         string
+	detailsURL  string
+
+	checkRunID int64
+}
+
+func (g *githubCheckRunNotifier) Name() string { return "github/check_run" }
+
+func (g *githubCheckRunNotifier) Post(ctx context.Context, msg chatMessage) error {
+	opts := github.CreateCheckRunOptions{
+		Name:    checkRunName,
+		HeadSHA: g.sha,
+		Status:  github.String("in_progress"),
+		Output: &github.CheckRunOutput{
+			Title:   github.String("Breakpoint available"),
+			Summary: github.String(msg.markdown()),
+		},
+	}
+
+	if g.detailsURL != "" {
+		opts.DetailsURL = github.String(g.detailsURL)
+	}
+
+	run, _, err := g.client.Checks.CreateCheckRun(ctx, g.owner, g.repo, opts)
+	if err != nil {
+		return err
+	}
+
+	g.checkRunID = run.GetID()
+	return nil
+}
+
+func (g *githubCheckRunNotifier) Update(ctx context.Context, msg chatMessage) error {
+	_, _, err := g.client.Checks.UpdateCheckRun(ctx, g.owner, g.repo, g.checkRunID, github.UpdateCheckRunOptions{
+		Name: checkRunName,
+		Output: &github.CheckRunOutput{
+			Title:   github.String("Breakpoint available"),
+			Summary: github.String(msg.markdown()),
+		},
+	})
+	return err
+}
+
+func (g *githubCheckRunNotifier) Finish(ctx context.Context, msg chatMessage, outcome Outcome) error {
+	conclusion := "neutral"
+	if outcome.ExitCode != nil && *outcome.ExitCode != 0 {
+		conclusion = "failure"
+	}
+
+	_, _, err := g.client.Checks.UpdateCheckRun(ctx, g.owner, g.repo, g.checkRunID, github.UpdateCheckRunOptions{
+		Name:       checkRunName,
+		Status:     github.String("completed"),
+		Conclusion: github.String(conclusion),
+		Output: &github.CheckRunOutput{
+			Title:   github.String(describeOutcome(outcome)),
+			Summary: github.String(msg.markdown()),
+		},
+	})
+	return err
+}
+
+// githubProviders returns the chat providers which were enabled in `conf`.
+func githubProviders(ctx context.Context, props renderGitHubProps, ci CIMetadata, conf v1.GitHub) ([]chatProvider, error) {
+	if !conf.PRComment && !conf.CheckRun {
+		return nil, nil
+	}
+
+	owner, repo, ok := splitRepository(props.Repository)
+	if !ok {
+		return nil, fmt.Errorf("github: unable to determine the repository, is GITHUB_REPOSITORY set?")
+	}
+
+	client, err := newGitHubClient(ctx, conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var providers []chatProvider
+	if conf.PRComment && props.PullNumber == 0 {
+		// Don't let pr_comment disable the check run as well.
+		zerolog.Ctx(ctx).Warn().Msg("github: pr_comment requires a pull_request event, skipping it")
+	} else if conf.PRComment {
+		providers = append(providers, &githubCommentNotifier{
+			client:      client,
+			owner:       owner,
+			repo:        repo,
+			number:      props.PullNumber,
+			deleteOnEnd: conf.DeleteCommentOnEnd,
+		})
+	}
+
+	if conf.CheckRun {
+		if props.SHA == "" {
+			return nil, fmt.Errorf("github: check_run requires GITHUB_SHA")
+		}
+
+		providers = append(providers, &githubCheckRunNotifier{
+			client:     client,
+			owner:      owner,
+			repo:       repo,
+			sha:        props.SHA,
+			detailsURL: ci.RunURL,
+		})
+	}
+
+	return providers, nil
+}
+
+func describeOutcome(outcome Outcome) string {
+	switch {
+	case outcome.Expired:
+		return "Breakpoint expired"
+	case outcome.Rerun:
+		return "Breakpoint resumed, running the command again"
+	case outcome.CancelJob:
+		return "Breakpoint resumed, canceling the job"
+	case outcome.ExitCode != nil && *outcome.ExitCode != 0:
+		return fmt.Sprintf("Breakpoint resumed, failing with exit code %d", *outcome.ExitCode)
+	}
+
+	return "Breakpoint resumed"
+}
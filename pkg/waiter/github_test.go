@@ -0,0 +1,150 @@
+package waiter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+)
+
+func TestGitHubIntegration(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer ghtoken" {
+			t.Errorf("missing token")
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			w.WriteHeader(http.StatusCreated)
+			_ = json.NewEncoder(w).Encode(map[string]any{"id": 99})
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			_ = json.NewEncoder(w).Encode(map[string]any{"id": 99})
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	eventPath := filepath.Join(dir, "event.json")
+	if err := os.WriteFile(eventPath, []byte(`{"number": 7, "pull_request": {"head": {"sha": "abc123"}}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("GITHUB_ACTIONS", "true")
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_TOKEN", "ghtoken")
+	t.Setenv("GITHUB_REPOSITORY", "org/repo")
+	t.Setenv("GITHUB_EVENT_NAME", "pull_request")
+	t.Setenv("GITHUB_EVENT_PATH", eventPath)
+	t.Setenv("GITHUB_STEP_SUMMARY", filepath.Join(dir, "summary.md"))
+	t.Setenv("GITHUB_OUTPUT", filepath.Join(dir, "output"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, mctx := NewManager(ctx, ManagerOpts{
+		InitialDur: time.Hour,
+		GitHub: &v1.GitHub{
+			PRComment:          true,
+			CheckRun:           true,
+			DeleteCommentOnEnd: true,
+		},
+	})
+	m.SetConnectionCountCallback(func() uint32 { return 0 })
+	m.SetEndpoint("127.0.0.1:1234")
+	m.StopWait(ResumeOpts{})
+	<-mctx.Done()
+
+	summary, _ := os.ReadFile(filepath.Join(dir, "summary.md"))
+	if !strings.Contains(string(summary), "ssh -p 1234 runner@127.0.0.1") {
+		t.Errorf("unexpected step summary:\n%s", summary)
+	}
+
+	output, _ := os.ReadFile(filepath.Join(dir, "output"))
+	for _, want := range []string{"endpoint=127.0.0.1:1234\n", "host=127.0.0.1\n", "port=1234\n", "expires="} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("expected %q in outputs:\n%s", want, output)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{
+		"POST /repos/org/repo/issues/7/comments",
+		"POST /repos/org/repo/check-runs",
+		"DELETE /repos/org/repo/issues/comments/99",
+		"PATCH /repos/org/repo/check-runs/99",
+	}
+	if d := cmp.Diff(want, requests); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestPRCommentWithoutPullRequest(t *testing.T) {
+	t.Setenv("GITHUB_API_URL", "")
+	t.Setenv("GITHUB_TOKEN", "ghtoken")
+
+	props := renderGitHubProps{Repository: "org/repo", SHA: "abc123"}
+	providers, err := githubProviders(context.Background(), props, CIMetadata{}, v1.GitHub{PRComment: true, CheckRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(providers) != 1 {
+		t.Fatalf("expected only the check run provider, got %d providers", len(providers))
+	}
+
+	if _, ok := providers[0].(*githubCheckRunNotifier); !ok {
+		t.Errorf("expected the check run provider, got %T", providers[0])
+	}
+}
+
+func TestCancelJob(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		if r.Header.Get("Authorization") != "Bearer configured" {
+			t.Errorf("expected the configured token to be used")
+		}
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	t.Setenv("GITHUB_ACTIONS", "")
+	if err := CancelJob(context.Background(), nil); err == nil {
+		t.Error("expected canceling to fail outside of GitHub Actions")
+	}
+
+	t.Setenv("GITHUB_ACTIONS", "true")
+	t.Setenv("GITHUB_API_URL", srv.URL)
+	t.Setenv("GITHUB_TOKEN", "ghtoken")
+	t.Setenv("GITHUB_REPOSITORY", "org/repo")
+	t.Setenv("GITHUB_RUN_ID", "1234")
+
+	if err := CancelJob(context.Background(), &v1.GitHub{Token: "configured"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := cmp.Diff([]string{"POST /repos/org/repo/actions/runs/1234/cancel"}, requests); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
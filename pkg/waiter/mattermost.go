@@ -0,0 +1,68 @@
+package waiter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+)
+
+// mattermostNotifier posts either through an incoming webhook (which can't
+// edit messages), or through the API with a bot token, which allows the
+// message to be kept up to date.
+type mattermostNotifier struct {
+	webhookURL string
+
+	serverURL string
+	token     string
+	channelID string
+	postID    string
+}
+
+func newMattermostNotifier(conf v1.Mattermost) *mattermostNotifier {
+	return &mattermostNotifier{
+		webhookURL: os.ExpandEnv(conf.WebhookURL),
+		serverURL:  strings.TrimSuffix(os.ExpandEnv(conf.ServerURL), "/"),
+		token:      os.ExpandEnv(conf.Token),
+		channelID:  os.ExpandEnv(conf.ChannelID),
+	}
+}
+
+func (m *mattermostNotifier) Name() string { return "mattermost" }
+
+func (m *mattermostNotifier) Post(ctx context.Context, msg chatMessage) error {
+	if m.webhookURL != "" {
+		return doJSON(ctx, http.MethodPost, m.webhookURL, nil, map[string]any{"text": msg.markdown()}, nil)
+	}
+
+	var resp struct {
+		ID string `json:"id"`
+	}
+
+	if err := doJSON(ctx, http.MethodPost, m.serverURL+"/api/v4/posts", m.headers(), map[string]any{
+		"channel_id": m.channelID,
+		"message":    msg.markdown(),
+	}, &resp); err != nil {
+		return err
+	}
+
+	m.postID = resp.ID
+	return nil
+}
+
+func (m *mattermostNotifier) Update(ctx context.Context, msg chatMessage) error {
+	if m.postID == "" {
+		return errUpdateUnsupported
+	}
+
+	return doJSON(ctx, http.MethodPut, fmt.Sprintf("%s/api/v4/posts/%s/patch", m.serverURL, m.postID), m.headers(), map[string]any{
+		"message": msg.markdown(),
+	}, nil)
+}
+
+func (m *mattermostNotifier) headers() map[string]string {
+	return map[string]string{"Authorization": "Bearer " + m.token}
+}
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -18,16 +20,30 @@ import (
 type botInstance struct {
 	client      *slack.Client
 	m           *Manager
+	conf        v1.SlackBot
 	githubProps renderGitHubProps
 
 	channelID string
 	ts        string
+
+	mu       sync.Mutex
+	activity []string // Who did what, through interactive controls.
+	closed   bool
+
+	events     chan Event // Posted as replies, if thread_activity is set.
+	eventsDone chan struct{}
 }
 
 func startBot(ctx context.Context, m *Manager, conf v1.SlackBot) *botInstance {
+	var opts []slack.Option
+	if conf.AppToken != "" {
+		opts = append(opts, slack.OptionAppLevelToken(os.ExpandEnv(conf.AppToken)))
+	}
+
 	bot := &botInstance{
-		client:      slack.New(os.ExpandEnv(conf.Token)),
+		client:      slack.New(os.ExpandEnv(conf.Token), opts...),
 		m:           m,
+		conf:        conf,
 		githubProps: prepareGitHubProps(ctx),
 	}
 
@@ -42,6 +58,17 @@ func startBot(ctx context.Context, m *Manager, conf v1.SlackBot) *botInstance {
 
 	go bot.loop(ctx)
 
+	if conf.AppToken != "" {
+		go bot.serveControls(ctx)
+	}
+
+	if conf.ThreadActivity {
+		bot.events = make(chan Event, 64)
+		bot.eventsDone = make(chan struct{})
+		go bot.postActivity(ctx)
+		m.Subscribe(bot.onEvent)
+	}
+
 	return bot
 }
 
@@ -49,15 +76,145 @@ func (b *botInstance) Close() error {
 	ctx, done := context.WithTimeout(context.Background(), 5*time.Second)
 	defer done()
 
+	b.mu.Lock()
+	b.closed = true
+	if b.events != nil {
+		close(b.events)
+	}
+	b.mu.Unlock()
+
+	// Make sure that the last events (e.g. resumed) are posted.
+	if b.eventsDone != nil {
+		select {
+		case <-b.eventsDone:
+		case <-ctx.Done():
+		}
+	}
+
 	return b.sendUpdate(ctx, true)
 }
 
+func (b *botInstance) onEvent(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	select {
+	case b.events <- ev:
+	default:
+		// Don't hold up the manager if Slack is slow.
+	}
+}
+
+func (b *botInstance) postActivity(ctx context.Context) {
+	defer close(b.eventsDone)
+
+	for ev := range b.events {
+		text := renderActivity(ev)
+		if text == "" {
+			continue
+		}
+
+		// Not using `ctx`, as the last events are posted while shutting down.
+		postCtx, done := context.WithTimeout(context.Background(), 10*time.Second)
+		if _, _, err := b.client.PostMessageContext(postCtx, b.channelID, slack.MsgOptionText(text, false), slack.MsgOptionTS(b.ts)); err != nil {
+			zerolog.Ctx(ctx).Err(err).Str("event", string(ev.Type)).Msg("SlackBot failed to post activity")
+		}
+		done()
+	}
+}
+
+func renderActivity(ev Event) string {
+	owner := ev.Owner
+	if owner == "" {
+		owner = "Someone"
+	}
+
+	switch ev.Type {
+	case EventConnectionOpened:
+		return fmt.Sprintf(":bust_in_silhouette: *%s* connected from `%s`.", owner, ev.RemoteAddr)
+
+	case EventConnectionClosed:
+		return fmt.Sprintf(":wave: *%s* disconnected (`%s`).", owner, ev.RemoteAddr)
+
+	case EventExtended:
+		if ev.Extension != nil && ev.Extension.Clamped {
+			return fmt.Sprintf(":stopwatch: Breakpoint extended until %s, limited because %s.", ev.Expiration.Format(Stamp), ev.Extension.ClampReason)
+		}
+
+		return fmt.Sprintf(":stopwatch: Breakpoint extended, now expires %s (%s).", humanize.Time(ev.Expiration), ev.Expiration.Format(Stamp))
+
+	case EventExpiringSoon:
+		return fmt.Sprintf(":hourglass_flowing_sand: Breakpoint expires %s (%s). Run `breakpoint extend` to keep it running.", humanize.Time(ev.Expiration), ev.Expiration.Format(Stamp))
+
+	case EventResumed:
+		switch {
+		case ev.Resume != nil && ev.Resume.Rerun:
+			return ":arrows_counterclockwise: Breakpoint resumed, running the command again."
+
+		case ev.Resume != nil && ev.Resume.ExitCode != nil && *ev.Resume.ExitCode != 0:
+			return fmt.Sprintf(":x: Breakpoint resumed, failing the workflow step (exit code %d).", *ev.Resume.ExitCode)
+		}
+
+		return ":arrow_forward: Breakpoint resumed."
+
+	case EventAccessGranted:
+		if g := ev.Grant; g != nil {
+			text := fmt.Sprintf(":key: *%s* was granted access until %s", owner, g.Expires.Format(Stamp))
+			if g.ReadOnly {
+				text += " (read-only)"
+			}
+			if g.GrantedBy != "" {
+				text += fmt.Sprintf(", invited by *%s*", g.GrantedBy)
+			}
+			return text + "."
+		}
+
+	case EventExpired:
+		if ev.Reason != "" {
+			return fmt.Sprintf(":arrow_forward: Breakpoint resumed automatically, %s.", ev.Reason)
+		}
+
+		return ":alarm_clock: Breakpoint expired."
+	}
+
+	return ""
+}
+
 func (b *botInstance) makeBlocks(leaving bool) slack.MsgOption {
+	var blocks []slack.Block
 	if leaving {
-		return slack.MsgOptionBlocks(renderGitHubMessage(b.githubProps, "", time.Time{})...)
+		blocks = renderGitHubMessage(b.githubProps, "", time.Time{}, false)
+	} else {
+		blocks = renderGitHubMessage(b.githubProps, b.m.Endpoint(), b.m.Expiration(), b.m.MaxDurationReached())
+
+		if b.conf.Text != "" {
+			text, err := RenderTemplate(b.conf.Text, b.m.TemplateContext())
+			if err != nil {
+				b.m.logger.Warn().Err(err).Msg("SlackBot failed to render text")
+			}
+
+			if text = strings.TrimSpace(text); text != "" {
+				blocks = append(blocks, slack.NewSectionBlock(slack.NewTextBlockObject(slack.MarkdownType, text, false, false), nil, nil))
+			}
+		}
+
+		if b.conf.AppToken != "" && b.m.Endpoint() != "" {
+			blocks = append(blocks, renderControls())
+		}
+	}
+
+	b.mu.Lock()
+	if len(b.activity) > 0 {
+		blocks = append(blocks, slack.NewContextBlock("",
+			slack.NewTextBlockObject(slack.MarkdownType, strings.Join(b.activity, "\n"), false, false)))
 	}
+	b.mu.Unlock()
 
-	return slack.MsgOptionBlocks(renderGitHubMessage(b.githubProps, b.m.Endpoint(), b.m.Expiration())...)
+	return slack.MsgOptionBlocks(blocks...)
 }
 
 func (b *botInstance) sendUpdate(ctx context.Context, leaving bool) error {
@@ -89,7 +246,9 @@ type renderGitHubProps struct {
 	RunID      string
 	RunNumber  string
 	Actor      string
+	SHA        string            // For pull requests, the head of the pull request.
 	PushEvent  *github.PushEvent // Only set on push events.
+	PullNumber int               // Only set on pull request events.
 }
 
 func prepareGitHubProps(ctx context.Context) renderGitHubProps {
@@ -100,21 +259,39 @@ func prepareGitHubProps(ctx context.Context) renderGitHubProps {
 		RunID:      os.Getenv("GITHUB_RUN_ID"),
 		RunNumber:  os.Getenv("GITHUB_RUN_NUMBER"),
 		Actor:      os.Getenv("GITHUB_ACTOR"),
+		SHA:        os.Getenv("GITHUB_SHA"),
 	}
 
-	if eventFile := os.Getenv("GITHUB_EVENT_PAH"); os.Getenv("GITHUB_EVENT_NAME") == "push" && eventFile != "" {
+	eventFile := os.Getenv("GITHUB_EVENT_PATH")
+	if eventFile == "" {
+		return props
+	}
+
+	switch os.Getenv("GITHUB_EVENT_NAME") {
+	case "push":
 		var pushEvent github.PushEvent
 		if err := jsonfile.Load(eventFile, &pushEvent); err != nil {
 			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to load event file")
 		} else {
 			props.PushEvent = &pushEvent
 		}
+
+	case "pull_request", "pull_request_target":
+		var prEvent github.PullRequestEvent
+		if err := jsonfile.Load(eventFile, &prEvent); err != nil {
+			zerolog.Ctx(ctx).Warn().Err(err).Msg("Failed to load event file")
+		} else {
+			props.PullNumber = prEvent.GetNumber()
+			if sha := prEvent.GetPullRequest().GetHead().GetSHA(); sha != "" {
+				props.SHA = sha
+			}
+		}
 	}
 
 	return props
 }
 
-func renderGitHubMessage(props renderGitHubProps, endpoint string, exp time.Time) []slack.Block {
+func renderGitHubMessage(props renderGitHubProps, endpoint string, exp time.Time, maxDurationReached bool) []slack.Block {
 	blocks := []slack.Block{
 		slack.NewHeaderBlock(slack.NewTextBlockObject(slack.PlainTextType, "Workflow failed", false, false)),
 		slack.NewSectionBlock(slack.NewTextBlockObject(
@@ -153,6 +330,15 @@ func renderGitHubMessage(props renderGitHubProps, endpoint string, exp time.Time
 				false, false,
 			), nil, nil),
 		)
+
+		if maxDurationReached {
+			blocks = append(blocks,
+				slack.NewSectionBlock(slack.NewTextBlockObject(
+					slack.MarkdownType,
+					"*Note:* maximum duration reached, this breakpoint can't be extended further.",
+					false, false,
+				), nil, nil))
+		}
 	}
 
 	blocks = append(blocks, slack.NewContextBlock("",
@@ -0,0 +1,192 @@
+package waiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+	"github.com/slack-go/slack/socketmode"
+	"golang.org/x/exp/slices"
+)
+
+const (
+	slackActionExtend = "breakpoint_extend"
+	slackActionResume = "breakpoint_resume"
+	slackActionFail   = "breakpoint_fail"
+
+	slackExtendBy = 30 * time.Minute
+
+	maxActivityLines = 10
+)
+
+func renderControls() slack.Block {
+	return slack.NewActionBlock("breakpoint_controls",
+		slack.NewButtonBlockElement(slackActionExtend, "",
+			slack.NewTextBlockObject(slack.PlainTextType, fmt.Sprintf("Extend %s", humanDuration(slackExtendBy)), false, false)),
+		slack.NewButtonBlockElement(slackActionResume, "",
+			slack.NewTextBlockObject(slack.PlainTextType, "Resume", false, false)).WithStyle(slack.StylePrimary),
+		slack.NewButtonBlockElement(slackActionFail, "",
+			slack.NewTextBlockObject(slack.PlainTextType, "Fail job", false, false)).WithStyle(slack.StyleDanger).
+			WithConfirm(slack.NewConfirmationBlockObject(
+				slack.NewTextBlockObject(slack.PlainTextType, "Fail job?", false, false),
+				slack.NewTextBlockObject(slack.PlainTextType, "The breakpoint is removed, and the workflow step fails.", false, false),
+				slack.NewTextBlockObject(slack.PlainTextType, "Fail job", false, false),
+				slack.NewTextBlockObject(slack.PlainTextType, "Cancel", false, false),
+			)),
+	)
+}
+
+// serveControls handles interactions with the buttons rendered by
+// renderControls. It uses Socket Mode, so the runner doesn't need to be
+// reachable by Slack.
+func (b *botInstance) serveControls(ctx context.Context) {
+	logger := zerolog.Ctx(ctx).With().Str("service", "slackbot").Logger()
+
+	client := socketmode.New(b.client)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case ev := <-client.Events:
+				switch ev.Type {
+				case socketmode.EventTypeConnectionError:
+					logger.Warn().Interface("data", ev.Data).Msg("Socket Mode connection failed")
+
+				case socketmode.EventTypeInteractive:
+					if ev.Request != nil {
+						client.Ack(*ev.Request)
+					}
+
+					if callback, ok := ev.Data.(slack.InteractionCallback); ok {
+						b.handleInteraction(ctx, logger, callback)
+					}
+				}
+			}
+		}
+	}()
+
+	if err := client.RunContext(ctx); err != nil && ctx.Err() == nil {
+		logger.Err(err).Msg("Socket Mode failed, interactive controls are not available")
+	}
+}
+
+func (b *botInstance) handleInteraction(ctx context.Context, logger zerolog.Logger, callback slack.InteractionCallback) {
+	if callback.Type != slack.InteractionTypeBlockActions || !isControlAction(callback) {
+		return
+	}
+
+	// Slack spreads interactions across all of the connections of an app
+	// token, so they may reach a different breakpoint than the one which
+	// posted the message. They can't be forwarded, so let the user know.
+	if callback.Container.MessageTs != b.ts || callback.Container.ChannelID != b.channelID {
+		logger.Warn().Str("slack_user", callback.User.ID).Str("channel", callback.Container.ChannelID).Str("message_ts", callback.Container.MessageTs).
+			Msg("Dropped interaction with another breakpoint's message; concurrent breakpoints need their own app token")
+		if _, err := b.client.PostEphemeralContext(ctx, callback.Container.ChannelID, callback.User.ID,
+			slack.MsgOptionText("This control reached a different breakpoint, which shares the same Slack app token. Each concurrent breakpoint needs its own app token.", false)); err != nil {
+			logger.Err(err).Msg("Failed to notify user")
+		}
+		return
+	}
+
+	for _, action := range callback.ActionCallback.BlockActions {
+		userLog := logger.With().Str("slack_user", callback.User.ID).Str("action", action.ActionID).Logger()
+
+		allowed, err := b.allowedToControl(ctx, callback.User.ID)
+		if err != nil {
+			userLog.Err(err).Msg("Failed to check whether user is allowed to control the breakpoint")
+		}
+
+		if !allowed {
+			userLog.Warn().Msg("Rejected interactive control")
+			if _, err := b.client.PostEphemeralContext(ctx, b.channelID, callback.User.ID,
+				slack.MsgOptionText("You're not allowed to control this breakpoint.", false)); err != nil {
+				userLog.Err(err).Msg("Failed to notify user")
+			}
+			continue
+		}
+
+		userLog.Info().Msg("Interactive control")
+
+		switch action.ActionID {
+		case slackActionExtend:
+			res := b.m.ExtendWait(slackExtendBy)
+			if res.Clamped {
+				b.recordActivity(callback.User.ID, fmt.Sprintf("extended the breakpoint, limited because %s", res.ClampReason))
+			} else {
+				b.recordActivity(callback.User.ID, fmt.Sprintf("extended the breakpoint by %s", humanDuration(slackExtendBy)))
+			}
+
+			if err := b.sendUpdate(ctx, false); err != nil {
+				userLog.Err(err).Msg("Failed to update message")
+			}
+
+		case slackActionResume:
+			b.recordActivity(callback.User.ID, "resumed the workflow")
+			b.m.StopWait(ResumeOpts{})
+
+		case slackActionFail:
+			exitCode := 1
+			b.recordActivity(callback.User.ID, "failed the job")
+			b.m.StopWait(ResumeOpts{ExitCode: &exitCode})
+		}
+	}
+}
+
+// isControlAction returns true if the interaction is with controls rendered by
+// renderControls.
+func isControlAction(callback slack.InteractionCallback) bool {
+	for _, action := range callback.ActionCallback.BlockActions {
+		switch action.ActionID {
+		case slackActionExtend, slackActionResume, slackActionFail:
+			return true
+		}
+	}
+	return false
+}
+
+func (b *botInstance) allowedToControl(ctx context.Context, userID string) (bool, error) {
+	if slices.Contains(b.conf.AllowedUsers, userID) {
+		return true, nil
+	}
+
+	if !b.conf.AllowChannelMembers {
+		return false, nil
+	}
+
+	params := &slack.GetUsersInConversationParameters{ChannelID: b.channelID, Limit: 200}
+	for {
+		members, cursor, err := b.client.GetUsersInConversationContext(ctx, params)
+		if err != nil {
+			return false, err
+		}
+
+		if slices.Contains(members, userID) {
+			return true, nil
+		}
+
+		if cursor == "" {
+			return false, nil
+		}
+
+		params.Cursor = cursor
+	}
+}
+
+func (b *botInstance) recordActivity(userID, what string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.activity = append(b.activity, fmt.Sprintf("<@%s> %s at %s.", userID, what, time.Now().Format(Stamp)))
+	if len(b.activity) > maxActivityLines {
+		b.activity = b.activity[len(b.activity)-maxActivityLines:]
+	}
+}
+
+func humanDuration(d time.Duration) string {
+	return fmt.Sprintf("%dm", int(d.Minutes()))
+}
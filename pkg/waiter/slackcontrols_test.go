@@ -0,0 +1,181 @@
+package waiter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/slack-go/slack"
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+)
+
+// fakeSlack serves the Slack API methods used by the interactive controls.
+// Channel members are returned two per page, to exercise pagination.
+type fakeSlack struct {
+	members []string
+
+	mu         sync.Mutex
+	ephemerals []string
+	updates    int
+}
+
+func (f *fakeSlack) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.TrimPrefix(r.URL.Path, "/") {
+	case "conversations.members":
+		var start int
+		if cursor := r.Form.Get("cursor"); cursor != "" {
+			start = len(cursor)
+		}
+		end := start + 2
+		if end >= len(f.members) {
+			end = len(f.members)
+		}
+		var next string
+		if end < len(f.members) {
+			next = strings.Repeat("x", end)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"ok":                true,
+			"members":           f.members[start:end],
+			"response_metadata": map[string]any{"next_cursor": next},
+		})
+
+	case "chat.postEphemeral":
+		f.ephemerals = append(f.ephemerals, r.Form.Get("channel")+" "+r.Form.Get("user")+": "+r.Form.Get("text"))
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "message_ts": "2.2"})
+
+	case "chat.update":
+		f.updates++
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": true, "channel": r.Form.Get("channel"), "ts": r.Form.Get("ts")})
+
+	default:
+		_ = json.NewEncoder(w).Encode(map[string]any{"ok": false, "error": "unknown_method"})
+	}
+}
+
+func newTestBot(t *testing.T, conf v1.SlackBot, members []string) (*botInstance, *fakeSlack, context.Context) {
+	fake := &fakeSlack{members: members}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	m, ctx := NewManager(ctx, ManagerOpts{InitialDur: time.Hour})
+	m.SetConnectionCountCallback(func() uint32 { return 0 })
+
+	return &botInstance{
+		client:    slack.New("xoxb-test", slack.OptionAPIURL(srv.URL+"/")),
+		m:         m,
+		conf:      conf,
+		channelID: "C1",
+		ts:        "1.1",
+	}, fake, ctx
+}
+
+func TestAllowedToControl(t *testing.T) {
+	members := []string{"U1", "U2", "U3", "U4", "U5"}
+
+	for _, tc := range []struct {
+		name string
+		conf v1.SlackBot
+		user string
+		want bool
+	}{
+		{"allowed user", v1.SlackBot{AllowedUsers: []string{"U9"}}, "U9", true},
+		{"not allowed", v1.SlackBot{AllowedUsers: []string{"U9"}}, "U1", false},
+		{"members not allowed", v1.SlackBot{}, "U1", false},
+		{"member", v1.SlackBot{AllowChannelMembers: true}, "U1", true},
+		{"member on last page", v1.SlackBot{AllowChannelMembers: true}, "U5", true},
+		{"not a member", v1.SlackBot{AllowChannelMembers: true}, "U6", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, _, ctx := newTestBot(t, tc.conf, members)
+
+			got, err := b.allowedToControl(ctx, tc.user)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestHandleInteraction(t *testing.T) {
+	conf := v1.SlackBot{AllowedUsers: []string{"U1"}, AllowChannelMembers: true}
+
+	for _, tc := range []struct {
+		name      string
+		user      string
+		channel   string
+		ts        string
+		action    string
+		extended  bool
+		stopped   bool
+		ephemeral string
+	}{
+		{name: "allowed user extends", user: "U1", channel: "C1", ts: "1.1", action: slackActionExtend, extended: true},
+		{name: "member resumes", user: "U2", channel: "C1", ts: "1.1", action: slackActionResume, stopped: true},
+		{name: "allowed user fails", user: "U1", channel: "C1", ts: "1.1", action: slackActionFail, stopped: true},
+		{name: "not allowed", user: "U3", channel: "C1", ts: "1.1", action: slackActionResume, ephemeral: "C1 U3: You're not allowed"},
+		{name: "other message", user: "U1", channel: "C1", ts: "9.9", action: slackActionResume, ephemeral: "C1 U1: This control reached a different breakpoint"},
+		{name: "other channel", user: "U1", channel: "C2", ts: "1.1", action: slackActionExtend, ephemeral: "C2 U1: This control reached a different breakpoint"},
+		{name: "unrelated action", user: "U1", channel: "C2", ts: "9.9", action: "other_app_action"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, fake, ctx := newTestBot(t, conf, []string{"U2"})
+			before := b.m.Expiration()
+
+			var callback slack.InteractionCallback
+			callback.Type = slack.InteractionTypeBlockActions
+			callback.User.ID = tc.user
+			callback.Container.ChannelID = tc.channel
+			callback.Container.MessageTs = tc.ts
+			callback.ActionCallback.BlockActions = []*slack.BlockAction{{ActionID: tc.action}}
+
+			b.handleInteraction(ctx, zerolog.Nop(), callback)
+
+			if extended := b.m.Expiration().After(before); extended != tc.extended {
+				t.Errorf("got extended=%v, want %v", extended, tc.extended)
+			}
+
+			if tc.stopped {
+				select {
+				case <-ctx.Done():
+				case <-time.After(10 * time.Second):
+					t.Errorf("expected the breakpoint to stop")
+				}
+			} else if ctx.Err() != nil {
+				t.Errorf("unexpected stop")
+			}
+
+			fake.mu.Lock()
+			defer fake.mu.Unlock()
+
+			if tc.extended && fake.updates != 1 {
+				t.Errorf("expected the message to be updated once, got %d", fake.updates)
+			}
+
+			switch {
+			case tc.ephemeral == "" && len(fake.ephemerals) > 0:
+				t.Errorf("unexpected ephemeral messages %v", fake.ephemerals)
+			case tc.ephemeral != "" && (len(fake.ephemerals) != 1 || !strings.HasPrefix(fake.ephemerals[0], tc.ephemeral)):
+				t.Errorf("got ephemeral messages %v, want %q", fake.ephemerals, tc.ephemeral)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package waiter
+
+import (
+	"context"
+	"net/http"
+	"os"
+
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+)
+
+// teamsNotifier posts an Adaptive Card through a Microsoft Teams incoming
+// webhook. Incoming webhooks can't edit messages, so the card is not updated.
+type teamsNotifier struct {
+	webhookURL string
+}
+
+func newTeamsNotifier(conf v1.Teams) *teamsNotifier {
+	return &teamsNotifier{webhookURL: os.ExpandEnv(conf.WebhookURL)}
+}
+
+func (t *teamsNotifier) Name() string { return "teams" }
+
+func (t *teamsNotifier) Post(ctx context.Context, msg chatMessage) error {
+	return doJSON(ctx, http.MethodPost, t.webhookURL, nil, teamsPayload(msg), nil)
+}
+
+func (t *teamsNotifier) Update(ctx context.Context, msg chatMessage) error {
+	return errUpdateUnsupported
+}
+
+func teamsPayload(msg chatMessage) map[string]any {
+	var facts []map[string]any
+	for _, f := range msg.Fields {
+		facts = append(facts, map[string]any{
+			"title": f.Name,
+			"value": f.markdown(),
+		})
+	}
+
+	return map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]any{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body": []map[string]any{
+					{"type": "TextBlock", "text": msg.Title, "size": "Large", "weight": "Bolder", "color": "Attention"},
+					{"type": "FactSet", "facts": facts},
+					{"type": "TextBlock", "text": msg.Footer, "isSubtle": true, "size": "Small"},
+				},
+			},
+		}},
+	}
+}
@@ -1,25 +1,208 @@
 package waiter
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
 	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// TemplateModeEnv expands ${VAR} references (the default).
+	TemplateModeEnv = "env"
+	// TemplateModeGo renders values as Go text/template, with a TemplateContext.
+	TemplateModeGo = "go"
 )
 
+// TemplateContext is made available to Go templates. Event fields are only
+// set when rendering webhook notifications.
+type TemplateContext struct {
+	Event
+
+	Host               string
+	Port               string
+	HostKey            string // In authorized_keys format, e.g. for known_hosts.
+	HostKeyFingerprint string
+	CI                 CIMetadata
+	AuthorizedUsers    []string
+}
+
+// CIMetadata describes the CI run that the breakpoint belongs to.
+type CIMetadata struct {
+	Provider   string // e.g. "github", empty if unknown.
+	Repository string
+	Ref        string
+	SHA        string
+	Workflow   string
+	RunID      string
+	RunNumber  string
+	RunURL     string
+	Actor      string
+}
+
+func ciMetadataFromEnv() CIMetadata {
+	if os.Getenv("GITHUB_ACTIONS") != "true" {
+		return CIMetadata{}
+	}
+
+	md := CIMetadata{
+		Provider:   "github",
+		Repository: os.Getenv("GITHUB_REPOSITORY"),
+		Ref:        os.Getenv("GITHUB_REF_NAME"),
+		SHA:        os.Getenv("GITHUB_SHA"),
+		Workflow:   os.Getenv("GITHUB_WORKFLOW"),
+		RunID:      os.Getenv("GITHUB_RUN_ID"),
+		RunNumber:  os.Getenv("GITHUB_RUN_NUMBER"),
+		Actor:      os.Getenv("GITHUB_ACTOR"),
+	}
+
+	if server := os.Getenv("GITHUB_SERVER_URL"); server != "" && md.Repository != "" && md.RunID != "" {
+		md.RunURL = fmt.Sprintf("%s/%s/actions/runs/%s", server, md.Repository, md.RunID)
+	}
+
+	return md
+}
+
+var templateFuncs = template.FuncMap{
+	"humanize": humanizeValue,
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join":  strings.Join,
+	"stamp": func(t time.Time) string { return t.Format(Stamp) },
+}
+
+// humanizeValue renders times relative to now (e.g. "in 30 minutes"), and
+// durations rounded to the second.
+func humanizeValue(v any) (string, error) {
+	switch x := v.(type) {
+	case time.Time:
+		return humanize.Time(x), nil
+	case time.Duration:
+		return x.Round(time.Second).String(), nil
+	}
+
+	return "", fmt.Errorf("humanize: unsupported type %T", v)
+}
+
+// ParseTemplate parses a Go template, with breakpoint's helper functions.
+func ParseTemplate(text string) (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).Parse(text)
+}
+
+// ValidateTemplate checks that all strings within `value` are valid in the
+// specified template mode.
+func ValidateTemplate(mode string, value any) error {
+	switch mode {
+	case "", TemplateModeEnv:
+		return nil
+
+	case TemplateModeGo:
+		var err error
+		mapStrings(value, func(str string) string {
+			if _, parseErr := ParseTemplate(str); parseErr != nil && err == nil {
+				err = parseErr
+			}
+			return str
+		})
+		return err
+	}
+
+	return fmt.Errorf("unknown template mode %q", mode)
+}
+
+// RenderTemplate renders a Go template; on failure, the error is returned
+// alongside the original text.
+func RenderTemplate(text string, tctx TemplateContext) (string, error) {
+	tmpl, err := ParseTemplate(text)
+	if err != nil {
+		return text, err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, tctx); err != nil {
+		return text, err
+	}
+
+	return out.String(), nil
+}
+
+func (m *Manager) templateContext(ev Event) TemplateContext {
+	host, port, _ := net.SplitHostPort(ev.Endpoint)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tctx := TemplateContext{
+		Event:           ev,
+		Host:            host,
+		Port:            port,
+		CI:              m.ci,
+		AuthorizedUsers: m.opts.AuthorizedUsers,
+	}
+
+	if m.hostKey != nil {
+		tctx.HostKey = strings.TrimSpace(string(gossh.MarshalAuthorizedKey(m.hostKey)))
+		tctx.HostKeyFingerprint = gossh.FingerprintSHA256(m.hostKey)
+	}
+
+	return tctx
+}
+
+// TemplateContext returns the current state of the breakpoint, for rendering templates.
+func (m *Manager) TemplateContext() TemplateContext {
+	m.mu.Lock()
+	ev := Event{
+		Time:               time.Now(),
+		Endpoint:           m.endpoint,
+		Expiration:         m.expiration,
+		MaxDurationReached: m.maxDurationReached,
+	}
+	m.mu.Unlock()
+
+	return m.templateContext(ev)
+}
+
+// execTemplate expands `${VAR}` references within every string of `value`, as
+// done for webhook payloads without Go templates.
 func execTemplate(value any, mapping func(string) string) any {
+	return mapStrings(value, func(str string) string {
+		return os.Expand(str, mapping)
+	})
+}
+
+// mapStrings applies `f` to every string within `value`, recursively.
+func mapStrings(value any, f func(string) string) any {
 	if value == nil {
 		return nil
 	}
 
 	switch x := value.(type) {
 	case map[string]any:
-		return execMapTemplate(x, mapping)
+		return mapStringsInMap(x, f)
 
 	case string:
-		return os.Expand(x, mapping)
+		return f(x)
+
+	case map[string]string:
+		out := map[string]string{}
+		for key, value := range x {
+			out[key] = f(value)
+		}
+		return out
 
 	case []any:
 		var res []any
 		for _, y := range x {
-			res = append(res, execTemplate(y, mapping))
+			res = append(res, mapStrings(y, f))
 		}
 		return res
 
@@ -29,14 +212,14 @@ func execTemplate(value any, mapping func(string) string) any {
 	return value
 }
 
-func execMapTemplate(input map[string]any, mapping func(string) string) map[string]any {
+func mapStringsInMap(input map[string]any, f func(string) string) map[string]any {
 	if input == nil {
 		return nil
 	}
 
 	out := map[string]any{}
 	for key, value := range input {
-		out[key] = execTemplate(value, mapping)
+		out[key] = mapStrings(value, f)
 	}
 
 	return out
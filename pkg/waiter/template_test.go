@@ -3,6 +3,7 @@ package waiter
 import (
 	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	v1 "namespacelabs.dev/breakpoint/api/private/v1"
@@ -71,3 +72,31 @@ func TestExecTemplate(t *testing.T) {
 	}
 
 }
+
+func TestRenderTemplate(t *testing.T) {
+	tctx := TemplateContext{
+		Event: Event{
+			Type:       EventConnectionOpened,
+			Endpoint:   "127.0.0.1:1234",
+			Expiration: time.Now().Add(time.Hour + time.Minute),
+			Owner:      "alice",
+		},
+		Host:            "127.0.0.1",
+		Port:            "1234",
+		CI:              CIMetadata{Repository: "org/repo", Actor: "bob"},
+		AuthorizedUsers: []string{"alice", "bob"},
+	}
+
+	got, err := RenderTemplate(`{{if eq .Type "connection_opened"}}{{.Owner}} connected to ssh -p {{.Port}} runner@{{.Host}} ({{.CI.Repository}}), expires {{humanize .Expiration}}; users: {{json .AuthorizedUsers}}{{end}}`, tctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := `alice connected to ssh -p 1234 runner@127.0.0.1 (org/repo), expires 1 hour from now; users: ["alice","bob"]`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := ValidateTemplate(TemplateModeGo, map[string]any{"text": "{{.Host"}); err == nil {
+		t.Errorf("expected invalid template to fail validation")
+	}
+}
@@ -2,18 +2,16 @@ package waiter
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"math"
-	"net"
 	"os"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog"
+	gossh "golang.org/x/crypto/ssh"
 	v1 "namespacelabs.dev/breakpoint/api/private/v1"
-	"namespacelabs.dev/breakpoint/pkg/webhook"
 )
 
 const (
@@ -25,39 +23,118 @@ const (
 type ManagerOpts struct {
 	InitialDur time.Duration
 
-	Webhooks  []v1.Webhook
-	SlackBots []v1.SlackBot
+	// Extension policy; zero values impose no limits.
+	MaxDuration   time.Duration // Measured from when the breakpoint started.
+	MaxExtension  time.Duration // Per call to ExtendWait.
+	MaxExtensions int
+
+	// Automatically resume if nobody connects within this long of the
+	// endpoint being allocated. Zero disables.
+	ResumeIfNoConnectionWithin time.Duration
+	// Automatically resume this long after the last connection closes. Zero disables.
+	ResumeAfterLastDisconnect time.Duration
+
+	// Who may connect to the breakpoint, made available to templates.
+	AuthorizedUsers []string
+
+	Webhooks   []v1.Webhook
+	SlackBots  []v1.SlackBot
+	Discord    []v1.Discord
+	Teams      []v1.Teams
+	Mattermost []v1.Mattermost
+	Email      []v1.Email
+	GitHub     *v1.GitHub
 }
 
 type ManagerStatus struct {
 	Endpoint       string    `json:"endpoint"`
 	Expiration     time.Time `json:"expiration"`
 	NumConnections uint32    `json:"num_connections"`
+
+	WebhookDeliveries []WebhookDelivery `json:"webhook_deliveries"`
+}
+
+type ExtendResult struct {
+	Expiration  time.Time
+	Clamped     bool   // Set if the requested extension was limited.
+	ClampReason string // Why the extension was limited.
+}
+
+// ResumeOpts are specified by whoever resumes the breakpoint.
+type ResumeOpts struct {
+	ExitCode  *int // If set, what the waiting process should exit with.
+	Rerun     bool // Re-run the command wrapped by `breakpoint run`.
+	CancelJob bool // Cancel the CI job, rather than resuming it.
+}
+
+// Outcome describes how a breakpoint ended.
+type Outcome struct {
+	ResumeOpts
+
+	Expired bool // Set if the breakpoint expired, or was automatically resumed.
 }
 
 type Manager struct {
 	ctx    context.Context
 	logger zerolog.Logger
 
-	opts ManagerOpts
+	opts     ManagerOpts
+	webhooks *webhookDispatcher // Set at construction, if webhooks are configured.
+
+	// Held while delivering an event, so that subscribers observe events in
+	// the order in which they were emitted. Acquired before mu.
+	emitMu sync.Mutex
 
 	mu                      sync.Mutex
 	updated                 chan struct{}
+	connectionsChanged      chan struct{}
+	started                 time.Time
 	expiration              time.Time
+	extensions              int
+	maxDurationReached      bool
+	stopped                 bool
+	outcome                 Outcome
+	warnedFor               time.Time // The expiration for which EventExpiringSoon was emitted.
+	subscribers             []func(Event)
 	endpoint                string
+	allocated               time.Time
 	resources               []io.Closer
 	connectionCountCallback func() uint32
+	numConnections          uint32
+	everConnected           bool
+	disconnected            chan struct{} // Closed, and replaced, when the last connection closes.
+	holds                   int           // Number of HoldWhileConnected calls in progress.
+	lastDisconnect          time.Time
+	hostKey                 gossh.PublicKey
+	ci                      CIMetadata
+	grants                  []AccessGrant
 }
 
 func NewManager(ctx context.Context, opts ManagerOpts) (*Manager, context.Context) {
 	ctx, cancel := context.WithCancel(ctx)
 	l := zerolog.Ctx(ctx).With().Logger()
+	now := time.Now()
 	m := &Manager{
-		ctx:        ctx,
-		logger:     l,
-		opts:       opts,
-		updated:    make(chan struct{}, 1),
-		expiration: time.Now().Add(opts.InitialDur),
+		ctx:                ctx,
+		logger:             l,
+		opts:               opts,
+		updated:            make(chan struct{}, 1),
+		connectionsChanged: make(chan struct{}, 1),
+		disconnected:       make(chan struct{}),
+		started:            now,
+		expiration:         now.Add(opts.InitialDur),
+		ci:                 ciMetadataFromEnv(),
+	}
+
+	if max := m.maxExpiration(); !max.IsZero() && m.expiration.After(max) {
+		l.Warn().Dur("duration", opts.InitialDur).Dur("max_duration", opts.MaxDuration).Msg("Initial duration exceeds the maximum duration")
+		m.expiration = max
+		m.maxDurationReached = true
+	}
+
+	if len(opts.Webhooks) > 0 {
+		m.webhooks = startWebhooks(m, opts.Webhooks)
+		m.resources = append(m.resources, m.webhooks)
 	}
 
 	go func() {
@@ -87,12 +164,42 @@ func (m *Manager) Wait() error {
 }
 
 func (m *Manager) loop(ctx context.Context) {
-	exitTimer := time.NewTicker(time.Until(m.expiration))
+	exitTimer := time.NewTimer(time.Until(m.Expiration()))
 	defer exitTimer.Stop()
 
 	logTicker := time.NewTicker(logTick())
 	defer logTicker.Stop()
 
+	idleTimer := time.NewTimer(math.MaxInt64)
+	defer idleTimer.Stop()
+
+	warnTimer := time.NewTimer(math.MaxInt64)
+	defer warnTimer.Stop()
+
+	resetWarnTimer := func() {
+		if deadline, ok := m.warnDeadline(); ok {
+			warnTimer.Reset(time.Until(deadline))
+		} else {
+			warnTimer.Stop()
+		}
+	}
+
+	resetExitTimer := func() {
+		if deadline, ok := m.exitDeadline(); ok {
+			exitTimer.Reset(time.Until(deadline))
+		} else {
+			exitTimer.Stop()
+		}
+	}
+
+	resetIdleTimer := func() {
+		if deadline, ok := m.idleDeadline(); ok {
+			idleTimer.Reset(time.Until(deadline))
+		} else {
+			idleTimer.Stop()
+		}
+	}
+
 	for {
 		select {
 		case _, ok := <-m.updated:
@@ -100,16 +207,56 @@ func (m *Manager) loop(ctx context.Context) {
 				return
 			}
 
+			resetExitTimer()
+			resetIdleTimer()
+			resetWarnTimer()
+			m.announce()
+
+		case <-warnTimer.C:
+			// The expiration may have moved since the timer was armed.
+			if deadline, ok := m.warnDeadline(); !ok || time.Now().Before(deadline) {
+				resetWarnTimer()
+				continue
+			}
+
 			m.mu.Lock()
-			newExp := m.expiration
+			m.warnedFor = m.expiration
 			m.mu.Unlock()
 
-			exitTimer.Reset(time.Until(newExp))
-			m.announce()
+			m.emit(Event{Type: EventExpiringSoon})
+
+		case <-m.connectionsChanged:
+			resetExitTimer()
+			resetIdleTimer()
+
+		case <-idleTimer.C:
+			// The deadline may have moved since the timer was armed.
+			if deadline, ok := m.idleDeadline(); !ok || time.Now().Before(deadline) {
+				resetIdleTimer()
+				continue
+			}
+
+			var reason string
+			if m.connectedOnce() {
+				reason = fmt.Sprintf("no active connections for %v", m.opts.ResumeAfterLastDisconnect)
+			} else {
+				reason = fmt.Sprintf("nobody connected within %v", m.opts.ResumeIfNoConnectionWithin)
+			}
+
+			m.logger.Info().Str("reason", reason).Msg("Resuming automatically")
+			m.setExpired(reason)
+			return
 
 		case <-exitTimer.C:
+			// The deadline may have moved since the timer was armed.
+			if deadline, ok := m.exitDeadline(); !ok || time.Now().Before(deadline) {
+				resetExitTimer()
+				continue
+			}
+
 			// Timer has expired, terminate the program
 			m.logger.Info().Msg("Breakpoint expired")
+			m.setExpired("")
 			return
 
 		case <-logTicker.C:
@@ -130,32 +277,206 @@ func logTick() time.Duration {
 	return math.MaxInt64
 }
 
-func (m *Manager) ExtendWait(dur time.Duration) time.Time {
+// ExtendWait extends the breakpoint by `dur`, within the extension policy.
+// EventExtended is only emitted if the expiration changed; if the policy
+// refused the extension, that's only reported in the result.
+func (m *Manager) ExtendWait(dur time.Duration) ExtendResult {
+	res, extended := m.extendWait(dur)
+	if extended {
+		m.emit(Event{Type: EventExtended, Extension: &res})
+	}
+	return res
+}
+
+func (m *Manager) extendWait(dur time.Duration) (ExtendResult, bool) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.expiration = m.expiration.Add(dur)
+	var res ExtendResult
+	clamp := func(reason string) {
+		res.Clamped = true
+		res.ClampReason = reason
+	}
+
+	switch {
+	case m.opts.MaxExtensions > 0 && m.extensions >= m.opts.MaxExtensions:
+		clamp(fmt.Sprintf("the breakpoint was already extended the maximum of %d times", m.opts.MaxExtensions))
+		dur = 0
+
+	case m.opts.MaxExtension > 0 && dur > m.opts.MaxExtension:
+		clamp(fmt.Sprintf("extensions are limited to %v each", m.opts.MaxExtension))
+		dur = m.opts.MaxExtension
+	}
 
-	m.updated <- struct{}{}
+	newExp := m.expiration.Add(dur)
+	if max := m.maxExpiration(); !max.IsZero() && !newExp.Before(max) {
+		if newExp.After(max) {
+			clamp(fmt.Sprintf("the breakpoint can't run for longer than %v", m.opts.MaxDuration))
+		}
+
+		newExp = max
+		m.maxDurationReached = true
+	}
+
+	extended := newExp.After(m.expiration)
+	if extended {
+		m.extensions++
+		m.expiration = newExp
+	}
+
+	m.signalUpdate()
+
+	res.Expiration = m.expiration
 
 	m.logger.Info().
 		Dur("dur", dur).
 		Time("expiration", m.expiration).
+		Bool("clamped", res.Clamped).
+		Str("clamp_reason", res.ClampReason).
 		Msg("Extend wait")
-	return m.expiration
+	return res, extended
+}
+
+// exitDeadline returns when the breakpoint expires. While it is held with
+// HoldWhileConnected, it only expires once the maximum duration is reached.
+func (m *Manager) exitDeadline() (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.holds > 0 && m.numConnections > 0 {
+		max := m.maxExpiration()
+		if max.IsZero() {
+			return time.Time{}, false
+		}
+
+		if max.After(m.expiration) {
+			return max, true
+		}
+	}
+
+	return m.expiration, true
+}
+
+// HoldWhileConnected keeps the breakpoint from expiring while there are active
+// connections, up to the maximum duration. Holding doesn't count as an
+// extension. It returns once there are no active connections, the breakpoint
+// ends, or ctx is canceled.
+func (m *Manager) HoldWhileConnected(ctx context.Context) {
+	m.mu.Lock()
+	if m.numConnections == 0 {
+		m.mu.Unlock()
+		return
+	}
+
+	m.holds++
+	disconnected := m.disconnected
+	m.signalUpdate()
+	m.mu.Unlock()
+
+	defer func() {
+		m.mu.Lock()
+		m.holds--
+		m.signalUpdate()
+		m.mu.Unlock()
+	}()
+
+	select {
+	case <-disconnected:
+	case <-m.ctx.Done():
+	case <-ctx.Done():
+	}
+}
+
+func (m *Manager) maxExpiration() time.Time {
+	if m.opts.MaxDuration <= 0 {
+		return time.Time{}
+	}
+
+	return m.started.Add(m.opts.MaxDuration)
 }
 
-func (m *Manager) StopWait() {
-	m.logger.Info().Msg("Resume requested")
+func (m *Manager) StopWait(opts ResumeOpts) {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return
+	}
+
+	ev := m.logger.Info().Bool("rerun", opts.Rerun).Bool("cancel_job", opts.CancelJob)
+	if opts.ExitCode != nil {
+		ev = ev.Int("exit_code", *opts.ExitCode)
+	}
+	ev.Msg("Resume requested")
+
+	m.stopped = true
+	m.outcome = Outcome{ResumeOpts: opts}
+	m.mu.Unlock()
+
+	// Emit before waking up the loop, so that subscribers observe the event
+	// before they are closed. No other updates are signaled once stopped.
+	m.emit(Event{Type: EventResumed, Resume: &opts})
 	close(m.updated)
 }
 
+func (m *Manager) setExpired(reason string) {
+	m.mu.Lock()
+	if m.stopped {
+		m.mu.Unlock()
+		return
+	}
+	// Once expired, the breakpoint can't be resumed anymore.
+	m.stopped = true
+	m.outcome = Outcome{Expired: true}
+	m.mu.Unlock()
+
+	m.emit(Event{Type: EventExpired, Reason: reason})
+}
+
+// warnDeadline returns when EventExpiringSoon should be emitted, if at all.
+func (m *Manager) warnDeadline() (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.endpoint == "" || m.warnedFor.Equal(m.expiration) {
+		return time.Time{}, false
+	}
+
+	return m.expiration.Add(-expiringSoonWarning), true
+}
+
+// Outcome returns how the breakpoint ended; only meaningful after Wait returns.
+func (m *Manager) Outcome() Outcome {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.outcome
+}
+
+// signalUpdate must be called with mu held. It never blocks: a pending update
+// already covers any subsequent changes.
+func (m *Manager) signalUpdate() {
+	if m.stopped {
+		return
+	}
+
+	select {
+	case m.updated <- struct{}{}:
+	default:
+	}
+}
+
 func (m *Manager) Expiration() time.Time {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	return m.expiration
 }
 
+// MaxDurationReached returns true if the breakpoint can't be extended any further.
+func (m *Manager) MaxDurationReached() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.maxDurationReached
+}
+
 func (m *Manager) Endpoint() string {
 	m.mu.Lock()
 	defer m.mu.Unlock()
@@ -165,16 +486,32 @@ func (m *Manager) Endpoint() string {
 func (m *Manager) Status() ManagerStatus {
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return ManagerStatus{
+	status := ManagerStatus{
 		Endpoint:       m.endpoint,
 		Expiration:     m.expiration,
 		NumConnections: m.connectionCountCallback(),
 	}
+
+	if m.webhooks != nil {
+		status.WebhookDeliveries = m.webhooks.Deliveries()
+	}
+
+	return status
+}
+
+// SetHostKey records the ssh server's host key, which is made available to templates.
+func (m *Manager) SetHostKey(key gossh.PublicKey) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.hostKey = key
 }
 
 func (m *Manager) SetEndpoint(addr string) {
 	m.mu.Lock()
 	m.endpoint = addr
+	if m.allocated.IsZero() {
+		m.allocated = time.Now()
+	}
 	m.mu.Unlock()
 
 	var resources []io.Closer
@@ -184,58 +521,104 @@ func (m *Manager) SetEndpoint(addr string) {
 		}
 	}
 
-	m.mu.Lock()
-	m.resources = resources
-	m.mu.Unlock()
-
-	m.updated <- struct{}{}
-
-	expandf := expand(addr, m.Expiration())
+	var providers []chatProvider
+	for _, conf := range m.opts.Discord {
+		providers = append(providers, newDiscordNotifier(conf))
+	}
+	for _, conf := range m.opts.Teams {
+		providers = append(providers, newTeamsNotifier(conf))
+	}
+	for _, conf := range m.opts.Mattermost {
+		providers = append(providers, newMattermostNotifier(conf))
+	}
 
-	for _, wh := range m.opts.Webhooks {
-		ctx, done := context.WithTimeout(m.ctx, 30*time.Second)
-		defer done()
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		if err := writeGitHubStepInfo(m.TemplateContext()); err != nil {
+			m.logger.Warn().Err(err).Msg("Failed to write GitHub step information")
+		}
+	}
 
-		payload := execTemplate(wh.Payload, expandf)
+	if m.opts.GitHub != nil {
+		ghProviders, err := githubProviders(m.ctx, prepareGitHubProps(m.ctx), m.ci, *m.opts.GitHub)
+		if err != nil {
+			m.logger.Warn().Err(err).Msg("Failed to set up GitHub integration")
+		}
+		providers = append(providers, ghProviders...)
+	}
 
-		t := time.Now()
-		if err := webhook.Notify(ctx, os.Expand(wh.URL, expandf), payload); err != nil {
-			m.logger.Err(err).Msg("Failed to notify Webhook")
-		} else {
-			m.logger.Info().Dur("took", time.Since(t)).Str("url", wh.URL).Msg("Notified webhook")
+	for _, p := range providers {
+		if n := startChatNotifier(m.ctx, m, p); n != nil {
+			resources = append(resources, n)
 		}
 	}
-}
 
-func (m *Manager) SetConnectionCountCallback(callback func() uint32) {
+	for _, conf := range m.opts.Email {
+		resources = append(resources, startEmailNotifier(m.ctx, m, conf))
+	}
+
 	m.mu.Lock()
-	m.connectionCountCallback = callback
+	m.resources = append(m.resources, resources...)
+	m.signalUpdate()
 	m.mu.Unlock()
+
+	m.emit(Event{Type: EventAllocated})
 }
 
-func expand(addr string, exp time.Time) func(key string) string {
-	host, port, _ := net.SplitHostPort(addr)
+// ConnectionsChanged is called whenever connections are opened or closed, and
+// drives automatic resumption of idle breakpoints.
+func (m *Manager) ConnectionsChanged() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-	return func(key string) string {
-		switch key {
-		case "BREAKPOINT_ENDPOINT":
-			return addr
+	if m.connectionCountCallback == nil {
+		return
+	}
 
-		case "BREAKPOINT_HOST":
-			return host
+	n := m.connectionCountCallback()
+	if n > 0 {
+		m.everConnected = true
+	} else if m.numConnections > 0 {
+		m.lastDisconnect = time.Now()
+		close(m.disconnected)
+		m.disconnected = make(chan struct{})
+	}
+	m.numConnections = n
+
+	select {
+	case m.connectionsChanged <- struct{}{}:
+	default:
+	}
+}
 
-		case "BREAKPOINT_PORT":
-			return port
+// idleDeadline returns when the breakpoint should be automatically resumed, if at all.
+func (m *Manager) idleDeadline() (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-		case "BREAKPOINT_TIME_LEFT":
-			return strings.TrimSpace(humanize.RelTime(exp, time.Now(), "", ""))
+	switch {
+	case m.allocated.IsZero() || m.numConnections > 0:
+		return time.Time{}, false
 
-		case "BREAKPOINT_EXPIRATION":
-			return exp.Format(Stamp)
-		}
+	case !m.everConnected && m.opts.ResumeIfNoConnectionWithin > 0:
+		return m.allocated.Add(m.opts.ResumeIfNoConnectionWithin), true
 
-		return os.Getenv(key)
+	case m.everConnected && m.opts.ResumeAfterLastDisconnect > 0:
+		return m.lastDisconnect.Add(m.opts.ResumeAfterLastDisconnect), true
 	}
+
+	return time.Time{}, false
+}
+
+func (m *Manager) connectedOnce() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.everConnected
+}
+
+func (m *Manager) SetConnectionCountCallback(callback func() uint32) {
+	m.mu.Lock()
+	m.connectionCountCallback = callback
+	m.mu.Unlock()
 }
 
 func (m *Manager) announce() {
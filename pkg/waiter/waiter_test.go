@@ -0,0 +1,470 @@
+package waiter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/atomic"
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+)
+
+func TestExtendWaitPolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _ := NewManager(ctx, ManagerOpts{
+		InitialDur:    10 * time.Minute,
+		MaxDuration:   50 * time.Minute,
+		MaxExtension:  20 * time.Minute,
+		MaxExtensions: 3,
+	})
+	m.SetConnectionCountCallback(func() uint32 { return 0 })
+
+	initial := m.Expiration()
+
+	if res := m.ExtendWait(10 * time.Minute); res.Clamped || !res.Expiration.Equal(initial.Add(10*time.Minute)) {
+		t.Errorf("expected unclamped extension, got %+v", res)
+	}
+
+	if res := m.ExtendWait(30 * time.Minute); !res.Clamped || !res.Expiration.Equal(initial.Add(30*time.Minute)) {
+		t.Errorf("expected extension to be clamped to 20m, got %+v", res)
+	}
+
+	if m.MaxDurationReached() {
+		t.Errorf("max duration should not have been reached yet")
+	}
+
+	if res := m.ExtendWait(20 * time.Minute); !res.Clamped || !res.Expiration.Equal(m.started.Add(50*time.Minute)) {
+		t.Errorf("expected extension to be clamped to max duration, got %+v", res)
+	}
+
+	if !m.MaxDurationReached() {
+		t.Errorf("max duration should have been reached")
+	}
+
+	if res := m.ExtendWait(time.Minute); !res.Clamped || !res.Expiration.Equal(m.started.Add(50*time.Minute)) {
+		t.Errorf("expected no further extensions, got %+v", res)
+	}
+}
+
+func TestRefusedExtensionIsNotAnnounced(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _ := NewManager(ctx, ManagerOpts{
+		InitialDur:    10 * time.Minute,
+		MaxDuration:   30 * time.Minute,
+		MaxExtensions: 2,
+	})
+	m.SetConnectionCountCallback(func() uint32 { return 0 })
+
+	var extensions []ExtendResult
+	m.Subscribe(func(ev Event) {
+		if ev.Type == EventExtended {
+			extensions = append(extensions, *ev.Extension)
+		}
+	})
+
+	m.ExtendWait(30 * time.Minute) // Clamped to the maximum duration.
+
+	// Refused: the maximum duration was reached.
+	if res := m.ExtendWait(time.Minute); !res.Clamped {
+		t.Errorf("expected extension to be refused, got %+v", res)
+	}
+
+	if len(extensions) != 1 || !extensions[0].Clamped {
+		t.Errorf("expected a single (clamped) extension event, got %+v", extensions)
+	}
+
+	m2, _ := NewManager(ctx, ManagerOpts{InitialDur: 10 * time.Minute, MaxExtensions: 1})
+	m2.SetConnectionCountCallback(func() uint32 { return 0 })
+
+	var events int
+	m2.Subscribe(func(ev Event) {
+		if ev.Type == EventExtended {
+			events++
+		}
+	})
+
+	m2.ExtendWait(time.Minute)
+
+	// Refused: no extensions left.
+	if res := m2.ExtendWait(time.Minute); !res.Clamped {
+		t.Errorf("expected extension to be refused, got %+v", res)
+	}
+
+	if events != 1 {
+		t.Errorf("expected a single extension event, got %d", events)
+	}
+}
+
+func TestAutoResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conns := atomic.NewUint32(0)
+	m, mctx := NewManager(ctx, ManagerOpts{
+		InitialDur:                 time.Hour,
+		ResumeIfNoConnectionWithin: 100 * time.Millisecond,
+		ResumeAfterLastDisconnect:  200 * time.Millisecond,
+	})
+	m.SetConnectionCountCallback(conns.Load)
+	m.SetEndpoint("127.0.0.1:1234")
+
+	// Someone connects in time, which keeps the breakpoint alive.
+	time.Sleep(50 * time.Millisecond)
+	conns.Store(1)
+	m.ConnectionsChanged()
+
+	select {
+	case <-mctx.Done():
+		t.Fatal("breakpoint resumed while connected")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	conns.Store(0)
+	m.ConnectionsChanged()
+
+	select {
+	case <-mctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("breakpoint was not resumed after the last disconnect")
+	}
+}
+
+func TestHoldWhileConnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conns := atomic.NewUint32(1)
+	m, mctx := NewManager(ctx, ManagerOpts{InitialDur: 200 * time.Millisecond, MaxExtensions: 1})
+	m.SetConnectionCountCallback(conns.Load)
+	m.ConnectionsChanged()
+
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		m.HoldWhileConnected(context.Background())
+	}()
+
+	select {
+	case <-mctx.Done():
+		t.Fatal("breakpoint expired while held")
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// Holding doesn't count as an extension.
+	if res := m.ExtendWait(time.Minute); res.Clamped {
+		t.Errorf("extension was clamped: %s", res.ClampReason)
+	}
+
+	conns.Store(0)
+	m.ConnectionsChanged()
+
+	select {
+	case <-held:
+	case <-time.After(5 * time.Second):
+		t.Fatal("hold did not return after the last disconnect")
+	}
+
+	// Without a connection, there's nothing to hold.
+	m.HoldWhileConnected(context.Background())
+}
+
+func TestConcurrentEventsAreOrdered(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _ := NewManager(ctx, ManagerOpts{InitialDur: 10 * time.Minute})
+
+	var first, second []time.Time
+	m.Subscribe(func(ev Event) { first = append(first, ev.Time) })
+	m.Subscribe(func(ev Event) { second = append(second, ev.Time) })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.ConnectionOpened("alice", "127.0.0.1:1234")
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(first) != 1000 {
+		t.Fatalf("expected 1000 events, got %d", len(first))
+	}
+
+	for i := 1; i < len(first); i++ {
+		if first[i].Before(first[i-1]) {
+			t.Fatalf("event %d was delivered out of order", i)
+		}
+	}
+
+	if d := cmp.Diff(first, second); d != "" {
+		t.Errorf("subscribers observed different orders (-first +second):\n%s", d)
+	}
+}
+
+func TestExpireAndResumeRace(t *testing.T) {
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		m, mctx := NewManager(ctx, ManagerOpts{InitialDur: time.Millisecond})
+		m.SetConnectionCountCallback(func() uint32 { return 0 })
+
+		var mu sync.Mutex
+		var events []EventType
+		m.Subscribe(func(ev Event) {
+			mu.Lock()
+			events = append(events, ev.Type)
+			mu.Unlock()
+		})
+
+		time.Sleep(time.Duration(i%3) * time.Millisecond)
+		exitCode := 1
+		m.StopWait(ResumeOpts{ExitCode: &exitCode})
+		<-mctx.Done()
+
+		mu.Lock()
+		got := events
+		mu.Unlock()
+
+		outcome := m.Outcome()
+		switch {
+		case len(got) != 1:
+			t.Fatalf("expected a single event, got %v", got)
+		case got[0] == EventExpired && (!outcome.Expired || outcome.ExitCode != nil):
+			t.Fatalf("expired, but the outcome is %+v", outcome)
+		case got[0] == EventResumed && (outcome.Expired || outcome.ExitCode == nil):
+			t.Fatalf("resumed, but the outcome is %+v", outcome)
+		}
+
+		cancel()
+	}
+}
+
+func TestAccessGranted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _ := NewManager(ctx, ManagerOpts{InitialDur: 10 * time.Minute})
+
+	var events []Event
+	m.Subscribe(func(ev Event) { events = append(events, ev) })
+
+	now := time.Now()
+	m.AccessGranted(AccessGrant{Owner: "bob", GrantedBy: "alice", Expires: now.Add(-time.Minute)})
+	m.AccessGranted(AccessGrant{Owner: "carol", GrantedBy: "alice", Expires: now.Add(15 * time.Minute), ReadOnly: true})
+
+	if len(events) != 2 || events[1].Type != EventAccessGranted || events[1].Owner != "carol" || !events[1].Grant.ReadOnly {
+		t.Fatalf("unexpected events %+v", events)
+	}
+
+	if got := renderActivity(events[1]); got != fmt.Sprintf(":key: *carol* was granted access until %s (read-only), invited by *alice*.", now.Add(15*time.Minute).Format(Stamp)) {
+		t.Errorf("unexpected activity %q", got)
+	}
+
+	// Expired grants are no longer listed.
+	if grants := m.Grants(); len(grants) != 1 || grants[0].Owner != "carol" {
+		t.Errorf("unexpected grants %+v", grants)
+	}
+}
+
+func TestLifecycleWebhooks(t *testing.T) {
+	var mu sync.Mutex
+	var received []map[string]any
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("failed to decode payload: %v", err)
+		}
+
+		mu.Lock()
+		received = append(received, payload)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, mctx := NewManager(ctx, ManagerOpts{
+		InitialDur: time.Hour,
+		Webhooks: []v1.Webhook{{
+			URL:    srv.URL + "/${BREAKPOINT_EVENT}",
+			Events: []string{"allocated", "resumed"},
+			Payload: map[string]any{
+				"event":     "${BREAKPOINT_EVENT}",
+				"host":      "${BREAKPOINT_HOST}",
+				"exit_code": "${BREAKPOINT_EXIT_CODE}",
+			},
+		}},
+	})
+	m.SetConnectionCountCallback(func() uint32 { return 0 })
+	m.SetEndpoint("127.0.0.1:1234")
+	m.ExtendWait(time.Minute) // Not subscribed.
+
+	code := 3
+	m.StopWait(ResumeOpts{ExitCode: &code})
+
+	select {
+	case <-mctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("breakpoint did not stop")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(received) != 2 {
+		t.Fatalf("expected 2 notifications, got %v", received)
+	}
+
+	if received[0]["event"] != "allocated" || received[0]["host"] != "127.0.0.1" {
+		t.Errorf("unexpected allocated payload: %v", received[0])
+	}
+
+	if received[1]["event"] != "resumed" || received[1]["exit_code"] != "3" {
+		t.Errorf("unexpected resumed payload: %v", received[1])
+	}
+}
+
+func TestGoTemplateWebhookExpandsEnv(t *testing.T) {
+	t.Setenv("WEBHOOK_SECRET", "s3cret")
+
+	received := make(chan *http.Request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _ := NewManager(ctx, ManagerOpts{
+		InitialDur: time.Hour,
+		Webhooks: []v1.Webhook{{
+			URL:      srv.URL + "/{{.Type}}?token=${WEBHOOK_SECRET}",
+			Template: TemplateModeGo,
+			Headers:  map[string]string{"Authorization": "Bearer ${WEBHOOK_SECRET}", "X-Host": "{{.Host}}"},
+			Payload:  map[string]any{"host": "{{.Host}}"},
+		}},
+	})
+	m.SetConnectionCountCallback(func() uint32 { return 0 })
+	m.SetEndpoint("127.0.0.1:1234")
+
+	select {
+	case r := <-received:
+		if r.URL.Path != "/allocated" || r.URL.Query().Get("token") != "s3cret" {
+			t.Errorf("unexpected url %q", r.URL)
+		}
+
+		if got := r.Header.Get("Authorization"); got != "Bearer s3cret" {
+			t.Errorf("unexpected Authorization header %q", got)
+		}
+
+		if got := r.Header.Get("X-Host"); got != "127.0.0.1" {
+			t.Errorf("unexpected X-Host header %q", got)
+		}
+
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not notified")
+	}
+}
+
+func TestChatNotifierErrorsOmitURL(t *testing.T) {
+	// Nothing listens on the server's address once it's closed.
+	srv := httptest.NewServer(http.NotFoundHandler())
+	srv.Close()
+
+	webhookURL := srv.URL + "/hooks/s3cr3t"
+
+	for _, p := range []chatProvider{
+		newDiscordNotifier(v1.Discord{WebhookURL: webhookURL}),
+		newTeamsNotifier(v1.Teams{WebhookURL: webhookURL}),
+		newMattermostNotifier(v1.Mattermost{WebhookURL: webhookURL}),
+		newDiscordNotifier(v1.Discord{WebhookURL: "http://host/hooks/s3cr3t\x7f"}),
+	} {
+		err := p.Post(context.Background(), chatMessage{Title: "Breakpoint"})
+		if err == nil {
+			t.Errorf("%s: expected delivery to fail", p.Name())
+		} else if strings.Contains(err.Error(), "s3cr3t") {
+			t.Errorf("%s: error includes the webhook url: %v", p.Name(), err)
+		}
+	}
+}
+
+func TestDiscordNotifierUpdatesMessage(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		if r.Method == http.MethodPost {
+			if r.URL.Query().Get("wait") != "true" {
+				t.Errorf("expected wait=true")
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{"id": "42"})
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, mctx := NewManager(ctx, ManagerOpts{
+		InitialDur: time.Hour,
+		Discord:    []v1.Discord{{WebhookURL: srv.URL + "/api/webhooks/1/token"}},
+	})
+	m.SetConnectionCountCallback(func() uint32 { return 0 })
+	m.SetEndpoint("127.0.0.1:1234")
+	m.ExtendWait(time.Minute)
+
+	// Wait for the extension to be reflected.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(requests)
+		mu.Unlock()
+
+		if n >= 2 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("message was not updated")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	m.StopWait(ResumeOpts{})
+	<-mctx.Done()
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	want := []string{
+		"POST /api/webhooks/1/token",
+		"PATCH /api/webhooks/1/token/messages/42",
+		"PATCH /api/webhooks/1/token/messages/42",
+	}
+	if d := cmp.Diff(want, requests); d != "" {
+		t.Errorf("mismatch (-want +got):\n%s", d)
+	}
+}
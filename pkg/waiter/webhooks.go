@@ -0,0 +1,294 @@
+package waiter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/rs/zerolog"
+	"golang.org/x/exp/slices"
+	v1 "namespacelabs.dev/breakpoint/api/private/v1"
+	"namespacelabs.dev/breakpoint/pkg/webhook"
+)
+
+// Webhooks which don't specify events are only notified on allocation.
+var defaultWebhookEvents = []string{string(EventAllocated)}
+
+// How many deliveries are kept for `breakpoint status`.
+const maxDeliveryLog = 20
+
+var AllEvents = []EventType{
+	EventAllocated,
+	EventConnectionOpened,
+	EventConnectionClosed,
+	EventExtended,
+	EventExpiringSoon,
+	EventResumed,
+	EventExpired,
+	EventAccessGranted,
+}
+
+type webhookDispatcher struct {
+	m        *Manager
+	logger   zerolog.Logger
+	ctx      context.Context
+	webhooks []v1.Webhook
+
+	mu         sync.Mutex
+	closed     bool
+	events     chan Event
+	done       chan struct{}
+	deliveries []WebhookDelivery
+}
+
+// WebhookDelivery records the outcome of a webhook notification.
+type WebhookDelivery struct {
+	Time       time.Time `json:"time"`
+	Event      EventType `json:"event"`
+	URL        string    `json:"url"` // Before expansion, so secrets are not leaked.
+	Attempts   int       `json:"attempts"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func startWebhooks(m *Manager, webhooks []v1.Webhook) *webhookDispatcher {
+	d := &webhookDispatcher{
+		m:        m,
+		logger:   m.logger,
+		ctx:      m.ctx,
+		webhooks: webhooks,
+		events:   make(chan Event, 64),
+		done:     make(chan struct{}),
+	}
+
+	go d.loop()
+	m.Subscribe(d.onEvent)
+
+	return d
+}
+
+func (d *webhookDispatcher) onEvent(ev Event) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return
+	}
+
+	select {
+	case d.events <- ev:
+	default:
+		d.logger.Warn().Str("event", string(ev.Type)).Msg("Too many pending webhook notifications, dropping event")
+	}
+}
+
+func (d *webhookDispatcher) Close() error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.events)
+	}
+	d.mu.Unlock()
+
+	// Give a chance for the last events (e.g. resumed) to be delivered.
+	select {
+	case <-d.done:
+	case <-time.After(30 * time.Second):
+		d.logger.Warn().Msg("Timed out delivering webhook notifications")
+	}
+
+	return nil
+}
+
+func (d *webhookDispatcher) loop() {
+	defer close(d.done)
+
+	for ev := range d.events {
+		for _, wh := range d.webhooks {
+			events := wh.Events
+			if len(events) == 0 {
+				events = defaultWebhookEvents
+			}
+
+			if !slices.Contains(events, string(ev.Type)) {
+				continue
+			}
+
+			d.notify(wh, ev)
+		}
+	}
+}
+
+func (d *webhookDispatcher) notify(wh v1.Webhook, ev Event) {
+	// Not using the manager's context, as the last events are delivered while shutting down.
+	// The timeout covers all retries.
+	ctx, done := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer done()
+
+	render := d.renderer(wh, ev)
+
+	var payload any
+	if wh.Template == TemplateModeGo {
+		payload = mapStrings(wh.Payload, render)
+	} else {
+		payload = execTemplate(wh.Payload, expand(ev))
+	}
+
+	// With Go templates, environment variables (e.g. secrets) are still
+	// expanded in the url and headers, before rendering.
+	renderWithEnv := render
+	if wh.Template == TemplateModeGo {
+		renderWithEnv = func(str string) string {
+			return render(os.ExpandEnv(str))
+		}
+	}
+
+	opts := webhook.Options{
+		Secret:  os.ExpandEnv(wh.Secret),
+		Retries: wh.Retries,
+	}
+
+	if wh.RetryBackoff != "" {
+		opts.Backoff, _ = time.ParseDuration(wh.RetryBackoff) // Validated when loading the config.
+	}
+
+	if len(wh.Headers) > 0 {
+		opts.Headers = map[string]string{}
+		for k, v := range wh.Headers {
+			opts.Headers[k] = renderWithEnv(v)
+		}
+	}
+
+	t := time.Now()
+	res, err := webhook.Deliver(ctx, renderWithEnv(wh.URL), payload, opts)
+	if err != nil {
+		d.logger.Err(err).Str("url", wh.URL).Str("event", string(ev.Type)).Int("attempts", res.Attempts).Msg("Failed to notify Webhook")
+	} else {
+		d.logger.Info().Dur("took", time.Since(t)).Str("url", wh.URL).Str("event", string(ev.Type)).Int("attempts", res.Attempts).Msg("Notified webhook")
+	}
+
+	delivery := WebhookDelivery{
+		Time:       t,
+		Event:      ev.Type,
+		URL:        wh.URL,
+		Attempts:   res.Attempts,
+		StatusCode: res.StatusCode,
+	}
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	d.mu.Lock()
+	d.deliveries = append(d.deliveries, delivery)
+	if len(d.deliveries) > maxDeliveryLog {
+		d.deliveries = d.deliveries[len(d.deliveries)-maxDeliveryLog:]
+	}
+	d.mu.Unlock()
+}
+
+func (d *webhookDispatcher) renderer(wh v1.Webhook, ev Event) func(string) string {
+	if wh.Template != TemplateModeGo {
+		expandf := expand(ev)
+		return func(str string) string {
+			return os.Expand(str, expandf)
+		}
+	}
+
+	tctx := d.m.templateContext(ev)
+	return func(str string) string {
+		out, err := RenderTemplate(str, tctx)
+		if err != nil {
+			d.logger.Warn().Err(err).Str("url", wh.URL).Msg("Failed to render webhook template")
+		}
+		return out
+	}
+}
+
+func (d *webhookDispatcher) Deliveries() []WebhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return slices.Clone(d.deliveries)
+}
+
+func expand(ev Event) func(key string) string {
+	host, port, _ := net.SplitHostPort(ev.Endpoint)
+
+	return func(key string) string {
+		switch key {
+		case "BREAKPOINT_EVENT":
+			return string(ev.Type)
+
+		case "BREAKPOINT_ENDPOINT":
+			return ev.Endpoint
+
+		case "BREAKPOINT_HOST":
+			return host
+
+		case "BREAKPOINT_PORT":
+			return port
+
+		case "BREAKPOINT_TIME_LEFT":
+			return strings.TrimSpace(humanize.RelTime(ev.Expiration, time.Now(), "", ""))
+
+		case "BREAKPOINT_EXPIRATION":
+			return ev.Expiration.Format(Stamp)
+
+		case "BREAKPOINT_MAX_DURATION_REACHED":
+			return fmt.Sprintf("%v", ev.MaxDurationReached)
+
+		// Connection events.
+		case "BREAKPOINT_OWNER":
+			return ev.Owner
+
+		case "BREAKPOINT_REMOTE_ADDR":
+			return ev.RemoteAddr
+
+		// Extensions.
+		case "BREAKPOINT_CLAMPED":
+			return fmt.Sprintf("%v", ev.Extension != nil && ev.Extension.Clamped)
+
+		case "BREAKPOINT_CLAMP_REASON":
+			if ev.Extension != nil {
+				return ev.Extension.ClampReason
+			}
+			return ""
+
+		// Resumption.
+		case "BREAKPOINT_EXIT_CODE":
+			if ev.Resume != nil && ev.Resume.ExitCode != nil {
+				return fmt.Sprintf("%d", *ev.Resume.ExitCode)
+			}
+			return ""
+
+		case "BREAKPOINT_RERUN":
+			return fmt.Sprintf("%v", ev.Resume != nil && ev.Resume.Rerun)
+
+		// Expiration.
+		case "BREAKPOINT_REASON":
+			return ev.Reason
+
+		// Granted access.
+		case "BREAKPOINT_GRANTED_BY":
+			if ev.Grant != nil {
+				return ev.Grant.GrantedBy
+			}
+			return ""
+
+		case "BREAKPOINT_ACCESS_EXPIRES":
+			if ev.Grant != nil {
+				return ev.Grant.Expires.Format(Stamp)
+			}
+			return ""
+
+		case "BREAKPOINT_READ_ONLY":
+			return fmt.Sprintf("%v", ev.Grant != nil && ev.Grant.ReadOnly)
+		}
+
+		return os.Getenv(key)
+	}
+}
@@ -3,35 +3,132 @@ package webhook
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"namespacelabs.dev/breakpoint/pkg/httperrors"
 )
 
 const (
 	userAgent = "Breakpoint/1.0"
+
+	// SignatureHeader holds `t=<unix timestamp>,v1=<hex signature>`, where the
+	// signature is the HMAC-SHA256 of `<unix timestamp>.<body>`. Receivers
+	// should reject deliveries whose timestamp is too old, to prevent replays.
+	SignatureHeader = "X-Breakpoint-Signature"
+	TimestampHeader = "X-Breakpoint-Timestamp"
+
+	defaultBackoff = time.Second
+	maxBackoff     = 30 * time.Second
 )
 
+type Options struct {
+	Headers map[string]string
+	// If set, deliveries are signed with this secret.
+	Secret string
+	// How many times to retry failed deliveries.
+	Retries int
+	// How long to wait before the first retry; doubled on each retry.
+	Backoff time.Duration
+}
+
+// Result describes a (possibly failed) delivery.
+type Result struct {
+	Attempts   int
+	StatusCode int // Of the last attempt, zero if no response was received.
+}
+
 func Notify(ctx context.Context, endpoint string, payload any) error {
+	_, err := Deliver(ctx, endpoint, payload, Options{})
+	return err
+}
+
+// Deliver posts `payload` to `endpoint`, retrying with exponential backoff on
+// network errors, 5xx and 429 responses.
+func Deliver(ctx context.Context, endpoint string, payload any, opts Options) (Result, error) {
+	var res Result
+
 	body, err := json.Marshal(payload)
 	if err != nil {
-		return err
+		return res, err
+	}
+
+	backoff := opts.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	for {
+		res.Attempts++
+
+		var retryable bool
+		res.StatusCode, retryable, err = post(ctx, endpoint, body, opts)
+		if err == nil || !retryable || res.Attempts > opts.Retries {
+			return res, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return res, err
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
 	}
+}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewBuffer(body))
+func post(ctx context.Context, endpoint string, body []byte, opts Options) (int, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
 	if err != nil {
-		return err
+		return 0, false, httperrors.WithoutURL(err)
+	}
+
+	for k, v := range opts.Headers {
+		req.Header.Set(k, v)
 	}
 
 	req.Header.Set("User-Agent", userAgent)
 	req.Header.Set("Content-Type", "application/json")
+
+	if opts.Secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, ts)
+		req.Header.Set(SignatureHeader, fmt.Sprintf("t=%s,v1=%s", ts, Sign(opts.Secret, ts, body)))
+	}
+
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		return err
+		// Retry on network errors, unless we were cancelled.
+		return 0, ctx.Err() == nil, httperrors.WithoutURL(err)
 	}
 
 	defer resp.Body.Close()
 
-	return httperrors.MaybeError(resp)
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return resp.StatusCode, false, nil
+	}
+
+	err = httperrors.MaybeError(resp)
+	retryable := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return resp.StatusCode, retryable, err
+}
+
+// Sign computes the signature of a delivery, as sent in SignatureHeader.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
 }
@@ -0,0 +1,86 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliverRetriesAndSigns(t *testing.T) {
+	var attempts int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		ts := r.Header.Get(TimestampHeader)
+		if want := fmt.Sprintf("t=%s,v1=%s", ts, Sign("s3cr3t", ts, body)); r.Header.Get(SignatureHeader) != want {
+			t.Errorf("bad signature: got %q, want %q", r.Header.Get(SignatureHeader), want)
+		}
+
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("missing custom header")
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	res, err := Deliver(context.Background(), srv.URL, map[string]any{"hello": "world"}, Options{
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		Secret:  "s3cr3t",
+		Retries: 3,
+		Backoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Attempts != 3 || res.StatusCode != http.StatusNoContent {
+		t.Errorf("unexpected result: %+v", res)
+	}
+}
+
+func TestDeliverDoesNotRetryClientErrors(t *testing.T) {
+	var attempts int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	res, err := Deliver(context.Background(), srv.URL, nil, Options{Retries: 3, Backoff: time.Millisecond})
+	if err == nil {
+		t.Fatal("expected delivery to fail")
+	}
+
+	if res.Attempts != 1 || attempts != 1 {
+		t.Errorf("expected a single attempt, got %d", attempts)
+	}
+}
+
+func TestDeliverErrorsOmitURL(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Close() // Connections are refused.
+
+	for _, endpoint := range []string{srv.URL + "/hooks/secret-path?token=secret-token", "http://[::1%zz/?token=secret-token"} {
+		_, err := Deliver(context.Background(), endpoint, nil, Options{})
+		if err == nil {
+			t.Fatalf("expected delivery to %q to fail", endpoint)
+		}
+
+		if strings.Contains(err.Error(), "secret") {
+			t.Errorf("expected error not to include the URL, got %q", err)
+		}
+	}
+}